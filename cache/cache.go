@@ -0,0 +1,357 @@
+// Package cache implements a cache for DNS replies. Replies are cached under the question name, type and
+// class of the query and its DO and CD bits. A reply is cached as a whole: positive replies expire with the
+// lowest TTL of all the RRs in the answer, authority and additional sections. NXDOMAIN and NODATA replies
+// are cached as specified in RFC 2308: for the lower of that and the TTL and minimum field of the SOA
+// record in the authority section. Cached replies are returned with TTLs that are
+// decremented by the time they spent in the cache. When Stale is set, expired replies are kept and served
+// when the upstream can not be reached, as described in RFC 8767.
+//
+// A Cache can be put in front of a Client:
+//
+//	cache := &cache.Cache{}
+//	c := &dns.Client{Wrap: cache.Wrap}
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dnsv2"
+)
+
+const (
+	// DefaultSize is the default maximum number of replies in a Cache.
+	DefaultSize = 10000
+	// DefaultMaxTTL is the default maximum time a positive reply is cached.
+	DefaultMaxTTL = 24 * time.Hour
+	// DefaultMaxNegativeTTL is the default maximum time a negative reply is cached, RFC 2308 section 5.
+	DefaultMaxNegativeTTL = 3 * time.Hour
+)
+
+// Cache is a cache of DNS replies. When it is full the least recently used reply is evicted. The zero Cache
+// is ready to use. A Cache is safe for concurrent use.
+type Cache struct {
+	// Size is the maximum number of replies in the cache, if zero DefaultSize is used.
+	Size int
+	// MinTTL is the minimum time a reply is cached, the TTLs of shorter lived RRsets are raised to it.
+	MinTTL time.Duration
+	// MaxTTL is the maximum time a positive reply is cached, the TTLs of longer lived RRsets are lowered to
+	// it. If zero DefaultMaxTTL is used.
+	MaxTTL time.Duration
+	// MaxNegativeTTL is the maximum time a NXDOMAIN or NODATA reply is cached, if zero
+	// DefaultMaxNegativeTTL is used.
+	MaxNegativeTTL time.Duration
+
+	// Stale is the time expired replies are kept around to be served stale when the upstream fails, see
+	// RFC 8767. If zero, expired replies are not kept.
+	Stale time.Duration
+	// StaleTTL is the TTL of the RRs in a stale reply. It is also the time an upstream that failed to refresh
+	// a reply is left alone. If zero DefaultStaleTTL is used.
+	StaleTTL time.Duration
+	// StaleTimeout is the time Wrap waits for the upstream before it answers with a stale reply, the
+	// refresh continues in the background. If zero DefaultStaleTimeout is used.
+	StaleTimeout time.Duration
+
+	mu      sync.Mutex
+	entries map[key]*list.Element
+	lru     list.List // of *entry, most recently used first
+
+	now func() time.Time // for testing
+}
+
+type key struct {
+	name          string
+	qtype, qclass uint16
+	do, cd        bool
+}
+
+type entry struct {
+	key    key
+	data   []byte    // the reply, with the TTLs as they were when it was stored
+	rcode  uint16    // the rcode of the reply
+	stored time.Time // when the reply was stored
+	expire time.Time // when the first RRset in the reply expires
+
+	// For serving stale, these are protected by Cache.mu.
+	refreshing bool      // a background refresh is in progress
+	retry      time.Time // when the upstream may be asked again, after a failed refresh
+}
+
+// Get returns the cached reply for the query m, or nil if there is none. The reply has the ID and question
+// of m and its TTLs are decremented by the time the reply has been in the cache.
+func (c *Cache) Get(m *dns.Msg) *dns.Msg {
+	k, ok := keyOf(m)
+	if !ok {
+		return nil
+	}
+	now := c.clock()
+
+	c.mu.Lock()
+	el, ok := c.entries[k]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	e := el.Value.(*entry)
+	if !now.Before(e.expire) {
+		if !now.Before(e.expire.Add(c.Stale)) {
+			c.remove(el)
+		}
+		c.mu.Unlock()
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	c.mu.Unlock()
+
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	return e.reply(m, func(ttl uint32) uint32 { return ttl - min(ttl, elapsed) })
+}
+
+// Set stores r, the reply to the query m, in the cache. Only replies with rcode NOERROR or NXDOMAIN are
+// stored, truncated replies and replies that do not answer the question of m are not. A negative reply is
+// only stored when it has a SOA record in the authority section.
+func (c *Cache) Set(m, r *dns.Msg) {
+	k, ok := keyOf(m)
+	if !ok || r.Truncated || len(r.Question) == 0 || !sameQuestion(m.Question[0], r.Question[0]) {
+		return
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return
+	}
+	if len(r.Data) == 0 {
+		if err := r.Pack(); err != nil {
+			return
+		}
+	}
+
+	// Work on a copy, as the TTLs are changed.
+	cp := &dns.Msg{Data: bytes.Clone(r.Data)}
+	if err := cp.Unpack(); err != nil {
+		return
+	}
+	// Signed replies are not cached, and cookies are specific to a single exchange.
+	pseudo := cp.Pseudo[:0]
+	for _, rr := range cp.Pseudo {
+		switch rr.(type) {
+		case *dns.TSIG:
+			return
+		case *dns.COOKIE:
+			continue
+		}
+		pseudo = append(pseudo, rr)
+	}
+	cp.Pseudo = pseudo
+	ttl, ok := c.ttl(cp, k.qtype)
+	if !ok || ttl == 0 {
+		return
+	}
+	cp.Data = nil
+	if err := cp.Pack(); err != nil {
+		return
+	}
+
+	now := c.clock()
+	e := &entry{key: k, data: cp.Data, rcode: cp.Rcode, stored: now, expire: now.Add(time.Duration(ttl) * time.Second)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[key]*list.Element{}
+	}
+	if el, ok := c.entries[k]; ok {
+		c.remove(el)
+	}
+	c.entries[k] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size() {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Len returns the number of replies in the cache, this includes expired replies that have not been evicted
+// yet and stale replies.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Wrap returns a RoundTripper that answers queries from the cache and that stores the replies it gets from
+// rt. It has the signature of dns.Client's Wrap field. When Stale is set and rt fails, or does not reply
+// within StaleTimeout, an expired reply is returned with GetStale.
+func (c *Cache) Wrap(network string, rt dns.RoundTripper) dns.RoundTripper {
+	return dns.RoundTripperFunc(func(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, error) {
+		if r := c.Get(m); r != nil {
+			return r, nil
+		}
+		if c.Stale > 0 {
+			if e, query := c.stale(m); e != nil {
+				return c.refresh(ctx, rt, m, address, e, query)
+			}
+		}
+		r, err := rt.RoundTrip(ctx, m, address)
+		if err == nil {
+			c.Set(m, r)
+		}
+		return r, err
+	})
+}
+
+// ttl normalizes the TTLs of m: all RRs in an RRset get the lowest TTL of the set, and the TTLs are capped.
+// For a negative reply the SOA record gets the negative TTL. It returns the time m may be cached, in seconds.
+// If m is a negative reply without a SOA record, false is returned.
+func (c *Cache) ttl(m *dns.Msg, qtype uint16) (uint32, bool) {
+	var soa *dns.SOA
+	if negative(m, qtype) {
+		for _, rr := range m.Ns {
+			if s, ok := rr.(*dns.SOA); ok {
+				soa = s
+				break
+			}
+		}
+		if soa == nil {
+			return 0, false
+		}
+	}
+	negttl := uint32(0)
+	if soa != nil {
+		negttl = capTTL(min(soa.Hdr.TTL, soa.Minttl), c.MinTTL, c.maxNegativeTTL())
+	}
+
+	ttl := uint32(math.MaxUint32)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		ttl = min(ttl, normalize(section, c.MinTTL, c.maxTTL()))
+	}
+	if soa != nil {
+		// RFC 2308 section 5, the SOA TTL is the negative TTL, which bounds the other RRs as well.
+		soa.Hdr.TTL = negttl
+		ttl = min(ttl, negttl)
+	}
+	return ttl, true
+}
+
+// normalize sets the TTL of each RRset in rrs to the lowest TTL in the set, within the bounds minTTL and
+// maxTTL. It returns the lowest TTL found.
+func normalize(rrs []dns.RR, minTTL, maxTTL time.Duration) uint32 {
+	type set struct {
+		name          string
+		rrtype, class uint16
+	}
+	ttls := map[set]uint32{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		s := set{strings.ToLower(h.Name), dns.RRToType(rr), h.Class}
+		if ttl, ok := ttls[s]; !ok || h.TTL < ttl {
+			ttls[s] = h.TTL
+		}
+	}
+	lowest := uint32(math.MaxUint32)
+	for _, rr := range rrs {
+		h := rr.Header()
+		h.TTL = capTTL(ttls[set{strings.ToLower(h.Name), dns.RRToType(rr), h.Class}], minTTL, maxTTL)
+		lowest = min(lowest, h.TTL)
+	}
+	return lowest
+}
+
+// reply returns the cached reply for the query m, with its TTLs set by ttl and with options added to its
+// pseudo section.
+func (e *entry) reply(m *dns.Msg, ttl func(uint32) uint32, options ...dns.RR) *dns.Msg {
+	r := &dns.Msg{Data: bytes.Clone(e.data)}
+	if err := r.Unpack(); err != nil {
+		return nil
+	}
+	r.ID = m.ID
+	r.Question = m.Question[:1]
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			h.TTL = ttl(h.TTL)
+		}
+	}
+	r.Pseudo = append(r.Pseudo, options...)
+	r.Data = nil
+	if err := r.Pack(); err != nil {
+		return nil
+	}
+	return r
+}
+
+// negative returns true if m is a NXDOMAIN reply, or a NODATA reply for qtype: a reply without records of
+// that type in the answer section.
+func negative(m *dns.Msg, qtype uint16) bool {
+	if m.Rcode == dns.RcodeNameError {
+		return true
+	}
+	for _, rr := range m.Answer {
+		if dns.RRToType(rr) == qtype {
+			return false
+		}
+	}
+	return true
+}
+
+func keyOf(m *dns.Msg) (key, bool) {
+	if len(m.Question) == 0 {
+		return key{}, false
+	}
+	q := m.Question[0]
+	h := q.Header()
+	return key{strings.ToLower(h.Name), dns.RRToType(q), classOf(q), m.Security, m.CheckingDisabled}, true
+}
+
+func sameQuestion(a, b dns.RR) bool {
+	return dns.RRToType(a) == dns.RRToType(b) && classOf(a) == classOf(b) &&
+		strings.EqualFold(a.Header().Name, b.Header().Name)
+}
+
+// classOf returns the class of rr, a zero class is sent as ClassINET.
+func classOf(rr dns.RR) uint16 {
+	if c := rr.Header().Class; c != 0 {
+		return c
+	}
+	return dns.ClassINET
+}
+
+func capTTL(ttl uint32, minTTL, maxTTL time.Duration) uint32 {
+	lo, hi := uint32(minTTL/time.Second), uint32(maxTTL/time.Second)
+	return max(min(ttl, hi), lo)
+}
+
+// remove removes el from the cache, c.mu must be held.
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*entry).key)
+}
+
+func (c *Cache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *Cache) size() int {
+	if c.Size > 0 {
+		return c.Size
+	}
+	return DefaultSize
+}
+
+func (c *Cache) maxTTL() time.Duration {
+	if c.MaxTTL > 0 {
+		return c.MaxTTL
+	}
+	return DefaultMaxTTL
+}
+
+func (c *Cache) maxNegativeTTL() time.Duration {
+	if c.MaxNegativeTTL > 0 {
+		return c.MaxNegativeTTL
+	}
+	return DefaultMaxNegativeTTL
+}
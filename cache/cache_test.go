@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dnsv2"
+)
+
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// newCache sets up c with a fake clock.
+func newCache(c *Cache) (*Cache, *clock) {
+	clk := &clock{t: time.Unix(1700000000, 0)}
+	c.now = clk.now
+	return c, clk
+}
+
+func query(name string, qtype uint16) *dns.Msg { return question(name, qtype, false) }
+
+func question(name string, qtype uint16, do bool) *dns.Msg {
+	q := dns.TypeToRR[qtype]()
+	*q.Header() = dns.Header{Name: name, Class: dns.ClassINET}
+	m := &dns.Msg{MsgHeader: dns.MsgHeader{ID: dns.ID(), RecursionDesired: true}, Question: []dns.RR{q}}
+	if do {
+		m.UDPSize, m.Security = 1232, true
+	}
+	return m
+}
+
+func reply(t *testing.T, req *dns.Msg, rcode uint16, answer, ns []string) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg).SetReply(req)
+	m.Rcode = rcode
+	for _, s := range answer {
+		m.Answer = append(m.Answer, mustRR(t, s))
+	}
+	for _, s := range ns {
+		m.Ns = append(m.Ns, mustRR(t, s))
+	}
+	if err := m.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.New(s)
+	if err != nil {
+		t.Fatalf("bad record %q: %v", s, err)
+	}
+	return rr
+}
+
+func ttls(m *dns.Msg) []uint32 {
+	var ttls []uint32
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			ttls = append(ttls, rr.Header().TTL)
+		}
+	}
+	return ttls
+}
+
+func TestCache(t *testing.T) {
+	c, clk := newCache(&Cache{})
+	req := query("example.org.", dns.TypeA)
+	c.Set(req, reply(t, req, dns.RcodeSuccess,
+		[]string{"example.org. 300 IN A 192.0.2.1", "example.org. 100 IN A 192.0.2.2"},
+		[]string{"example.org. 600 IN NS ns.example.org."},
+	))
+
+	clk.advance(40 * time.Second)
+	req = query("Example.ORG.", dns.TypeA)
+	r := c.Get(req)
+	if r == nil {
+		t.Fatal("expected cached reply")
+	}
+	if r.ID != req.ID || r.Question[0].Header().Name != "Example.ORG." {
+		t.Errorf("expected ID and question of the query, got %d %s", r.ID, r.Question[0].Header().Name)
+	}
+	if got := fmt.Sprint(ttls(r)); got != "[60 60 560]" {
+		t.Errorf("expected TTLs [60 60 560], got %s", got)
+	}
+
+	if r := c.Get(question("example.org.", dns.TypeA, true)); r != nil {
+		t.Errorf("expected a miss for a query with DO set, got %v", r)
+	}
+	if r := c.Get(query("example.org.", dns.TypeAAAA)); r != nil {
+		t.Errorf("expected a miss for AAAA, got %v", r)
+	}
+	// A zero class is sent as INET.
+	noclass := query("example.org.", dns.TypeA)
+	noclass.Question[0].Header().Class = 0
+	if r := c.Get(noclass); r == nil {
+		t.Error("expected a hit for a query without a class")
+	}
+
+	clk.advance(60 * time.Second)
+	if r := c.Get(req); r != nil {
+		t.Errorf("expected expired reply, got %v", r)
+	}
+	if c.Len() != 0 {
+		t.Errorf("expected expired reply to be removed, got %d replies", c.Len())
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	c, clk := newCache(&Cache{})
+	soa := "example.org. 3600 IN SOA ns.example.org. hostmaster.example.org. 1 7200 3600 1209600 300"
+
+	nx := query("nx.example.org.", dns.TypeA)
+	c.Set(nx, reply(t, nx, dns.RcodeNameError, nil, []string{soa}))
+	nodata := query("example.org.", dns.TypeMX)
+	c.Set(nodata, reply(t, nodata, dns.RcodeSuccess, nil, []string{soa}))
+	nosoa := query("nosoa.example.org.", dns.TypeA)
+	c.Set(nosoa, reply(t, nosoa, dns.RcodeNameError, nil, nil))
+	servfail := query("servfail.example.org.", dns.TypeA)
+	c.Set(servfail, reply(t, servfail, dns.RcodeServerFailure, nil, nil))
+
+	if c.Len() != 2 {
+		t.Fatalf("expected 2 cached replies, got %d", c.Len())
+	}
+
+	clk.advance(100 * time.Second)
+	r := c.Get(nx)
+	if r == nil || r.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected cached NXDOMAIN, got %v", r)
+	}
+	if got := fmt.Sprint(ttls(r)); got != "[200]" {
+		t.Errorf("expected SOA TTL from its minimum field, got %s", got)
+	}
+	if r := c.Get(nodata); r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Errorf("expected cached NODATA, got %v", r)
+	}
+
+	clk.advance(200 * time.Second)
+	if r := c.Get(nx); r != nil {
+		t.Errorf("expected expired NXDOMAIN, got %v", r)
+	}
+}
+
+func TestCacheCaps(t *testing.T) {
+	c, _ := newCache(&Cache{MinTTL: 60 * time.Second, MaxTTL: time.Hour, MaxNegativeTTL: 30 * time.Second})
+	req := query("example.org.", dns.TypeA)
+	c.Set(req, reply(t, req, dns.RcodeSuccess,
+		[]string{"example.org. 10 IN A 192.0.2.1"},
+		[]string{"example.org. 86400 IN NS ns.example.org."},
+	))
+	if got := fmt.Sprint(ttls(c.Get(req))); got != "[60 3600]" {
+		t.Errorf("expected capped TTLs [60 3600], got %s", got)
+	}
+
+	c.MinTTL = 0
+	nx := query("nx.example.org.", dns.TypeA)
+	c.Set(nx, reply(t, nx, dns.RcodeNameError, nil,
+		[]string{"example.org. 3600 IN SOA ns.example.org. hostmaster.example.org. 1 7200 3600 1209600 300"}))
+	if got := fmt.Sprint(ttls(c.Get(nx))); got != "[30]" {
+		t.Errorf("expected negative TTL capped to [30], got %s", got)
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c, _ := newCache(&Cache{Size: 2})
+	reqs := []*dns.Msg{query("a.example.org.", dns.TypeA), query("b.example.org.", dns.TypeA), query("c.example.org.", dns.TypeA)}
+	set := func(req *dns.Msg) {
+		c.Set(req, reply(t, req, dns.RcodeSuccess, []string{req.Question[0].Header().Name + " 300 IN A 192.0.2.1"}, nil))
+	}
+
+	set(reqs[0])
+	set(reqs[1])
+	c.Get(reqs[0]) // b is now the least recently used
+	set(reqs[2])
+
+	if c.Len() != 2 {
+		t.Fatalf("expected 2 cached replies, got %d", c.Len())
+	}
+	if c.Get(reqs[1]) != nil {
+		t.Errorf("expected b.example.org. to be evicted")
+	}
+	if c.Get(reqs[0]) == nil || c.Get(reqs[2]) == nil {
+		t.Errorf("expected a.example.org. and c.example.org. to be cached")
+	}
+}
+
+func TestCacheWrap(t *testing.T) {
+	c, _ := newCache(&Cache{})
+	queries := 0
+	rt := c.Wrap("udp", dns.RoundTripperFunc(func(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, error) {
+		queries++
+		return reply(t, m, dns.RcodeSuccess, []string{"example.org. 300 IN A 192.0.2.1"}, nil), nil
+	}))
+
+	for range 3 {
+		r, err := rt.RoundTrip(context.Background(), query("example.org.", dns.TypeA), "192.0.2.53:53")
+		if err != nil || len(r.Answer) != 1 {
+			t.Fatalf("expected an answer, got %v, %v", r, err)
+		}
+	}
+	if queries != 1 {
+		t.Errorf("expected 1 query, got %d", queries)
+	}
+}
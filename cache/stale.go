@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/miekg/dnsv2"
+)
+
+const (
+	// DefaultStaleTTL is the default TTL of stale replies, RFC 8767 section 4.
+	DefaultStaleTTL = 30 * time.Second
+	// DefaultStaleTimeout is the default time to wait for the upstream before answering stale, this is the
+	// "client response timer" of RFC 8767 section 5.
+	DefaultStaleTimeout = 1800 * time.Millisecond
+)
+
+// refreshTimeout bounds a background refresh, as it is no longer tied to the context of the query.
+const refreshTimeout = 10 * time.Second
+
+// GetStale returns the expired reply for the query m, or nil if there is none or if it is not expired. The
+// reply has the ID and question of m, all TTLs are set to StaleTTL and when m has EDNS an extended error
+// with ExtendedErrorStaleAnswer, or ExtendedErrorStaleNXDOMAINAnswer, is added.
+func (c *Cache) GetStale(m *dns.Msg) *dns.Msg {
+	k, ok := keyOf(m)
+	if !ok {
+		return nil
+	}
+	now := c.clock()
+
+	c.mu.Lock()
+	el, ok := c.entries[k]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	e := el.Value.(*entry)
+	if now.Before(e.expire) || !now.Before(e.expire.Add(c.Stale)) {
+		c.mu.Unlock()
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	c.mu.Unlock()
+
+	return c.staleReply(e, m)
+}
+
+func (c *Cache) staleReply(e *entry, m *dns.Msg) *dns.Msg {
+	ttl := uint32(c.staleTTL() / time.Second)
+	if m.UDPSize == 0 {
+		return e.reply(m, func(uint32) uint32 { return ttl })
+	}
+	ede := &dns.EDE{InfoCode: dns.ExtendedErrorStaleAnswer}
+	if e.rcode == dns.RcodeNameError {
+		ede.InfoCode = dns.ExtendedErrorStaleNXDOMAINAnswer
+	}
+	return e.reply(m, func(uint32) uint32 { return ttl }, ede)
+}
+
+// stale returns the stale entry for the query m, or nil if there is none. If a stale entry is returned,
+// query tells if the upstream should be asked to refresh it. Only a single refresh is done at a time, and
+// after a failed refresh the upstream is left alone for StaleTTL.
+func (c *Cache) stale(m *dns.Msg) (e *entry, query bool) {
+	k, ok := keyOf(m)
+	if !ok {
+		return nil, false
+	}
+	now := c.clock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[k]
+	if !ok {
+		return nil, false
+	}
+	e = el.Value.(*entry)
+	if now.Before(e.expire) || !now.Before(e.expire.Add(c.Stale)) {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	if e.refreshing || now.Before(e.retry) {
+		return e, false
+	}
+	e.refreshing = true
+	return e, true
+}
+
+// refresh asks rt to refresh the stale entry e for the query m. If the upstream replies within StaleTimeout
+// that reply is returned, otherwise, or if it fails, the stale reply is returned and the refresh continues in
+// the background.
+func (c *Cache) refresh(ctx context.Context, rt dns.RoundTripper, m *dns.Msg, address string, e *entry, query bool) (*dns.Msg, error) {
+	if !query {
+		return c.staleReply(e, m), nil
+	}
+
+	// The refresh outlives this call, so it can not use m, nor ctx's cancellation.
+	q := &dns.Msg{Data: bytes.Clone(m.Data)}
+	if err := q.Unpack(); err != nil {
+		c.refreshed(e, false)
+		return nil, err
+	}
+	type result struct {
+		r   *dns.Msg
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+		defer cancel()
+		r, err := rt.RoundTrip(ctx, q, address)
+		ok := err == nil && (r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError)
+		if ok {
+			c.Set(q, r)
+		}
+		c.refreshed(e, ok)
+		done <- result{r, err}
+	}()
+
+	timer := time.NewTimer(c.staleTimeout())
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		if res.err == nil && (res.r.Rcode == dns.RcodeSuccess || res.r.Rcode == dns.RcodeNameError) {
+			return res.r, nil
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return c.staleReply(e, m), nil
+}
+
+// refreshed records the outcome of a refresh of e.
+func (c *Cache) refreshed(e *entry, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.refreshing = false
+	if !ok {
+		e.retry = c.clock().Add(c.staleTTL())
+	}
+}
+
+func (c *Cache) staleTTL() time.Duration {
+	if c.StaleTTL > 0 {
+		return c.StaleTTL
+	}
+	return DefaultStaleTTL
+}
+
+func (c *Cache) staleTimeout() time.Duration {
+	if c.StaleTimeout > 0 {
+		return c.StaleTimeout
+	}
+	return DefaultStaleTimeout
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dnsv2"
+)
+
+func TestGetStale(t *testing.T) {
+	c, clk := newCache(&Cache{Stale: time.Hour})
+	req := question("example.org.", dns.TypeA, true)
+	c.Set(req, reply(t, req, dns.RcodeSuccess, []string{"example.org. 60 IN A 192.0.2.1"}, nil))
+
+	if r := c.GetStale(req); r != nil {
+		t.Errorf("expected no stale reply for a fresh entry, got %v", r)
+	}
+
+	clk.advance(2 * time.Minute)
+	if r := c.Get(req); r != nil {
+		t.Errorf("expected expired reply, got %v", r)
+	}
+	r := c.GetStale(req)
+	if r == nil {
+		t.Fatal("expected stale reply")
+	}
+	if got := fmt.Sprint(ttls(r)); got != "[30]" {
+		t.Errorf("expected stale TTL [30], got %s", got)
+	}
+	if ede := staleEDE(r); ede == nil || ede.InfoCode != dns.ExtendedErrorStaleAnswer {
+		t.Errorf("expected extended error %q, got %v", dns.ExtendedErrorToString[dns.ExtendedErrorStaleAnswer], r.Pseudo)
+	}
+	if r := c.GetStale(query("example.org.", dns.TypeA)); r != nil {
+		t.Errorf("expected miss for a query without DO, got %v", r)
+	}
+
+	clk.advance(time.Hour)
+	if r := c.GetStale(req); r != nil {
+		t.Errorf("expected no stale reply after the stale window, got %v", r)
+	}
+	c.Get(req)
+	if c.Len() != 0 {
+		t.Errorf("expected entry to be removed after the stale window, got %d replies", c.Len())
+	}
+}
+
+func TestWrapStale(t *testing.T) {
+	c, clk := newCache(&Cache{Stale: time.Hour, StaleTimeout: 10 * time.Millisecond})
+	var queries atomic.Int32
+	fail := atomic.Bool{}
+	release := make(chan struct{})
+	rt := c.Wrap("udp", dns.RoundTripperFunc(func(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, error) {
+		queries.Add(1)
+		if fail.Load() {
+			return nil, errors.New("upstream down")
+		}
+		if queries.Load() > 3 {
+			<-release
+		}
+		return reply(t, m, dns.RcodeSuccess, []string{"example.org. 60 IN A 192.0.2.1"}, nil), nil
+	}))
+	exchange := func() *dns.Msg {
+		t.Helper()
+		m := question("example.org.", dns.TypeA, true)
+		m.Pack()
+		r, err := rt.RoundTrip(context.Background(), m, "192.0.2.53:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	exchange()
+	clk.advance(2 * time.Minute)
+	fail.Store(true)
+	if r := exchange(); staleEDE(r) == nil {
+		t.Errorf("expected stale reply when the upstream fails, got %v", r)
+	}
+	if r := exchange(); staleEDE(r) == nil || queries.Load() != 2 {
+		t.Errorf("expected stale reply without asking the failed upstream, got %v after %d queries", r, queries.Load())
+	}
+
+	// After StaleTTL the upstream is asked again.
+	clk.advance(31 * time.Second)
+	fail.Store(false)
+	if r := exchange(); staleEDE(r) != nil || queries.Load() != 3 {
+		t.Errorf("expected fresh reply after %d queries, got %v", queries.Load(), r)
+	}
+
+	// A slow upstream gets a stale reply, the refresh finishes in the background.
+	clk.advance(2 * time.Minute)
+	if r := exchange(); staleEDE(r) == nil {
+		t.Errorf("expected stale reply for a slow upstream, got %v", r)
+	}
+	close(release)
+	for range 100 {
+		if c.Get(question("example.org.", dns.TypeA, true)) != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected background refresh to update the cache")
+}
+
+func staleEDE(m *dns.Msg) *dns.EDE {
+	for _, rr := range m.Pseudo {
+		if ede, ok := rr.(*dns.EDE); ok {
+			return ede
+		}
+	}
+	return nil
+}
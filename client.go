@@ -6,24 +6,121 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
 // A Client is a DNS client. If it currently empty.
 type Client struct {
-	// 	Transport RoundTripper Do the RoundTripper interface?
 	*Transport
+
+	// Wrap, if not nil, is called for every exchange with the network and the RoundTripper of the
+	// Transport for that network. The returned RoundTripper is used for the exchange. This allows middleware,
+	// i.e. for logging, caching or fault injection, to be put in front of the transport.
+	Wrap func(network string, rt RoundTripper) RoundTripper
+
+	// SingleInflight, when true, makes concurrent queries for the same question name, type and class, with
+	// the same DO bit, to the same server share a single round trip. Each caller gets its own copy of the
+	// reply, with the ID of its own query.
+	SingleInflight bool
+
+	// Cookies, if not nil, holds the DNS cookies, RFC 7873, that are sent to servers and that are received
+	// from them. Replies with a client cookie that is not ours are rejected with ErrCookie.
+	Cookies *CookieJar
+
+	// TsigSecret holds the base64 encoded TSIG secrets, keyed on the key name in canonical form (lowercase,
+	// fqdn, see RFC 4034 Section 6.2). A query that has a TSIG RR in its pseudo section is signed with the
+	// secret for the owner name of that RR, and the TSIG of the reply is verified. ErrSig, ErrTime and
+	// ErrBadKey are returned when the reply does not verify.
+	TsigSecret map[string]string
+
+	// TsigProvider, if not nil, is used instead of TsigSecret to sign queries and verify replies.
+	TsigProvider TsigProvider
+
+	// Randomize0x20, when true, randomises the case of the letters in the question name of each query
+	// (draft-vixie-dnsext-dns0x20), making spoofed replies harder to get accepted. A reply must echo the
+	// question name with the exact same case, in the returned reply the case of the query is restored. When
+	// a server does not preserve case, which for UDP is checked over TCP, queries to it are sent without
+	// randomisation for a while.
+	Randomize0x20 bool
+
+	group    singleflight
+	caseless caseless // servers that do not preserve the case of the question name
+}
+
+// A RoundTripper performs a single DNS exchange: it sends m to address and returns the reply. The network that
+// is used is a property of the RoundTripper. The message's Data buffer must have been written to by calling
+// m.Pack() before calling RoundTrip. A RoundTripper must be safe for concurrent use.
+type RoundTripper interface {
+	RoundTrip(ctx context.Context, m *Msg, address string) (*Msg, error)
 }
 
+// The RoundTripperFunc type is an adapter to allow the use of ordinary functions as a RoundTripper. Middleware
+// is typically written with it:
+//
+//	func logging(network string, rt dns.RoundTripper) dns.RoundTripper {
+//		return dns.RoundTripperFunc(func(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, error) {
+//			r, err := rt.RoundTrip(ctx, m, address)
+//			log.Printf("%s %s: %v", network, address, err)
+//			return r, err
+//		})
+//	}
+type RoundTripperFunc func(ctx context.Context, m *Msg, address string) (*Msg, error)
+
+// RoundTrip calls f(ctx, m, address).
+func (f RoundTripperFunc) RoundTrip(ctx context.Context, m *Msg, address string) (*Msg, error) {
+	return f(ctx, m, address)
+}
+
+// Transport performs the exchanges of a Client, for all networks supported by [Client.Exchange]. It is not a
+// RoundTripper itself, [Transport.RoundTripper] returns one for a network.
 type Transport struct {
 	// DialContext specifies the dial function for creating unencrypted TCP or UDP connections.
 	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 
-	// TLSClientConfig specifies the TLS configuration to use with tls.Client.
-	// If nil, the default configuration is used.
+	// TLSClientConfig specifies the TLS configuration to use with tls.Client for the "tcp-tls" and "quic"
+	// networks. If nil, the default configuration is used. When not set in the configuration, ServerName is
+	// taken from the address, NextProtos is set to "dot" or "doq" and a session cache that is shared by all
+	// connections of this transport is used.
 	TLSClientConfig *tls.Config
+
+	// TCPFallback, when true, makes a UDP exchange that returns a truncated reply (TC bit set) retry the
+	// same query over TCP to the same address. See [Client.ExchangeWithFallback].
+	TCPFallback bool
+
+	// HTTPClient is the client used for the "https" network (DNS over HTTPS, RFC 8484). If nil, a client
+	// that uses DialContext and TLSClientConfig is created.
+	HTTPClient *http.Client
+
+	// HTTPGet, when true, makes DNS over HTTPS queries use GET instead of POST.
+	HTTPGet bool
+
+	// DisableKeepAlives, if true, disables connection reuse for the "tcp" and "tcp-tls" networks: each query
+	// is sent over a new connection that is closed after the reply is read.
+	DisableKeepAlives bool
+
+	// MaxIdleConnsPerHost is the maximum number of TCP and DNS over TLS connections without outstanding
+	// queries to keep open per address. Queries are pipelined on the open connections, another one is
+	// dialed when they are all busy. If zero, [DefaultMaxIdleConnsPerHost] is used.
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout is the maximum amount of time a connection without outstanding queries will remain
+	// open. Zero means no limit. Queries that use EDNS0 are sent with an edns-tcp-keepalive option (RFC
+	// 7828); when the server sends its timeout in the reply, that is used if it is shorter.
+	IdleConnTimeout time.Duration
+
+	sessionOnce sync.Once
+	sessions    tls.ClientSessionCache // TLS session cache, if TLSClientConfig does not have one
+	httpOnce    sync.Once
+	httpc       *http.Client // HTTP client, if HTTPClient is nil
+	quic        quicConns    // DNS over QUIC connections
+	pool        connPool     // TCP and DNS over TLS connections
 }
 
 var DefaultTransport = &Transport{
@@ -31,6 +128,7 @@ var DefaultTransport = &Transport{
 		Timeout:   5 * time.Second,
 		KeepAlive: 3 * time.Second,
 	}),
+	IdleConnTimeout: 10 * time.Second,
 }
 
 func defaultTransportDialContext(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
@@ -56,8 +154,21 @@ func Exchange(ctx context.Context, m *Msg, network, address string) (r *Msg, err
 //	m.Pack()
 //	resp, rtt, err := c.Exchange(m, "127.0.0.1:53")
 //
+// The network is one of "udp", "tcp" or "tcp-tls" (DNS over TLS, RFC 7858), the last two may have a 4
+// or 6 appended before the "-tls", like with [net.Dial]. The network "https" uses DNS over HTTPS (RFC 8484),
+// the address is then the URL of the server, i.e. "https://dns.example.org/dns-query". If the HTTP response
+// has a Cache-Control max-age, the TTLs of the RRs in r are lowered to not exceed it; r.Data still holds the
+// message as received. The network "quic" uses DNS over QUIC (RFC 9250), the query is sent with an ID of zero
+// on a connection that is kept open for later queries to the same address; r has the ID of m.
+//
+// For "tcp" and "tcp-tls" connections are reused: queries to the same address are pipelined on a single
+// connection and the replies are matched on message ID, so they may be received out of order (RFC 7766).
+// If the ID of m is already used by an outstanding query on the connection, another ID is used on the wire;
+// r has the ID of m. Connections are closed when they are idle for the transport's IdleConnTimeout.
+//
 // If client does not have a transport [DefaultTransport] is used.
-// Exchange does not retry a failed query, nor will it fall back to TCP in case of truncation.
+// Exchange does not retry a failed query. It will only fall back to TCP in case of truncation when the
+// transport has TCPFallback set.
 //
 // It is up to the caller to create a message that allows for larger responses to be returned. Specifically
 // this means setting [Msg.Bufsize] that will advertise a larger buffer. Messages without an Bufsize will
@@ -66,67 +177,362 @@ func Exchange(ctx context.Context, m *Msg, network, address string) (r *Msg, err
 // The full binary data is included in the (decoded) message r. Any TSIG or SIG(0) can still be performed on
 // those octets.
 func (c *Client) Exchange(ctx context.Context, m *Msg, network, address string) (r *Msg, rtt time.Duration, err error) {
-	var conn net.Conn
-	if c.Transport == nil {
-		conn, err = DefaultTransport.DialContext(ctx, network, address)
-	} else {
-		conn, err = c.Transport.DialContext(ctx, network, address)
+	if c.transport().TCPFallback && isUDP(network) {
+		r, rtt, _, err = c.exchangeWithFallback(ctx, m, network, address)
+		return r, rtt, err
 	}
-	if err != nil {
-		return nil, 0, err
+	return c.exchange(ctx, m, network, address)
+}
+
+// ExchangeWithFallback performs a synchronous UDP query, just like Exchange. If the reply has the TC bit
+// set, the query is asked again, with the same message and ID, over TCP to the same address. The returned rtt
+// covers both legs. The returned network is the network that produced r, this is either "udp" or "tcp".
+func (c *Client) ExchangeWithFallback(ctx context.Context, m *Msg, address string) (r *Msg, rtt time.Duration, network string, err error) {
+	return c.exchangeWithFallback(ctx, m, "udp", address)
+}
+
+func (c *Client) exchangeWithFallback(ctx context.Context, m *Msg, network, address string) (r *Msg, rtt time.Duration, _ string, err error) {
+	r, rtt, err = c.exchange(ctx, m, network, address)
+	// A truncated reply may fail to unpack completely, r is still returned in that case.
+	if r == nil || !r.Truncated {
+		return r, rtt, network, err
 	}
-	defer conn.Close()
-	return c.ExchangeWithConn(ctx, m, conn)
+
+	network = "tcp" + strings.TrimPrefix(network, "udp") // keeps the 4 or 6 suffix
+	ContextClientTrace(ctx).truncatedFallback(network, address)
+	r, rtt1, err := c.exchange(ctx, m, network, address)
+	return r, rtt + rtt1, network, err
 }
 
-// ExchangeWithContext behaves like Exchange, but with a supplied connection.
-func (c *Client) ExchangeWithConn(ctx context.Context, m *Msg, conn net.Conn) (r *Msg, rtt time.Duration, err error) {
-	t := time.Now()
-	if isPacketConn(conn) {
-		if _, err := conn.Write(m.Data); err != nil {
-			return nil, 0, err
+func (c *Client) exchange(ctx context.Context, m *Msg, network, address string) (r *Msg, rtt time.Duration, err error) {
+	if !c.SingleInflight {
+		return c.roundTrip(ctx, m, network, address)
+	}
+	key, ok := inflightKey(m, network, address)
+	if !ok {
+		return c.roundTrip(ctx, m, network, address)
+	}
+	r, rtt, err, shared := c.group.do(ctx, key, func() (*Msg, time.Duration, error) {
+		return c.roundTrip(ctx, m, network, address)
+	})
+	if r != nil && shared {
+		r = copyReply(r, m.ID)
+	}
+	return r, rtt, err
+}
+
+// roundTrip performs a single exchange with the RoundTripper for network, wrapped by c.Wrap.
+func (c *Client) roundTrip(ctx context.Context, m *Msg, network, address string) (r *Msg, rtt time.Duration, err error) {
+	rt := c.roundTripper(network)
+	if c.Randomize0x20 {
+		rt = c.caseRoundTripper(rt, network)
+	}
+	if c.Wrap != nil {
+		rt = c.Wrap(network, rt)
+	}
+	now := time.Now()
+	r, err = rt.RoundTrip(ctx, m, address)
+	return r, time.Since(now), err
+}
+
+// roundTripper returns the RoundTripper of the transport for network, with TSIG and cookies handled.
+func (c *Client) roundTripper(network string) RoundTripper {
+	rt := c.transport().RoundTripper(network)
+	rt = c.tsigRoundTripper(rt)
+	if isStream(network) && !c.transport().DisableKeepAlives {
+		// Added before the query is signed, the transport can't add it to a signed query.
+		next := rt
+		rt = RoundTripperFunc(func(ctx context.Context, m *Msg, address string) (*Msg, error) {
+			q, err := withKeepalive(m)
+			if err != nil {
+				return nil, err
+			}
+			return next.RoundTrip(ctx, q, address)
+		})
+	}
+	if c.Cookies != nil {
+		rt = c.Cookies.roundTripper(rt)
+	}
+	return rt
+}
+
+// tsigRoundTripper returns a RoundTripper that signs queries that have a TSIG RR and verifies the replies to
+// them, using the request MAC.
+func (c *Client) tsigRoundTripper(rt RoundTripper) RoundTripper {
+	return RoundTripperFunc(func(ctx context.Context, m *Msg, address string) (*Msg, error) {
+		t := m.tsig()
+		if t == nil {
+			return rt.RoundTrip(ctx, m, address)
+		}
+		provider := c.TsigProvider
+		if provider == nil {
+			if c.TsigSecret == nil {
+				return nil, ErrSecret
+			}
+			provider = tsigSecretProvider(c.TsigSecret)
 		}
 
-		r = new(Msg)
-		if m.UDPSize > MinMsgSize {
-			r.Data = make([]byte, m.UDPSize)
-		} else {
-			r.Data = make([]byte, MinMsgSize)
+		// Sign a copy, so m is left as is.
+		q := *m
+		q.Pseudo = make([]RR, len(m.Pseudo))
+		for i, rr := range m.Pseudo {
+			if rr == RR(t) {
+				t1 := *t
+				rr = &t1
+			}
+			q.Pseudo[i] = rr
 		}
-		n, err := conn.Read(r.Data)
+		mac, err := TsigGenerateWithProvider(&q, provider, "", false)
 		if err != nil {
-			return nil, time.Since(t), err
+			return nil, err
 		}
-		r.Data = r.Data[:n]
 
-	} else {
+		r, err := rt.RoundTrip(ctx, &q, address)
+		if err != nil || r == nil {
+			return r, err
+		}
+		return r, TsigVerifyWithProvider(r, provider, mac, false)
+	})
+}
+
+// RoundTripper returns a RoundTripper that exchanges messages over network, see [Client.Exchange] for the
+// networks that can be used.
+func (t *Transport) RoundTripper(network string) RoundTripper {
+	return &transportRoundTripper{t: t, network: network}
+}
+
+type transportRoundTripper struct {
+	t       *Transport
+	network string
+}
+
+func (rt *transportRoundTripper) RoundTrip(ctx context.Context, m *Msg, address string) (*Msg, error) {
+	return rt.t.roundTrip(ctx, m, rt.network, address)
+}
+
+func (t *Transport) roundTrip(ctx context.Context, m *Msg, network, address string) (r *Msg, err error) {
+	if trace := ContextClientTrace(ctx); trace != nil {
+		defer func() {
+			if r != nil {
+				trace.responseParsed(r, err)
+			}
+		}()
+	}
+
+	switch network {
+	case "https":
+		return t.exchangeHTTPS(ctx, m, address)
+	case "quic":
+		return t.exchangeQUIC(ctx, m, address)
+	}
+	if isStream(network) && !t.DisableKeepAlives {
+		return t.exchangePipelined(ctx, m, network, address)
+	}
+
+	conn, err := t.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ContextClientTrace(ctx).gotConn(conn, false)
+	r, _, err = exchangeWithConn(ctx, m, conn)
+	return r, err
+}
+
+func (c *Client) transport() *Transport {
+	if c.Transport == nil {
+		return DefaultTransport
+	}
+	return c.Transport
+}
+
+// dialTLS dials a TCP connection to address and performs the TLS handshake on it.
+func (t *Transport) dialTLS(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := t.DialContext(ctx, strings.TrimSuffix(network, "-tls"), address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, t.tlsConfig(address, "dot"))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tlsConfig returns the TLS configuration to use when connecting to address, alpn is used when the
+// configuration does not set NextProtos.
+func (t *Transport) tlsConfig(address, alpn string) *tls.Config {
+	cfg := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			cfg.ServerName = host
+		}
+	}
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{alpn}
+	}
+	if cfg.ClientSessionCache == nil {
+		t.sessionOnce.Do(func() { t.sessions = tls.NewLRUClientSessionCache(0) })
+		cfg.ClientSessionCache = t.sessions
+	}
+	return cfg
+}
+
+// ExchangeWithConn behaves like Exchange, but with a supplied connection. The deadline of ctx is set on
+// conn and cancelling ctx unblocks a pending read or write. When ctx is done, the returned error wraps
+// ctx.Err(), use errors.Is with context.Canceled or context.DeadlineExceeded to tell it apart from a network
+// error. Any deadline set on conn is cleared when ExchangeWithConn returns.
+func (c *Client) ExchangeWithConn(ctx context.Context, m *Msg, conn net.Conn) (r *Msg, rtt time.Duration, err error) {
+	return exchangeWithConn(ctx, m, conn)
+}
 
-		msg := make([]byte, 2+len(m.Data))
+func exchangeWithConn(ctx context.Context, m *Msg, conn net.Conn) (r *Msg, rtt time.Duration, err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if ctx.Done() != nil {
+		// Setting a deadline in the past unblocks any read or write.
+		stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+		defer func() {
+			if !stop() {
+				conn.SetDeadline(time.Time{})
+			}
+		}()
+	}
+	defer func() { err = ctxError(ctx, err) }()
+
+	trace := ContextClientTrace(ctx)
+	t := time.Now()
+	msg := m.Data
+	if !isPacketConn(conn) {
+		msg = make([]byte, 2+len(m.Data))
 		binary.BigEndian.PutUint16(msg, uint16(len(m.Data)))
 		copy(msg[2:], m.Data)
-		if _, err := conn.Write(msg); err != nil {
-			return nil, 0, err
-		}
+	}
+	n, err := conn.Write(msg)
+	trace.wroteQuery(n, err)
+	if err != nil {
+		return nil, 0, err
+	}
 
-		var length uint16
-		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+	// Messages that are not a reply to m are discarded and we keep waiting. If nothing else arrives the
+	// reason the last message was discarded is returned.
+	var mismatch error
+	for {
+		r, err = readMsg(conn, m, trace)
+		trace = nil // only the first reply is traced
+		if r == nil {
+			if err == ErrSource {
+				mismatch = err
+				continue
+			}
+			if mismatch != nil && isTimeout(err) {
+				return nil, time.Since(t), mismatch
+			}
 			return nil, time.Since(t), err
 		}
+		if merr := isReply(m, r); merr != nil {
+			mismatch = merr
+			continue
+		}
+		if exactCaseMismatch(ctx, m, r) {
+			mismatch = ErrQuestion
+			continue
+		}
+		return r, time.Since(t), err
+	}
+}
 
-		r = new(Msg)
-		r.Data = make([]byte, length)
-		n, err := io.ReadFull(conn, r.Data)
+// readMsg reads a single message from conn and unpacks it. For a packet connection the buffer used is
+// sized after the UDPSize of m and ErrSource is returned when the message is not from the remote address of
+// conn. The GotFirstResponseByte hook of trace is called when the message starts to arrive.
+func readMsg(conn net.Conn, m *Msg, trace *ClientTrace) (r *Msg, err error) {
+	r = new(Msg)
+	if pc, ok := conn.(net.PacketConn); ok && isPacketConn(conn) {
+		r.Data = make([]byte, max(m.UDPSize, MinMsgSize))
+		n, from, err := pc.ReadFrom(r.Data)
 		if err != nil {
-			return r, time.Since(t), err
-		}
-		if int(length) > len(r.Data) {
-			return r, time.Since(t), io.ErrShortBuffer
+			return nil, err
 		}
+		trace.gotFirstResponseByte()
 		r.Data = r.Data[:n]
+		if from != nil && conn.RemoteAddr() != nil && !sameAddr(from, conn.RemoteAddr()) {
+			return nil, ErrSource
+		}
+	} else {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		trace.gotFirstResponseByte()
+		r.Data = make([]byte, length)
+		if _, err := io.ReadFull(conn, r.Data); err != nil {
+			return nil, err
+		}
 	}
+	return r, r.Unpack()
+}
 
-	err = r.Unpack()
-	return r, time.Since(t), err
+// isReply returns nil if r is a reply to m: the IDs must be the same, and if r has a question it must be the
+// question from m. Names are compared case insensitively, as a query may use 0x20 randomisation; the exact
+// case is checked by the exchange when it has to be.
+func isReply(m, r *Msg) error {
+	if r.ID != m.ID {
+		return ErrId
+	}
+	if len(m.Question) == 0 || len(r.Question) == 0 {
+		return nil
+	}
+	q, rq := m.Question[0], r.Question[0]
+	if !strings.EqualFold(q.Header().Name, rq.Header().Name) || RRToType(q) != RRToType(rq) || classOf(q) != classOf(rq) {
+		return ErrQuestion
+	}
+	return nil
+}
+
+// classOf returns the class of rr, a zero class is sent as ClassINET.
+func classOf(rr RR) uint16 {
+	if c := rr.Header().Class; c != 0 {
+		return c
+	}
+	return ClassINET
+}
+
+// sameAddr returns true if a and b are the same address.
+func sameAddr(a, b net.Addr) bool {
+	ua, ok1 := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	if ok1 && ok2 {
+		return ua.Port == ub.Port && ua.AddrPort().Addr().Unmap() == ub.AddrPort().Addr().Unmap()
+	}
+	return a.String() == b.String()
+}
+
+// ctxError returns err wrapped with the error of ctx, if ctx is done or its deadline has passed. Otherwise
+// err is returned as is.
+func ctxError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	cerr := ctx.Err()
+	if deadline, ok := ctx.Deadline(); cerr == nil && ok && !time.Now().Before(deadline) {
+		cerr = context.DeadlineExceeded // the connection's deadline may fire before the context's
+	}
+	if cerr == nil || errors.Is(err, cerr) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", cerr, err)
+}
+
+// isTimeout returns true if err is a timeout.
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
 }
 
 func isPacketConn(c net.Conn) bool {
@@ -139,3 +545,13 @@ func isPacketConn(c net.Conn) bool {
 	}
 	return true
 }
+
+// isTLS returns true if network is one of the DNS over TLS networks.
+func isTLS(network string) bool {
+	return network == "tcp-tls" || network == "tcp4-tls" || network == "tcp6-tls"
+}
+
+// isUDP returns true if network is one of the UDP networks.
+func isUDP(network string) bool {
+	return network == "udp" || network == "udp4" || network == "udp6"
+}
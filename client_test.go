@@ -2,8 +2,22 @@ package dns
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestClient(t *testing.T) {
@@ -20,3 +34,523 @@ func TestClient(t *testing.T) {
 	}
 	fmt.Println(r.String())
 }
+
+// serveLocal starts a UDP and TCP responder on the same address, each incoming query is answered with
+// the message returned from f. The network the query was received on is given to f. If f returns nil no reply
+// is sent. It returns the address the responder listens on.
+func serveLocal(t *testing.T, addr string, f func(network string, req *Msg) *Msg) string {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close(); pc.Close() })
+
+	go func() {
+		buf := make([]byte, MaxMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := &Msg{Data: append([]byte{}, buf[:n]...)}
+			if req.Unpack() != nil {
+				continue
+			}
+			r := f("udp", req)
+			if r != nil && r.Pack() == nil {
+				pc.WriteTo(r.Data, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, "tcp", f)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serveConn answers the queries on the stream connection conn with the messages returned from f.
+func serveConn(conn net.Conn, network string, f func(network string, req *Msg) *Msg) {
+	defer conn.Close()
+	for {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		req := &Msg{Data: make([]byte, length)}
+		if _, err := io.ReadFull(conn, req.Data); err != nil || req.Unpack() != nil {
+			return
+		}
+		r := f(network, req)
+		if r == nil || r.Pack() != nil {
+			return
+		}
+		buf := binary.BigEndian.AppendUint16(nil, uint16(len(r.Data)))
+		if _, err := conn.Write(append(buf, r.Data...)); err != nil {
+			return
+		}
+	}
+}
+
+// serveTLS starts a DNS over TLS responder on a loopback address using a self signed certificate for
+// "dns.example.org". The handshake state of each connection is send on the returned channel.
+func serveTLS(t *testing.T, f func(network string, req *Msg) *Msg) (string, *x509.CertPool, chan tls.ConnectionState) {
+	t.Helper()
+	cert, pool := selfSignedCert(t, "dns.example.org")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"dot"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	states := make(chan tls.ConnectionState, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				continue
+			}
+			states <- tlsConn.ConnectionState()
+			go serveConn(conn, "tcp-tls", f)
+		}
+	}()
+	return l.Addr().String(), pool, states
+}
+
+// selfSignedCert returns a self signed certificate for name and a pool that holds it.
+func selfSignedCert(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestClientTCPFallback(t *testing.T) {
+	addr := serveLocal(t, "127.0.0.1:0", func(network string, req *Msg) *Msg {
+		r := &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true}, Question: req.Question}
+		if network == "udp" {
+			r.Truncated = true
+			return r
+		}
+		r.Answer = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET, TTL: 3600}, A: net.IPv4(127, 0, 0, 1).To4()}}
+		return r
+	})
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+	m.Question = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+	m.Pack()
+
+	c := &Client{Transport: &Transport{DialContext: DefaultTransport.DialContext}}
+	r, _, network, err := c.ExchangeWithFallback(context.Background(), m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network != "tcp" {
+		t.Errorf("expected answer over %s, got %s", "tcp", network)
+	}
+	if r.ID != m.ID || r.Truncated || len(r.Answer) != 1 {
+		t.Errorf("expected untruncated reply with ID %d and 1 answer, got:\n%s", m.ID, r)
+	}
+
+	r, _, err = c.Exchange(context.Background(), m, "udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Truncated {
+		t.Errorf("expected truncated reply without TCPFallback")
+	}
+
+	c.TCPFallback = true
+	r, _, err = c.Exchange(context.Background(), m, "udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncated || len(r.Answer) != 1 {
+		t.Errorf("expected untruncated reply with 1 answer, got:\n%s", r)
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	addr, pool, states := serveTLS(t, func(network string, req *Msg) *Msg {
+		r := &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true}, Question: req.Question}
+		r.Answer = []RR{&TXT{Hdr: Header{Name: "miek.nl.", Class: ClassINET, TTL: 3600}, Txt: []string{network}}}
+		return r
+	})
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+	m.Question = []RR{&TXT{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+	m.Pack()
+
+	tr := &Transport{
+		DialContext:       DefaultTransport.DialContext,
+		TLSClientConfig:   &tls.Config{RootCAs: pool, ServerName: "dns.example.org"},
+		DisableKeepAlives: true,
+	}
+	c := &Client{Transport: tr}
+	for i := range 2 {
+		r, _, err := c.Exchange(context.Background(), m, "tcp-tls", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*TXT).Txt[0] != "tcp-tls" {
+			t.Fatalf("expected answer over tcp-tls, got:\n%s", r)
+		}
+
+		state := <-states
+		if state.NegotiatedProtocol != "dot" {
+			t.Errorf("expected ALPN %q, got %q", "dot", state.NegotiatedProtocol)
+		}
+		if state.ServerName != "dns.example.org" {
+			t.Errorf("expected SNI %q, got %q", "dns.example.org", state.ServerName)
+		}
+		if i == 1 && !state.DidResume {
+			t.Errorf("expected second connection to resume the TLS session")
+		}
+	}
+}
+
+func TestClientTrace(t *testing.T) {
+	addr := serveLocal(t, "127.0.0.1:0", func(network string, req *Msg) *Msg {
+		r := &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true}, Question: req.Question}
+		r.Truncated = network == "udp"
+		return r
+	})
+
+	var events []string
+	trace := &ClientTrace{
+		DialStart: func(network, address string) { events = append(events, "dial "+network) },
+		DialDone: func(network, address string, err error) {
+			events = append(events, fmt.Sprintf("dialed %s %v", network, err))
+		},
+		GotConn:              func(info GotConnInfo) { events = append(events, fmt.Sprintf("conn reused=%t", info.Reused)) },
+		WroteQuery:           func(info WroteQueryInfo) { events = append(events, fmt.Sprintf("wrote %d", info.Bytes)) },
+		GotFirstResponseByte: func() { events = append(events, "first byte") },
+		TruncatedFallback:    func(network, address string) { events = append(events, "fallback "+network) },
+		ResponseParsed: func(r *Msg, err error) {
+			events = append(events, fmt.Sprintf("parsed tc=%t %v", r.Truncated, err))
+		},
+	}
+	ctx := WithClientTrace(context.Background(), trace)
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+	m.Question = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+	m.Pack()
+	c := &Client{Transport: &Transport{DialContext: DefaultTransport.DialContext}}
+	if _, _, _, err := c.ExchangeWithFallback(ctx, m, addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Exchange(ctx, m, "tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+
+	n := len(m.Data)
+	expect := []string{
+		"dial udp", "dialed udp <nil>", "conn reused=false", fmt.Sprintf("wrote %d", n), "first byte", "parsed tc=true <nil>",
+		"fallback tcp",
+		"dial tcp", "dialed tcp <nil>", "conn reused=false", fmt.Sprintf("wrote %d", n+2), "first byte", "parsed tc=false <nil>",
+		"conn reused=true", fmt.Sprintf("wrote %d", n+2), "first byte", "parsed tc=false <nil>",
+	}
+	if fmt.Sprint(events) != fmt.Sprint(expect) {
+		t.Errorf("expected events:\n%q\ngot:\n%q", expect, events)
+	}
+}
+
+func TestClientRandomize0x20(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		seen     []string
+		preserve = true
+	)
+	addr := serveLocal(t, "127.0.0.1:0", func(network string, req *Msg) *Msg {
+		mu.Lock()
+		defer mu.Unlock()
+		name := req.Question[0].Header().Name
+		seen = append(seen, name)
+		if !preserve {
+			req.Question[0].Header().Name = strings.ToLower(name)
+		}
+		r := &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true}, Question: req.Question}
+		r.Answer = []RR{&A{Hdr: Header{Name: name, Class: ClassINET, TTL: 3600}, A: net.IPv4(127, 0, 0, 1).To4()}}
+		return r
+	})
+
+	const name = "www.Example.org."
+	m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+	m.Question = []RR{&A{Hdr: Header{Name: name, Class: ClassINET}}}
+	m.Pack()
+	c := &Client{Transport: &Transport{DialContext: DefaultTransport.DialContext}, Randomize0x20: true}
+
+	r, _, err := c.Exchange(context.Background(), m, "udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(seen) != 1 || !strings.EqualFold(seen[0], name) {
+		t.Errorf("expected 1 query for %s, got %v", name, seen)
+	}
+	seen, preserve = nil, false
+	mu.Unlock()
+	if r.Question[0].Header().Name != name || r.Answer[0].Header().Name != name {
+		t.Errorf("expected case of %s to be restored, got:\n%s", name, r)
+	}
+	data := &Msg{Data: r.Data}
+	if data.Unpack(); data.Question[0].Header().Name != name {
+		t.Errorf("expected case of %s to be restored in the data, got %s", name, data.Question[0].Header().Name)
+	}
+
+	// A server that does not preserve case gets the randomised query over UDP and TCP, and then the query with
+	// the original name.
+	for range 2 {
+		if _, _, err := c.Exchange(context.Background(), m, "udp", addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 3 || seen[0] != seen[1] || seen[2] != name {
+		t.Errorf("expected the same randomised query twice and a query for %s, got %v", name, seen)
+	}
+}
+
+func TestClientRandomize0x20Spoofed(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, MaxMsgSize)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := &Msg{Data: buf[:n]}
+		if req.Unpack() != nil {
+			return
+		}
+		// A spoofed reply with the wrong case comes in before the real one.
+		name := req.Question[0].Header().Name
+		for _, qname := range []string{strings.ToUpper(name), name} {
+			req.Question[0].Header().Name = qname
+			r := &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true}, Question: req.Question}
+			r.Answer = []RR{&TXT{Hdr: Header{Name: qname, Class: ClassINET}, Txt: []string{qname}}}
+			if r.Pack() == nil {
+				pc.WriteTo(r.Data, addr)
+			}
+		}
+	}()
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID()}, Question: []RR{&TXT{Hdr: Header{Name: "www.example.org.", Class: ClassINET}}}}
+	m.Pack()
+	c := &Client{Transport: &Transport{DialContext: DefaultTransport.DialContext}, Randomize0x20: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r, _, err := c.Exchange(ctx, m, "udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txt := r.Answer[0].(*TXT).Txt[0]; txt == strings.ToUpper(txt) {
+		t.Errorf("expected the spoofed reply to be discarded, got %s", txt)
+	}
+	if c.caseless.has(pc.LocalAddr().String()) {
+		t.Error("expected the server not to be marked as not preserving case")
+	}
+}
+
+func TestClientWrap(t *testing.T) {
+	addr := serveLocal(t, "127.0.0.1:0", func(network string, req *Msg) *Msg {
+		r := &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true}, Question: req.Question}
+		r.Answer = []RR{&TXT{Hdr: Header{Name: "miek.nl.", Class: ClassINET, TTL: 3600}, Txt: []string{network}}}
+		return r
+	})
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+	m.Question = []RR{&TXT{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+	m.Pack()
+
+	tr := &Transport{DialContext: DefaultTransport.DialContext}
+	for _, network := range []string{"udp", "tcp"} {
+		r, err := tr.RoundTripper(network).RoundTrip(context.Background(), m, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ID != m.ID || r.Answer[0].(*TXT).Txt[0] != network {
+			t.Errorf("expected reply with ID %d over %s, got:\n%s", m.ID, network, r)
+		}
+	}
+
+	// Fail every UDP exchange, without sending anything.
+	errFault := &Error{err: "injected fault"}
+	seen := []string{}
+	c := &Client{Transport: tr, Wrap: func(network string, rt RoundTripper) RoundTripper {
+		return RoundTripperFunc(func(ctx context.Context, m *Msg, address string) (*Msg, error) {
+			seen = append(seen, network)
+			if network == "udp" {
+				return nil, errFault
+			}
+			return rt.RoundTrip(ctx, m, address)
+		})
+	}}
+	if _, _, err := c.Exchange(context.Background(), m, "udp", addr); err != errFault {
+		t.Errorf("expected %v, got %v", errFault, err)
+	}
+	if _, _, err := c.Exchange(context.Background(), m, "tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[0] != "udp" || seen[1] != "tcp" {
+		t.Errorf("expected middleware to see udp and tcp, got %v", seen)
+	}
+}
+
+func TestClientValidateReply(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// Each query is answered with a reply with the wrong ID and a reply with the wrong question. For
+	// MieK.nL. the correct reply is send last.
+	go func() {
+		buf := make([]byte, MaxMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := &Msg{Data: append([]byte{}, buf[:n]...)}
+			if req.Unpack() != nil {
+				continue
+			}
+			bad := &Msg{MsgHeader: MsgHeader{ID: req.ID + 1, Response: true}, Question: req.Question}
+			bad.Pack()
+			pc.WriteTo(bad.Data, addr)
+			bad = &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true}, Question: []RR{&A{Hdr: Header{Name: "example.org.", Class: ClassINET}}}}
+			bad.Pack()
+			pc.WriteTo(bad.Data, addr)
+
+			if req.Question[0].Header().Name == "MieK.nL." {
+				// The case of the question name is not preserved.
+				r := &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true}, Question: []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}}
+				r.Answer = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET, TTL: 3600}, A: net.IPv4(127, 0, 0, 1).To4()}}
+				r.Pack()
+				pc.WriteTo(r.Data, addr)
+			}
+		}
+	}()
+
+	c := &Client{Transport: &Transport{DialContext: DefaultTransport.DialContext}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+	m.Question = []RR{&A{Hdr: Header{Name: "MieK.nL.", Class: ClassINET}}}
+	m.Pack()
+	r, _, err := c.Exchange(ctx, m, "udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != m.ID || len(r.Answer) != 1 {
+		t.Errorf("expected reply with ID %d and 1 answer, got:\n%s", m.ID, r)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	m.Question = []RR{&A{Hdr: Header{Name: "example.net.", Class: ClassINET}}}
+	m.Pack()
+	_, _, err = c.Exchange(ctx, m, "udp", pc.LocalAddr().String())
+	if !errors.Is(err, ErrQuestion) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v at the deadline, got %v", ErrQuestion, err)
+	}
+}
+
+func TestExchangeWithConnCancel(t *testing.T) {
+	// Nothing is ever replied.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	addr := l.Addr().String()
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+	m.Question = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+	m.Pack()
+
+	for _, network := range []string{"udp", "tcp"} {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		c := &Client{}
+		_, _, err = c.ExchangeWithConn(ctx, m, conn)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v over %s, got %v", context.Canceled, network, err)
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, _, err = c.ExchangeWithConn(ctx, m, conn)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected %v over %s, got %v", context.DeadlineExceeded, network, err)
+		}
+	}
+}
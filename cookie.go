@@ -0,0 +1,266 @@
+package dns
+
+// DNS Cookies, RFC 7873 and RFC 9018.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// A CookieJar holds the DNS cookies of a client, see RFC 7873. For each server a random client cookie is
+// generated, the server cookie received from the server is remembered and echoed in later queries to it.
+// Use it by setting Client.Cookies. The zero value is ready to use.
+type CookieJar struct {
+	mu      sync.Mutex
+	cookies map[string]*COOKIE // keyed on server address
+}
+
+// Cookie returns the cookie that is sent to the server at address. The first time it is called for a server,
+// a new client cookie is generated.
+func (j *CookieJar) Cookie(address string) *COOKIE {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cookies == nil {
+		j.cookies = map[string]*COOKIE{}
+	}
+	c, ok := j.cookies[address]
+	if !ok {
+		client := make([]byte, 8)
+		rand.Read(client)
+		c = &COOKIE{Cookie: hex.EncodeToString(client)}
+		j.cookies[address] = c
+	}
+	return &COOKIE{Cookie: c.Cookie}
+}
+
+// set stores the server cookie from c for address, if the client cookie in c is the one we use for address.
+func (j *CookieJar) set(address string, c *COOKIE) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	prev, ok := j.cookies[address]
+	if !ok || prev.Client() != c.Client() {
+		return false
+	}
+	j.cookies[address] = &COOKIE{Cookie: c.Cookie}
+	return true
+}
+
+// roundTripper returns a RoundTripper that adds cookies to the queries sent with rt. A reply with a cookie
+// that does not have our client cookie is rejected with ErrCookie. On a BADCOOKIE reply the query is sent
+// once more with the new server cookie.
+func (j *CookieJar) roundTripper(rt RoundTripper) RoundTripper {
+	return RoundTripperFunc(func(ctx context.Context, m *Msg, address string) (*Msg, error) {
+		for retry := 0; ; retry++ {
+			q, err := withOption(m, j.Cookie(address))
+			if err != nil {
+				return nil, err
+			}
+			r, err := rt.RoundTrip(ctx, q, address)
+			if r == nil {
+				return r, err
+			}
+			c := cookieOf(r)
+			if c == nil {
+				return r, err
+			}
+			if !j.set(address, c) {
+				return nil, ErrCookie
+			}
+			if r.Rcode == RcodeBadCookie && retry == 0 && err == nil {
+				continue
+			}
+			return r, err
+		}
+	})
+}
+
+// withOption returns a copy of m with option added to its pseudo section, an existing option with the same
+// code is removed. The copy is packed.
+func withOption(m *Msg, option EDNS0) (*Msg, error) {
+	q := *m
+	q.Pseudo = make([]RR, 0, len(m.Pseudo)+1)
+	code := RRToCode(option)
+	for _, rr := range m.Pseudo {
+		if o, ok := rr.(EDNS0); ok && RRToCode(o) == code {
+			continue
+		}
+		q.Pseudo = append(q.Pseudo, rr)
+	}
+	q.Pseudo = append(q.Pseudo, option)
+	q.Data = nil
+	if err := q.Pack(); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// cookieOf returns the COOKIE from the pseudo section of m, or nil if there is none.
+func cookieOf(m *Msg) *COOKIE {
+	for _, rr := range m.Pseudo {
+		if c, ok := rr.(*COOKIE); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// A CookieServer issues and verifies server cookies as specified in RFC 9018. A server cookie holds a
+// version, a timestamp and a SipHash-2-4 over the client cookie, the version, the timestamp and the IP
+// address of the client, keyed with a secret. Servers that share the secret, i.e. the servers of an anycast
+// set, accept each other's cookies. The secret can be rotated, cookies made with the previous secret remain
+// valid until the next rotation.
+type CookieServer struct {
+	// Require, when true, makes the Handler reply with BADCOOKIE, and a fresh server cookie, to requests
+	// that have a client cookie but no valid server cookie. Requests without a COOKIE option are always
+	// handled.
+	Require bool
+
+	mu       sync.RWMutex
+	secret   [16]byte
+	previous *[16]byte
+
+	now func() time.Time // for testing
+}
+
+// NewCookieServer returns a CookieServer that uses secret.
+func NewCookieServer(secret [16]byte) *CookieServer {
+	return &CookieServer{secret: secret, now: time.Now}
+}
+
+// Rotate makes secret the secret used for new server cookies. Cookies made with the current secret are
+// still accepted, the secret before that is forgotten.
+func (s *CookieServer) Rotate(secret [16]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.secret
+	s.secret, s.previous = secret, &prev
+}
+
+// Check checks the cookie in req, that was sent from the IP address ip. It returns the cookie to put in the
+// reply, or nil if req has no cookie. The returned bool is true if req has a valid server cookie. If the
+// cookie in req is malformed ErrCookie is returned, the reply should then have rcode FORMERR.
+func (s *CookieServer) Check(req *Msg, ip net.IP) (*COOKIE, bool, error) {
+	c := cookieOf(req)
+	if c == nil {
+		return nil, false, nil
+	}
+	cookie, err := hex.DecodeString(c.Cookie)
+	if err != nil || len(cookie) != 8 && (len(cookie) < 16 || len(cookie) > 40) {
+		return nil, false, ErrCookie
+	}
+	client := cookie[:8]
+	now := uint32(s.now().Unix())
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(cookie) == 24 && cookie[8] == 1 {
+		ts := binary.BigEndian.Uint32(cookie[12:16])
+		// Valid for an hour and accept up to 5 minutes of clock skew, RFC 9018 section 4.3.
+		if fresh := int32(now - ts); fresh <= 3600 && fresh >= -300 {
+			for _, secret := range []*[16]byte{&s.secret, s.previous} {
+				if secret == nil {
+					continue
+				}
+				if hmac := serverCookie(*secret, client, ts, ip); string(hmac) == string(cookie[8:]) {
+					// A cookie older than half an hour is replaced with a new one.
+					if fresh > 1800 || secret != &s.secret {
+						return &COOKIE{Cookie: hex.EncodeToString(client) + hex.EncodeToString(serverCookie(s.secret, client, now, ip))}, true, nil
+					}
+					return &COOKIE{Cookie: c.Cookie}, true, nil
+				}
+			}
+		}
+	}
+	return &COOKIE{Cookie: hex.EncodeToString(client) + hex.EncodeToString(serverCookie(s.secret, client, now, ip))}, false, nil
+}
+
+// serverCookie returns the server cookie for the client cookie and IP address, made at timestamp ts.
+func serverCookie(secret [16]byte, client []byte, ts uint32, ip net.IP) []byte {
+	cookie := make([]byte, 16)
+	cookie[0] = 1 // version, followed by 3 reserved bytes
+	binary.BigEndian.PutUint32(cookie[4:], ts)
+
+	input := make([]byte, 0, 8+8+net.IPv6len)
+	input = append(input, client...)
+	input = append(input, cookie[:8]...)
+	if ip4 := ip.To4(); ip4 != nil {
+		input = append(input, ip4...)
+	} else {
+		input = append(input, ip.To16()...)
+	}
+	binary.LittleEndian.PutUint64(cookie[8:], siphash(secret, input))
+	return cookie
+}
+
+// Handler returns a Handler that checks the cookies of requests before calling h. A request with a malformed
+// cookie gets a FORMERR reply. When Require is set, a request without a valid server cookie gets a BADCOOKIE
+// reply. Otherwise h is called and a fresh cookie is added to the reply that h writes.
+func (s *CookieServer) Handler(h Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, req *Msg) {
+		c, valid, err := s.Check(req, addrIP(w.RemoteAddr()))
+		switch {
+		case err != nil:
+			m := new(Msg).SetRcode(req, RcodeFormatError)
+			m.UDPSize = req.UDPSize
+			w.WriteMsg(m)
+			return
+		case c == nil:
+			h.ServeDNS(ctx, w, req)
+			return
+		case !valid && s.Require:
+			m := new(Msg).SetRcode(req, RcodeBadCookie)
+			m.UDPSize = req.UDPSize
+			m.Pseudo = []RR{c}
+			w.WriteMsg(m)
+			return
+		}
+		h.ServeDNS(ctx, &cookieWriter{ResponseWriter: w, cookie: c}, req)
+	})
+}
+
+// cookieWriter adds a cookie to the reply written to the ResponseWriter.
+type cookieWriter struct {
+	ResponseWriter
+	cookie *COOKIE
+}
+
+func (w *cookieWriter) WriteMsg(m *Msg) error {
+	r, err := withOption(m, w.cookie)
+	if err != nil {
+		return err
+	}
+	return w.ResponseWriter.WriteMsg(r)
+}
+
+func (w *cookieWriter) Write(b []byte) (int, error) {
+	m := &Msg{Data: b}
+	if err := m.Unpack(); err != nil {
+		return 0, err
+	}
+	if err := w.WriteMsg(m); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// addrIP returns the IP address of addr, or nil if it has none.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return ap.Addr().AsSlice()
+	}
+	return nil
+}
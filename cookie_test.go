@@ -0,0 +1,120 @@
+package dns
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSiphash(t *testing.T) {
+	var k [16]byte
+	p := make([]byte, 15)
+	for i := range k {
+		k[i] = byte(i)
+	}
+	for i := range p {
+		p[i] = byte(i)
+	}
+	if h := siphash(k, p); h != 0xa129ca6149be45e5 {
+		t.Errorf("expected %x, got %x", uint64(0xa129ca6149be45e5), h)
+	}
+}
+
+func TestServerCookie(t *testing.T) {
+	// Example from RFC 9018, Appendix A.2.
+	var secret [16]byte
+	hex.Decode(secret[:], []byte("e5e973e5a6b2a43f48e7dc849e37bfcf"))
+	s := NewCookieServer(secret)
+	s.now = func() time.Time { return time.Unix(1559731985, 0) }
+
+	req := &Msg{Pseudo: []RR{&COOKIE{Cookie: "2464c4abcf10c957"}}}
+	c, valid, err := s.Check(req, net.ParseIP("198.51.100.100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Errorf("expected cookie without server cookie to be invalid")
+	}
+	if expect := "2464c4abcf10c957010000005cf79f111f8130c3eee29480"; c.Cookie != expect {
+		t.Fatalf("expected cookie %s, got %s", expect, c.Cookie)
+	}
+
+	req.Pseudo = []RR{c}
+	if _, valid, _ := s.Check(req, net.ParseIP("198.51.100.100")); !valid {
+		t.Errorf("expected cookie to be valid")
+	}
+	if _, valid, _ := s.Check(req, net.ParseIP("198.51.100.101")); valid {
+		t.Errorf("expected cookie from another address to be invalid")
+	}
+
+	var next [16]byte
+	s.Rotate(next)
+	if c1, valid, _ := s.Check(req, net.ParseIP("198.51.100.100")); !valid || c1.Cookie == c.Cookie {
+		t.Errorf("expected cookie with previous secret to be valid and to be replaced")
+	}
+	s.Rotate(next)
+	if _, valid, _ := s.Check(req, net.ParseIP("198.51.100.100")); valid {
+		t.Errorf("expected cookie with forgotten secret to be invalid")
+	}
+
+	s.now = func() time.Time { return time.Unix(1559731985+3601, 0) }
+	s.Rotate(secret)
+	if _, valid, _ := s.Check(req, net.ParseIP("198.51.100.100")); valid {
+		t.Errorf("expected expired cookie to be invalid")
+	}
+
+	req.Pseudo = []RR{&COOKIE{Cookie: "2464c4abcf10c95701"}}
+	if _, _, err := s.Check(req, net.ParseIP("198.51.100.100")); err != ErrCookie {
+		t.Errorf("expected %v for malformed cookie, got %v", ErrCookie, err)
+	}
+}
+
+func TestClientCookies(t *testing.T) {
+	s := NewCookieServer([16]byte{1, 2, 3})
+	var queries atomic.Int32
+	addr := serveLocal(t, "127.0.0.1:0", func(network string, req *Msg) *Msg {
+		queries.Add(1)
+		c, valid, err := s.Check(req, net.IPv4(127, 0, 0, 1))
+		if err != nil || c == nil {
+			return new(Msg).SetRcode(req, RcodeFormatError)
+		}
+		r := new(Msg).SetReply(req)
+		if !valid {
+			r.SetRcode(req, RcodeBadCookie)
+		}
+		r.Pseudo = []RR{c}
+		return r
+	})
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID()}, Question: []RR{&A{Hdr: Header{Name: "example.org.", Class: ClassINET}}}}
+	if err := m.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{Cookies: &CookieJar{}}
+	r, _, err := c.Exchange(context.Background(), m, "udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != RcodeSuccess {
+		t.Errorf("expected rcode %s after BADCOOKIE retry, got %s", RcodeToString[RcodeSuccess], RcodeToString[r.Rcode])
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("expected 2 queries, got %d", n)
+	}
+	if len(m.Pseudo) != 0 {
+		t.Errorf("expected query to be left alone, got %v", m.Pseudo)
+	}
+	if cookie := c.Cookies.Cookie(addr); cookie.Server() == "" {
+		t.Errorf("expected server cookie to be stored")
+	}
+
+	if _, _, err := c.Exchange(context.Background(), m, "udp", addr); err != nil {
+		t.Fatal(err)
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("expected 3 queries, got %d", n)
+	}
+}
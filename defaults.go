@@ -1,26 +1,33 @@
 package dns
 
-/*
-const hexDigit = "0123456789abcdef"
-
-// Everything is assumed in ClassINET.
-
 // SetReply creates a reply message from a request message.
-func (dns *Msg) SetReply(request *Msg) *Msg {
-	dns.Id = request.Id
-	dns.Response = true
-	dns.Opcode = request.Opcode
-	if dns.Opcode == OpcodeQuery {
-		dns.RecursionDesired = request.RecursionDesired // Copy rd bit
-		dns.CheckingDisabled = request.CheckingDisabled // Copy cd bit
+func (m *Msg) SetReply(request *Msg) *Msg {
+	m.ID = request.ID
+	m.Response = true
+	m.Opcode = request.Opcode
+	if m.Opcode == OpcodeQuery {
+		m.RecursionDesired = request.RecursionDesired // Copy rd bit
+		m.CheckingDisabled = request.CheckingDisabled // Copy cd bit
 	}
-	dns.Rcode = RcodeSuccess
+	m.Rcode = RcodeSuccess
 	if len(request.Question) > 0 {
-		dns.Question = []Question{request.Question[0]}
+		m.Question = []RR{request.Question[0]}
 	}
-	return dns
+	return m
+}
+
+// SetRcode creates an error message suitable for the request.
+func (m *Msg) SetRcode(request *Msg, rcode uint16) *Msg {
+	m.SetReply(request)
+	m.Rcode = rcode
+	return m
 }
 
+/*
+const hexDigit = "0123456789abcdef"
+
+// Everything is assumed in ClassINET.
+
 // SetQuestion creates a question message, it sets the Question
 // section, generates an Id and sets the RecursionDesired (RD)
 // bit to true.
@@ -44,13 +51,6 @@ func (dns *Msg) SetNotify(z string) *Msg {
 	return dns
 }
 
-// SetRcode creates an error message suitable for the request.
-func (dns *Msg) SetRcode(request *Msg, rcode int) *Msg {
-	dns.SetReply(request)
-	dns.Rcode = rcode
-	return dns
-}
-
 // SetRcodeFormatError creates a message with FormError set.
 func (dns *Msg) SetRcodeFormatError(request *Msg) *Msg {
 	dns.Rcode = RcodeFormatError
@@ -179,10 +179,10 @@ func IsRRset(rrset []RR) bool {
 		return false
 	}
 
-	baseH := rrset[0].Header()
+	baseH, baseT := rrset[0].Header(), RRToType(rrset[0])
 	for _, rr := range rrset[1:] {
 		curH := rr.Header()
-		if curH.t != baseH.t || curH.Class != baseH.Class || curH.Name != baseH.Name {
+		if RRToType(rr) != baseT || curH.Class != baseH.Class || curH.Name != baseH.Name {
 			// Mismatch between the records, so this is not a valid rrset for
 			// signing/verifying
 			return false
@@ -0,0 +1,223 @@
+package dns
+
+// DNS 0x20 query name case randomisation, draft-vixie-dnsext-dns0x20.
+
+import (
+	"context"
+	"crypto/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// caselessTTL is how long a server that does not preserve the case of the question name is queried without
+// randomisation.
+const caselessTTL = 30 * time.Minute
+
+// caseless holds the addresses of servers that do not preserve the case of the question name, with the time
+// they are checked again.
+type caseless struct {
+	mu    sync.Mutex
+	addrs map[string]time.Time
+}
+
+func (c *caseless) has(address string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expire, ok := c.addrs[address]
+	if ok && !time.Now().Before(expire) {
+		delete(c.addrs, address)
+		return false
+	}
+	return ok
+}
+
+func (c *caseless) add(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.addrs == nil {
+		c.addrs = map[string]time.Time{}
+	}
+	c.addrs[address] = time.Now().Add(caselessTTL)
+}
+
+// exactCase is put in the context of a UDP exchange with a randomised question name. With it replies must
+// echo the question name with the exact same case, others are discarded like replies to another question.
+// The first time that happens mismatch is closed.
+type exactCase struct {
+	once     sync.Once
+	mismatch chan struct{}
+}
+
+type exactCaseKey struct{}
+
+// exactCaseMismatch returns true if ctx asks for an exact question name in r, and r does not have it.
+func exactCaseMismatch(ctx context.Context, m, r *Msg) bool {
+	ec, _ := ctx.Value(exactCaseKey{}).(*exactCase)
+	if ec == nil || len(m.Question) == 0 {
+		return false
+	}
+	if len(r.Question) > 0 && r.Question[0].Header().Name == m.Question[0].Header().Name {
+		return false
+	}
+	ec.once.Do(func() { close(ec.mismatch) })
+	return true
+}
+
+// caseRoundTripper returns a RoundTripper that sends queries over network with the case of the letters in the
+// question name randomised, and that only accepts replies that echo the question name exactly. The case of
+// the question name is restored in the reply.
+//
+// Over UDP a reply that does not echo the case could be spoofed, it is discarded and the exchange goes on
+// waiting for the real reply. The query is then asked over TCP too: when the reply to that does not echo
+// the case either, the server does not preserve case and queries to the address are no longer randomised
+// for a while. Over the other networks replies can't be spoofed off-path, so that is decided on the reply
+// itself.
+func (c *Client) caseRoundTripper(rt RoundTripper, network string) RoundTripper {
+	return RoundTripperFunc(func(ctx context.Context, m *Msg, address string) (*Msg, error) {
+		if len(m.Question) != 1 || c.caseless.has(address) {
+			return rt.RoundTrip(ctx, m, address)
+		}
+		q, name, err := withRandomCase(m)
+		if err != nil {
+			return nil, err
+		}
+		if q == nil {
+			return rt.RoundTrip(ctx, m, address) // nothing to randomise
+		}
+		if !isUDP(network) {
+			r, err := rt.RoundTrip(ctx, q, address)
+			return c.checkCase(r, err, m, name, address)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		type result struct {
+			r   *Msg
+			err error
+		}
+		ec := &exactCase{mismatch: make(chan struct{})}
+		udp, tcp := make(chan result, 1), chan result(nil)
+		go func() {
+			r, err := rt.RoundTrip(context.WithValue(ctx, exactCaseKey{}, ec), q, address)
+			udp <- result{r, err}
+		}()
+		mismatch := ec.mismatch
+		for {
+			select {
+			case res := <-udp:
+				if res.err == nil || tcp == nil {
+					if res.r != nil && len(res.r.Question) > 0 {
+						restoreCase(res.r, m, name)
+					}
+					return res.r, res.err
+				}
+				udp = nil
+			case <-mismatch:
+				mismatch = nil
+				tcp = make(chan result, 1)
+				go func() {
+					r, err := c.roundTripper("tcp"+strings.TrimPrefix(network, "udp")).RoundTrip(ctx, q, address)
+					tcp <- result{r, err}
+				}()
+			case res := <-tcp:
+				if res.err == nil || udp == nil {
+					return c.checkCase(res.r, res.err, m, name, address)
+				}
+				tcp = nil
+			}
+		}
+	})
+}
+
+// checkCase checks that the reply r, which can be trusted, echoes the question name with the random case
+// name and restores the case of m in it. If it does not, the server at address does not preserve case.
+func (c *Client) checkCase(r *Msg, err error, m *Msg, name, address string) (*Msg, error) {
+	if r == nil || len(r.Question) == 0 {
+		return r, err
+	}
+	if r.Question[0].Header().Name != name {
+		c.caseless.add(address)
+		return r, err
+	}
+	restoreCase(r, m, name)
+	return r, err
+}
+
+// withRandomCase returns a packed copy of m that has the case of the ASCII letters in its question name
+// randomised, and that name. If the name has no letters, q is nil.
+func withRandomCase(m *Msg) (q *Msg, name string, _ error) {
+	question := m.Question[0]
+	newFn, ok := TypeToRR[RRToType(question)]
+	if !ok {
+		return nil, "", nil
+	}
+
+	b := []byte(question.Header().Name)
+	random := make([]byte, len(b))
+	rand.Read(random)
+	letters := false
+	for i, c := range b {
+		if isLetter(c) {
+			letters = true
+			b[i] = c&^0x20 | random[i]&0x20
+		}
+	}
+	if !letters {
+		return nil, "", nil
+	}
+
+	rr := newFn()
+	*rr.Header() = *question.Header()
+	rr.Header().Name = string(b)
+	c := *m
+	c.Question = []RR{rr}
+	c.Data = nil
+	if err := c.Pack(); err != nil {
+		return nil, "", err
+	}
+	return &c, rr.Header().Name, nil
+}
+
+// restoreCase sets the owner names in r that are name to the question name of m. The question name in r.Data
+// is restored too, with that the names that are compressed to it.
+func restoreCase(r, m *Msg, name string) {
+	original := m.Question[0].Header().Name
+	for _, section := range [][]RR{r.Question, r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if rr.Header().Name == name {
+				rr.Header().Name = original
+			}
+		}
+	}
+
+	end := questionEnd(m.Data)
+	if end == 0 || len(r.Data) < end {
+		return
+	}
+	for i := MsgHeaderSize; i < end; i++ {
+		if r.Data[i]|0x20 != m.Data[i]|0x20 {
+			return
+		}
+	}
+	copy(r.Data[MsgHeaderSize:end], m.Data[MsgHeaderSize:end])
+}
+
+// questionEnd returns the offset just after the question name in the message msg, or zero when that name
+// is not valid or compressed.
+func questionEnd(msg []byte) int {
+	off := MsgHeaderSize
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1
+		case l&0xC0 != 0:
+			return 0
+		}
+		off += l + 1
+	}
+	return 0
+}
+
+func isLetter(c byte) bool { return c|0x20 >= 'a' && c|0x20 <= 'z' }
@@ -17,7 +17,8 @@ type Config struct {
 	Port     string   // what port to use
 	Ndots    int      // number of dots in name to trigger absolute lookup
 	Timeout  int      // seconds before giving up on packet
-	Attempts int      // lost packets before giving up on server, not used in the package dns
+	Attempts int      // lost packets before giving up on server
+	Rotate   bool     // round robin among servers, instead of always starting with the first
 }
 
 // FromFile parses a resolv.conf(5) like file and returns a *Config.
@@ -95,7 +96,7 @@ func FromReader(resolvconf io.Reader) (*Config, error) {
 					}
 					c.Attempts = n
 				case s == "rotate":
-					/* not imp */
+					c.Rotate = true
 				}
 			}
 		}
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/miekg/dnsv2/dnsutil"
+	"golang.org/x/crypto/cryptobyte"
 )
 
 // DNSSEC encryption algorithm codes.
@@ -267,7 +268,7 @@ func (rr *RRSIG) Sign(k crypto.Signer, rrset []RR) error {
 	if rr.OrigTTL == 0 { // If set don't override
 		rr.OrigTTL = h0.TTL
 	}
-	rr.TypeCovered = h0.t
+	rr.TypeCovered = RRToType(rrset[0])
 	rr.Labels = uint8(dnsutil.Count(h0.Name))
 
 	if strings.HasPrefix(h0.Name, "*") {
@@ -388,7 +389,7 @@ func (rr *RRSIG) Verify(k *DNSKEY, rrset []RR) error {
 	// IsRRset checked that we have at least one RR and that the RRs in
 	// the set have consistent type, class, and name. Also check that type and
 	// class matches the RRSIG record.
-	if h0 := rrset[0].Header(); h0.Class != rr.Hdr.Class || h0.t != rr.TypeCovered {
+	if h0 := rrset[0].Header(); h0.Class != rr.Hdr.Class || RRToType(rrset[0]) != rr.TypeCovered {
 		return ErrRRset
 	}
 
@@ -598,23 +599,22 @@ func (p wireSlice) Less(i, j int) bool {
 	return bytes.Compare(p[i][ioff+10:], p[j][joff+10:]) < 0
 }
 
-// Return the raw signature data.
+// Return the raw signature data. The RRs in rrset are not modified, the canonical form is built from a copy.
 func rawSignatureData(rrset []RR, s *RRSIG) (buf []byte, err error) {
 	wires := make(wireSlice, len(rrset))
+	scratch := make([]byte, MaxMsgSize)
 	for i, r := range rrset {
-		//		r1 := r.copy()
-		r1 := r
+		r1, err := copyRR(r, scratch)
+		if err != nil {
+			return nil, err
+		}
 		h := r1.Header()
 		h.TTL = s.OrigTTL
-		/*
-			labels := SplitDomainName(h.Name)
-			// 6.2. Canonical RR Form. (4) - wildcards
-			if len(labels) > int(s.Labels) {
-				// Wildcard
-				h.Name = "*." + strings.Join(labels[len(labels)-int(s.Labels):], ".") + "."
-			}
-			// TODO
-		*/
+		// 6.2. Canonical RR Form. (4) - wildcards
+		if dnsutil.Count(h.Name) > int(s.Labels) {
+			j, _ := dnsutil.Prev(h.Name, int(s.Labels))
+			h.Name = "*." + h.Name[j:]
+		}
 		// RFC 4034: 6.2.  Canonical RR Form. (2) - domain name to lowercase
 		h.Name = dnsutil.Canonical(h.Name)
 		// 6.2. Canonical RR Form. (3) - domain rdata to lowercase.
@@ -674,13 +674,11 @@ func rawSignatureData(rrset []RR, s *RRSIG) (buf []byte, err error) {
 			x.Target = dnsutil.Canonical(x.Target)
 		}
 		// 6.2. Canonical RR Form. (5) - origTTL
-		wire := make([]byte, r1.Len()+1) // +1 to be safe(r)
-		off, err1 := PackRR(r1, wire, 0, nil)
-		if err1 != nil {
-			return nil, err1
+		off, err := PackRR(r1, scratch, 0, nil)
+		if err != nil {
+			return nil, err
 		}
-		wire = wire[:off]
-		wires[i] = wire
+		wires[i] = bytes.Clone(scratch[:off])
 	}
 	sort.Sort(wires)
 	for i, wire := range wires {
@@ -692,6 +690,17 @@ func rawSignatureData(rrset []RR, s *RRSIG) (buf []byte, err error) {
 	return buf, nil
 }
 
+// copyRR returns a deep copy of r by packing it into scratch and unpacking it again.
+func copyRR(r RR, scratch []byte) (RR, error) {
+	off, err := PackRR(r, scratch, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	wire := bytes.Clone(scratch[:off])
+	s := cryptobyte.String(wire)
+	return unpackRR(&s, wire)
+}
+
 func packSigWire(sw *rrsigWireFmt, msg []byte) (int, error) {
 	// copied from zmsg.go RRSIG packing
 	off, err := packUint16(sw.TypeCovered, msg, 0)
@@ -2,6 +2,8 @@ package dnsutil
 
 import (
 	"strings"
+
+	"github.com/miekg/dnsv2/internal/ddd"
 )
 
 // Holds a bunch of helper functions for dealing with labels.
@@ -117,3 +119,82 @@ func Prev(s string, n int) (i int, start bool) {
 
 	return 0, n > 1
 }
+
+// IsSubDomain checks if child is indeed a child of the parent. If child and parent are the same domain true is
+// returned as well. The comparison is case insensitive.
+func IsSubDomain(parent, child string) bool {
+	parent, child = Canonical(parent), Canonical(child)
+	if parent == "." {
+		return true
+	}
+	if !strings.HasSuffix(child, parent) {
+		return false
+	}
+	i := len(child) - len(parent)
+	if i == 0 {
+		return true
+	}
+	if child[i-1] != '.' {
+		return false
+	}
+	// The dot must not be escaped.
+	j := i - 2
+	for j >= 0 && child[j] == '\\' {
+		j--
+	}
+	return (i-2-j)%2 == 0
+}
+
+// Compare compares the names a and b in canonical DNS name order, see RFC 4034 section 6.1. The result is 0
+// if a == b, -1 if a < b and +1 if a > b.
+func Compare(a, b string) int {
+	la, lb := canonicalLabels(a), canonicalLabels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	}
+	return 0
+}
+
+// canonicalLabels returns the labels of s, unescaped and with upper case ASCII letters converted to lower case.
+func canonicalLabels(s string) []string {
+	s = Fqdn(s)
+	idx := Split(s)
+	labels := make([]string, len(idx))
+	for i, start := range idx {
+		end := len(s)
+		if i+1 < len(idx) {
+			end = idx[i+1]
+		}
+		labels[i] = unescapeLabel(s[start : end-1]) // without the separating dot
+	}
+	return labels
+}
+
+func unescapeLabel(label string) string {
+	b := make([]byte, 0, len(label))
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if c == '\\' && i+1 < len(label) {
+			if ddd.Is(label[i+1:]) {
+				c = ddd.ToByte(label[i+1:])
+				i += 3
+			} else {
+				i++
+				c = label[i]
+			}
+		}
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
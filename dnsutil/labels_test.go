@@ -19,3 +19,56 @@ func TestJoin(t *testing.T) {
 		}
 	}
 }
+
+func TestIsSubDomain(t *testing.T) {
+	tests := []struct {
+		parent, child string
+		out           bool
+	}{
+		{".", "example.org.", true},
+		{"example.org.", "example.org.", true},
+		{"example.org.", "www.Example.ORG.", true},
+		{"example.org.", "wwwexample.org.", false},
+		{"www.example.org.", "example.org.", false},
+		{"example.org.", `www\.example.org.`, false},
+		{"example.org.", `www\\.example.org.`, true},
+	}
+
+	for i, tc := range tests {
+		if x := IsSubDomain(tc.parent, tc.child); x != tc.out {
+			t.Errorf("Test %d, expected %t, got %t", i, tc.out, x)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// RFC 4034 section 6.1.
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		`\001.z.example.`,
+		"*.z.example.",
+		`\200.z.example.`,
+	}
+	for i := range names {
+		for j := range names {
+			expect := 0
+			switch {
+			case i < j:
+				expect = -1
+			case i > j:
+				expect = 1
+			}
+			if x := Compare(names[i], names[j]); x != expect {
+				t.Errorf("Compare(%q, %q): expected %d, got %d", names[i], names[j], expect, x)
+			}
+		}
+	}
+	if x := Compare("Example.ORG.", "example.org"); x != 0 {
+		t.Errorf("expected names to be equal, got %d", x)
+	}
+}
@@ -52,7 +52,7 @@ querying the DNS at a server configured on 127.0.0.1 and port 53:
 	in, rtt, err := c.Exchange(m1, "127.0.0.1:53")
 
 Suppressing multiple outstanding queries (with the same question, type and
-class) is as easy as setting:
+class and DO bit to the same server) is as easy as setting:
 
 	c.SingleInflight = true
 
@@ -159,18 +159,21 @@ Basic use pattern when querying with a TSIG name "axfr." (note that these key na
 must be fully qualified - as they are domain names) and the base64 secret
 "so6ZGir4GPAqINNh9U5c3A==":
 
-If an incoming message contains a TSIG record it MUST be the last record in
-the additional section (RFC2845 3.2).  This means that you should make the
-call to SetTsig last, right before executing the query.  If you make any
-changes to the RRset after calling SetTsig() the signature will be incorrect.
+The TSIG record is put in the pseudo section of the message, when packing it is
+always the last record in the additional section (RFC 8945 4.2). The client signs
+the message right before sending it and verifies the TSIG of the reply, using
+the MAC of the query. If you make any changes to the message after it has been
+signed the signature will be incorrect.
 
 	c := new(dns.Client)
 	c.TsigSecret = map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
-	m := new(dns.Msg)
-	m.SetQuestion("miek.nl.", dns.TypeMX)
-	m.SetTsig("axfr.", dns.HmacSHA256, 300, time.Now().Unix())
-	...
-	// When sending the TSIG RR is calculated and filled in before sending
+	m := &dns.Msg{MsgHeader: dns.MsgHeader{ID: dns.ID()}}
+	m.Question = []dns.RR{&dns.MX{Hdr: dns.Header{Name: "miek.nl.", Class: dns.ClassINET}}}
+	m.Pseudo = []dns.RR{&dns.TSIG{Hdr: dns.Header{Name: "axfr."}, Algorithm: dns.HmacSHA256}}
+	m.Pack()
+	r, _, err := c.Exchange(ctx, m, "udp", "176.58.119.54:53")
+	// When sending the TSIG RR is calculated and filled in before sending, err is
+	// dns.ErrSig, dns.ErrTime or dns.ErrBadKey if the reply does not verify.
 
 When requesting an zone transfer (almost all TSIG usage is when requesting zone
 transfers), with TSIG, this is the basic use pattern. In this example we
@@ -178,11 +181,11 @@ request an AXFR for miek.nl. with TSIG key named "axfr." and secret
 "so6ZGir4GPAqINNh9U5c3A==" and using the server 176.58.119.54:
 
 	t := new(dns.Transfer)
-	m := new(dns.Msg)
 	t.TsigSecret = map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
-	m.SetAxfr("miek.nl.")
-	m.SetTsig("axfr.", dns.HmacSHA256, 300, time.Now().Unix())
-	c, err := t.In(m, "176.58.119.54:53")
+	m := &dns.Msg{MsgHeader: dns.MsgHeader{ID: dns.ID()}}
+	m.Question = []dns.RR{&dns.AXFR{Hdr: dns.Header{Name: "miek.nl.", Class: dns.ClassINET}}}
+	m.Pseudo = []dns.RR{&dns.TSIG{Hdr: dns.Header{Name: "axfr."}, Algorithm: dns.HmacSHA256}}
+	c, err := t.In(ctx, m, "176.58.119.54:53")
 	for r := range c { ... }
 
 You can now read the records from the transfer as they come in. Each envelope
@@ -206,9 +209,7 @@ client must be configured with an implementation of the TsigProvider interface:
 
 	c := new(dns.Client)
 	c.TsigProvider = new(Provider)
-	m := new(dns.Msg)
-	m.SetQuestion("miek.nl.", dns.TypeMX)
-	m.SetTsig(keyname, dns.HmacSHA256, 300, time.Now().Unix())
+	m.Pseudo = []dns.RR{&dns.TSIG{Hdr: dns.Header{Name: keyname}, Algorithm: dns.HmacSHA256}}
 	...
 	// TSIG RR is calculated by calling your Generate method
 
@@ -219,13 +220,17 @@ Basic use pattern validating and replying to a message that has TSIG set.
 	go server.ListenAndServe()
 	dns.HandleFunc(".", handleRequest)
 
-	func handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	func handleRequest(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
 		m := new(dns.Msg)
 		m.SetReply(r)
-		if r.IsTsig() != nil {
+		for _, rr := range r.Pseudo {
+			t, ok := rr.(*dns.TSIG)
+			if !ok {
+				continue
+			}
 			if w.TsigStatus() == nil {
-				// *Msg r has an TSIG record and it was validated
-				m.SetTsig("axfr.", dns.HmacSHA256, 300, time.Now().Unix())
+				// *Msg r has an TSIG record and it was validated, the reply is signed when it is written
+				m.Pseudo = []dns.RR{&dns.TSIG{Hdr: dns.Header{Name: t.Hdr.Name}, Algorithm: t.Algorithm}}
 			} else {
 				// *Msg r has an TSIG records and it was not validated
 			}
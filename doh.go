@@ -0,0 +1,148 @@
+package dns
+
+// DNS over HTTPS (DoH), RFC 8484, client side.
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MimeType is the media type for DNS messages as used in DNS over HTTPS.
+const MimeType = "application/dns-message"
+
+// HTTPError is returned when a DNS over HTTPS server replies with a non successful status code.
+type HTTPError struct {
+	StatusCode int    // StatusCode is the HTTP status code, i.e. 415.
+	Status     string // Status is the HTTP status, i.e. "415 Unsupported Media Type".
+}
+
+func (e *HTTPError) Error() string { return "dns: http status " + e.Status }
+
+// exchangeHTTPS sends m to the DoH server with the URL in address and waits for a reply. A reply with
+// another ID or question than m is an error, ErrId or ErrQuestion.
+func (t *Transport) exchangeHTTPS(ctx context.Context, m *Msg, address string) (*Msg, error) {
+	ctx = ContextClientTrace(ctx).httpTrace(ctx, m)
+	req, err := t.newHTTPRequest(ctx, m, address)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct != MimeType {
+		return nil, &Error{err: "unexpected content-type: " + resp.Header.Get("Content-Type")}
+	}
+
+	r := new(Msg)
+	r.Data, err = io.ReadAll(io.LimitReader(resp.Body, MaxMsgSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Data) > MaxMsgSize {
+		return nil, ErrBuf
+	}
+	if err := r.Unpack(); err != nil {
+		return r, err
+	}
+	if err := isReply(m, r); err != nil {
+		return nil, err
+	}
+
+	if freshness, ok := httpFreshness(resp.Header); ok {
+		capTTL(r, freshness)
+	}
+	return r, nil
+}
+
+// newHTTPRequest creates the HTTP request that carries m. If the transport has HTTPGet set, the message is
+// encoded in the "dns" query parameter, otherwise it is the body of a POST.
+func (t *Transport) newHTTPRequest(ctx context.Context, m *Msg, address string) (*http.Request, error) {
+	var (
+		req *http.Request
+		err error
+	)
+	if t.HTTPGet {
+		u, perr := url.Parse(address)
+		if perr != nil {
+			return nil, perr
+		}
+		q := u.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(m.Data))
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(m.Data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", MimeType)
+	}
+	req.Header.Set("Accept", MimeType)
+	return req, nil
+}
+
+// httpClient returns the HTTP client to use for DNS over HTTPS.
+func (t *Transport) httpClient() *http.Client {
+	if t.HTTPClient != nil {
+		return t.HTTPClient
+	}
+	t.httpOnce.Do(func() {
+		t.httpc = &http.Client{Transport: &http.Transport{
+			DialContext:       t.DialContext,
+			TLSClientConfig:   t.TLSClientConfig,
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		}}
+	})
+	return t.httpc
+}
+
+// httpFreshness returns the freshness lifetime of a response, this is the max-age from the Cache-Control
+// header minus the value of the Age header. If there is no max-age, the bool is false.
+func httpFreshness(h http.Header) (uint32, bool) {
+	maxAge := -1
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if v, err := strconv.Atoi(value); err == nil && v >= 0 {
+				maxAge = v
+			}
+		}
+	}
+	if maxAge < 0 {
+		return 0, false
+	}
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+		maxAge = max(maxAge-age, 0)
+	}
+	return uint32(maxAge), true
+}
+
+// capTTL lowers the TTL of all RRs in m to be at most ttl. The Data of m is not changed.
+func capTTL(m *Msg, ttl uint32) {
+	for _, s := range [][]RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range s {
+			if h := rr.Header(); h.TTL > ttl {
+				h.TTL = ttl
+			}
+		}
+	}
+}
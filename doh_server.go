@@ -0,0 +1,173 @@
+package dns
+
+// DNS over HTTPS (DoH), RFC 8484, server side.
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// HTTPHandler returns an http.Handler that serves DNS over HTTPS requests by calling h. Both GET requests
+// with the "dns" query parameter and POST requests are supported. If h is nil DefaultServeMux is used. To serve
+// the same handlers on port 53 and over HTTPS:
+//
+//	mux := dns.NewServeMux()
+//	mux.HandleFunc("example.org.", handleExample)
+//	http.Handle("/dns-query", dns.HTTPHandler(mux))
+//
+// The ResponseWriter given to h has the addresses of the HTTP connection. The reply has its Cache-Control
+// max-age set to the lowest TTL found in the answer and authority sections.
+func HTTPHandler(h Handler) http.Handler {
+	if h == nil {
+		h = DefaultServeMux
+	}
+	return &httpHandler{h}
+}
+
+type httpHandler struct {
+	h Handler
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+	switch req.Method {
+	case http.MethodGet:
+		q := req.URL.Query().Get("dns")
+		if q == "" {
+			http.Error(w, "missing dns query parameter", http.StatusBadRequest)
+			return
+		}
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(q, "="))
+	case http.MethodPost:
+		if ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); ct != MimeType {
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(io.LimitReader(req.Body, MaxMsgSize+1))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(buf) > MaxMsgSize {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	m := &Msg{Data: buf}
+	if err := m.Unpack(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw := &httpResponse{w: w, req: req}
+	info := &ConnInfo{Network: "https", LocalAddr: rw.LocalAddr(), RemoteAddr: rw.RemoteAddr(), TLS: req.TLS}
+	h.h.ServeDNS(NewConnInfoContext(req.Context(), info), rw, m)
+	if !rw.written && !rw.hijacked {
+		http.Error(w, "no reply", http.StatusInternalServerError)
+	}
+}
+
+// httpResponse implements ResponseWriter for DNS over HTTPS.
+type httpResponse struct {
+	w        http.ResponseWriter
+	req      *http.Request
+	written  bool
+	hijacked bool
+}
+
+// WriteMsg implements the ResponseWriter.WriteMsg method.
+func (w *httpResponse) WriteMsg(m *Msg) error {
+	if err := m.Pack(); err != nil {
+		return err
+	}
+	_, err := w.write(m.Data, m)
+	return err
+}
+
+// Write implements the ResponseWriter.Write method.
+func (w *httpResponse) Write(b []byte) (int, error) {
+	m := &Msg{Data: b}
+	if err := m.Unpack(); err != nil {
+		return 0, err
+	}
+	return w.write(b, m)
+}
+
+func (w *httpResponse) write(b []byte, m *Msg) (int, error) {
+	if w.written {
+		return 0, &Error{err: "reply already written"}
+	}
+	w.written = true
+
+	w.w.Header().Set("Content-Type", MimeType)
+	w.w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(minTTL(m)), 10))
+	w.w.WriteHeader(http.StatusOK)
+	return w.w.Write(b)
+}
+
+// LocalAddr implements the ResponseWriter.LocalAddr method.
+func (w *httpResponse) LocalAddr() net.Addr {
+	if addr, ok := w.req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return nil
+}
+
+// RemoteAddr implements the ResponseWriter.RemoteAddr method.
+func (w *httpResponse) RemoteAddr() net.Addr {
+	ap, err := netip.ParseAddrPort(w.req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// Close implements the ResponseWriter.Close method. The HTTP connection is managed by the http.Server, so this is a noop.
+func (w *httpResponse) Close() error { return nil }
+
+// TsigStatus implements the ResponseWriter.TsigStatus method.
+func (w *httpResponse) TsigStatus() error { return nil }
+
+// TsigTimersOnly implements the ResponseWriter.TsigTimersOnly method.
+func (w *httpResponse) TsigTimersOnly(bool) {}
+
+// Hijack implements the ResponseWriter.Hijack method.
+func (w *httpResponse) Hijack() { w.hijacked = true }
+
+// ConnectionState implements the ConnectionStater.ConnectionState interface.
+func (w *httpResponse) ConnectionState() *tls.ConnectionState { return w.req.TLS }
+
+// minTTL returns the lowest TTL of the RRs in the answer and authority sections of m. For a SOA record the
+// minimum TTL from its rdata is also considered, as that is used for negative caching. If there are no RRs
+// zero is returned.
+func minTTL(m *Msg) uint32 {
+	ttl, seen := uint32(0), false
+	for _, s := range [][]RR{m.Answer, m.Ns} {
+		for _, rr := range s {
+			t := rr.Header().TTL
+			if soa, ok := rr.(*SOA); ok {
+				t = min(t, soa.Minttl)
+			}
+			if !seen || t < ttl {
+				ttl, seen = t, true
+			}
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientHTTPS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var (
+			buf []byte
+			err error
+		)
+		switch req.Method {
+		case http.MethodGet:
+			buf, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		case http.MethodPost:
+			buf, err = io.ReadAll(req.Body)
+		}
+		m := &Msg{Data: buf}
+		if err != nil || m.Unpack() != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		r := &Msg{MsgHeader: MsgHeader{ID: m.ID, Response: true}, Question: m.Question}
+		switch m.Question[0].Header().Name {
+		case "id.miek.nl.":
+			r.ID++
+		case "question.miek.nl.":
+			r.Question = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+		}
+		r.Answer = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET, TTL: 3600}, A: net.IPv4(127, 0, 0, 1).To4()}}
+		r.Pack()
+		w.Header().Set("Content-Type", MimeType)
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Header().Set("Age", "100")
+		w.Write(r.Data)
+	}))
+	defer ts.Close()
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+	m.Question = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+	m.Pack()
+
+	for _, get := range []bool{false, true} {
+		c := &Client{Transport: &Transport{HTTPClient: ts.Client(), HTTPGet: get}}
+		r, _, err := c.Exchange(context.Background(), m, "https", ts.URL+"/dns-query")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ID != m.ID || len(r.Answer) != 1 || len(r.Data) == 0 {
+			t.Fatalf("expected reply with ID %d and 1 answer, got:\n%s", m.ID, r)
+		}
+		if ttl := r.Answer[0].Header().TTL; ttl != 200 {
+			t.Errorf("expected TTL to be capped to %d, got %d", 200, ttl)
+		}
+	}
+
+	c := &Client{Transport: &Transport{HTTPClient: ts.Client()}}
+	for name, want := range map[string]error{"id.miek.nl.": ErrId, "question.miek.nl.": ErrQuestion} {
+		m := &Msg{MsgHeader: MsgHeader{ID: ID()}, Question: []RR{&A{Hdr: Header{Name: name, Class: ClassINET}}}}
+		m.Pack()
+		if _, _, err := c.Exchange(context.Background(), m, "https", ts.URL+"/dns-query"); !errors.Is(err, want) {
+			t.Errorf("expected %v for %s, got %v", want, name, err)
+		}
+	}
+
+	_, _, err := c.Exchange(context.Background(), &Msg{Data: []byte{1}}, "https", ts.URL+"/dns-query")
+	herr := &HTTPError{}
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected HTTPError with status %d, got %v", http.StatusBadRequest, err)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("miek.nl.", func(ctx context.Context, w ResponseWriter, req *Msg) {
+		m := new(Msg).SetReply(req)
+		ip := w.RemoteAddr().(*net.TCPAddr).IP
+		m.Answer = []RR{
+			&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET, TTL: 3600}, A: ip.To4()},
+			&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET, TTL: 60}, A: ip.To4()},
+		}
+		w.WriteMsg(m)
+	})
+	ts := httptest.NewTLSServer(HTTPHandler(mux))
+	defer ts.Close()
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+	m.Question = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+	m.Pack()
+
+	for _, get := range []bool{false, true} {
+		c := &Client{Transport: &Transport{HTTPClient: ts.Client(), HTTPGet: get}}
+		r, _, err := c.Exchange(context.Background(), m, "https", ts.URL+"/dns-query")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 2 || !r.Answer[0].(*A).A.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("expected 2 answers with remote address, got:\n%s", r)
+		}
+		if ttl := r.Answer[0].Header().TTL; ttl != 60 {
+			t.Errorf("expected TTL to be capped to %d, got %d", 60, ttl)
+		}
+	}
+
+	// Not handled by the mux.
+	m.Question = []RR{&A{Hdr: Header{Name: "example.org.", Class: ClassINET}}}
+	m.Pack()
+	c := &Client{Transport: &Transport{HTTPClient: ts.Client()}}
+	r, _, err := c.Exchange(context.Background(), m, "https", ts.URL+"/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != RcodeRefused {
+		t.Errorf("expected rcode %s, got %s", RcodeToString[RcodeRefused], RcodeToString[r.Rcode])
+	}
+
+	resp, err := ts.Client().Post(ts.URL+"/dns-query", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status %d, got %d", http.StatusUnsupportedMediaType, resp.StatusCode)
+	}
+}
@@ -0,0 +1,336 @@
+package dns
+
+// DNS over QUIC (DoQ), RFC 9250.
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/quic"
+)
+
+// DoQError is a DNS over QUIC error code. It is returned when the peer resets a stream or closes the
+// connection with one of these codes, use errors.Is to test for a specific code.
+type DoQError uint64
+
+// DoQ error codes, see RFC 9250, Section 4.3.
+const (
+	DoQNoError          DoQError = 0x0 // No error, used when the connection or stream needs to be closed.
+	DoQInternalError    DoQError = 0x1 // The DoQ implementation encountered an internal error.
+	DoQProtocolError    DoQError = 0x2 // The DoQ implementation encountered a protocol error.
+	DoQRequestCancelled DoQError = 0x3 // A DoQ client uses this to signal that it wants to cancel an outstanding transaction.
+	DoQExcessiveLoad    DoQError = 0x4 // A DoQ implementation uses this to signal when closing a connection due to excessive load.
+	DoQUnspecifiedError DoQError = 0x5 // A DoQ implementation uses this in the absence of a more specific error code.
+)
+
+// DoQErrorToString maps DoQ error codes to strings.
+var DoQErrorToString = map[DoQError]string{
+	DoQNoError:          "DOQ_NO_ERROR",
+	DoQInternalError:    "DOQ_INTERNAL_ERROR",
+	DoQProtocolError:    "DOQ_PROTOCOL_ERROR",
+	DoQRequestCancelled: "DOQ_REQUEST_CANCELLED",
+	DoQExcessiveLoad:    "DOQ_EXCESSIVE_LOAD",
+	DoQUnspecifiedError: "DOQ_UNSPECIFIED_ERROR",
+}
+
+func (e DoQError) Error() string {
+	if s, ok := DoQErrorToString[e]; ok {
+		return "dns: " + s
+	}
+	return "dns: doq error 0x" + strconv.FormatUint(uint64(e), 16)
+}
+
+// doqError translates the QUIC application error codes found in err into a DoQError.
+func doqError(err error) error {
+	var code quic.StreamErrorCode
+	if errors.As(err, &code) {
+		return DoQError(code)
+	}
+	var aerr *quic.ApplicationError
+	if errors.As(err, &aerr) {
+		return DoQError(aerr.Code)
+	}
+	return err
+}
+
+// quicConns holds the QUIC endpoint and the open DoQ connections of a Transport. The endpoint is created on
+// first use and closed by Transport.Close.
+type quicConns struct {
+	mu       sync.Mutex
+	endpoint *quic.Endpoint
+	conns    map[string]*quic.Conn
+}
+
+// exchangeQUIC sends m to the DoQ server at address on a new stream and waits for the reply.
+func (t *Transport) exchangeQUIC(ctx context.Context, m *Msg, address string) (r *Msg, err error) {
+	if len(m.Data) < 2 {
+		return nil, ErrShortRead
+	}
+
+	conn, s, err := t.quicStream(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	trace := ContextClientTrace(ctx)
+	s.SetReadContext(ctx)
+	s.SetWriteContext(ctx)
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			s.Reset(uint64(DoQRequestCancelled))
+		}
+		s.CloseRead()
+	}()
+
+	buf := make([]byte, 2+len(m.Data))
+	binary.BigEndian.PutUint16(buf, uint16(len(m.Data)))
+	copy(buf[2:], m.Data)
+	buf[2], buf[3] = 0, 0 // the ID must be zero, RFC 9250, Section 4.2.1.
+	n, err := s.Write(buf)
+	trace.wroteQuery(n, err)
+	if err != nil {
+		return nil, doqError(err)
+	}
+	s.CloseWrite() // sends the data and the STREAM FIN
+
+	var length uint16
+	if err := binary.Read(s, binary.BigEndian, &length); err != nil {
+		return nil, doqError(err)
+	}
+	trace.gotFirstResponseByte()
+	r = &Msg{Data: make([]byte, length)}
+	if _, err := io.ReadFull(s, r.Data); err != nil {
+		return nil, doqError(err)
+	}
+
+	if err := r.Unpack(); err != nil {
+		return r, err
+	}
+	if r.ID != 0 {
+		t.dropQUIC(address, conn)
+		conn.Abort(&quic.ApplicationError{Code: uint64(DoQProtocolError)})
+		return r, DoQProtocolError
+	}
+	r.ID = m.ID
+	binary.BigEndian.PutUint16(r.Data, m.ID)
+	return r, nil
+}
+
+// quicStream returns a new stream on the connection to address. An existing connection is used when there
+// is one, otherwise a new one is dialed.
+func (t *Transport) quicStream(ctx context.Context, address string) (*quic.Conn, *quic.Stream, error) {
+	trace := ContextClientTrace(ctx)
+	t.quic.mu.Lock()
+	if t.quic.endpoint == nil {
+		e, err := quic.Listen("udp", ":0", nil)
+		if err != nil {
+			t.quic.mu.Unlock()
+			return nil, nil, err
+		}
+		t.quic.endpoint = e
+	}
+	endpoint := t.quic.endpoint
+	conn := t.quic.conns[address]
+	t.quic.mu.Unlock()
+	if conn != nil {
+		s, err := conn.NewStream(ctx)
+		if err == nil {
+			trace.gotConn(nil, true)
+			return conn, s, nil
+		}
+		t.dropQUIC(address, conn) // connection was closed, dial a new one
+	}
+
+	trace.dialStart("quic", address)
+	conn, err := endpoint.Dial(ctx, "udp", address, &quic.Config{TLSConfig: t.tlsConfig(address, "doq")})
+	trace.dialDone("quic", address, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.quic.mu.Lock()
+	if t.quic.conns == nil {
+		t.quic.conns = map[string]*quic.Conn{}
+	}
+	if c, ok := t.quic.conns[address]; ok {
+		// Lost a race with another query, use its connection.
+		conn.Abort(nil)
+		conn = c
+	} else {
+		t.quic.conns[address] = conn
+	}
+	t.quic.mu.Unlock()
+
+	s, err := conn.NewStream(ctx)
+	if err != nil {
+		t.dropQUIC(address, conn)
+		return nil, nil, doqError(err)
+	}
+	trace.gotConn(nil, false)
+	return conn, s, nil
+}
+
+// dropQUIC forgets the connection to address, if it is conn.
+func (t *Transport) dropQUIC(address string, conn *quic.Conn) {
+	t.quic.mu.Lock()
+	defer t.quic.mu.Unlock()
+	if t.quic.conns[address] == conn {
+		delete(t.quic.conns, address)
+	}
+}
+
+// closeQUIC closes the QUIC endpoint, which aborts all DoQ connections made from it.
+func (t *Transport) closeQUIC() error {
+	t.quic.mu.Lock()
+	endpoint := t.quic.endpoint
+	t.quic.endpoint = nil
+	t.quic.conns = nil
+	t.quic.mu.Unlock()
+
+	if endpoint == nil {
+		return nil
+	}
+	return endpoint.Close(context.Background())
+}
+
+// ListenAndServeQUIC listens on the UDP address addr and serves DNS over QUIC by calling handler, if handler
+// is nil DefaultServeMux is used. The config must have at least one certificate, when it does not set
+// NextProtos "doq" is used. ListenAndServeQUIC always returns a non-nil error.
+func ListenAndServeQUIC(addr string, config *tls.Config, handler Handler) error {
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"doq"}
+	}
+	l, err := quic.Listen("udp", addr, &quic.Config{TLSConfig: config})
+	if err != nil {
+		return err
+	}
+	defer l.Close(context.Background())
+	return ServeQUIC(l, handler)
+}
+
+// ServeQUIC accepts DNS over QUIC connections on the endpoint l. Each query is read from its own stream and
+// served by calling handler, if handler is nil DefaultServeMux is used. A query with a non-zero ID closes the
+// connection with DOQ_PROTOCOL_ERROR. When the handler does not write a reply, the stream is reset with
+// DOQ_INTERNAL_ERROR. The handler has two seconds to write its reply, the context given to it has that as
+// its deadline. ServeQUIC returns when l is closed, the returned error is never nil.
+func ServeQUIC(l *quic.Endpoint, handler Handler) error {
+	if handler == nil {
+		handler = DefaultServeMux
+	}
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go serveQUICConn(conn, handler)
+	}
+}
+
+func serveQUICConn(conn *quic.Conn, h Handler) {
+	for {
+		s, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go serveQUICStream(conn, s, h)
+	}
+}
+
+func serveQUICStream(conn *quic.Conn, s *quic.Stream, h Handler) {
+	var length uint16
+	if err := binary.Read(s, binary.BigEndian, &length); err != nil {
+		s.Reset(uint64(DoQProtocolError))
+		return
+	}
+	req := &Msg{Data: make([]byte, length)}
+	if _, err := io.ReadFull(s, req.Data); err != nil {
+		s.Reset(uint64(DoQProtocolError))
+		return
+	}
+	if err := req.Unpack(); err != nil || req.ID != 0 {
+		conn.Abort(&quic.ApplicationError{Code: uint64(DoQProtocolError)})
+		return
+	}
+
+	w := &quicResponse{conn: conn, s: s}
+	info := &ConnInfo{Network: "quic", LocalAddr: w.LocalAddr(), RemoteAddr: w.RemoteAddr(), TLS: w.ConnectionState()}
+	ctx, cancel := context.WithTimeout(NewConnInfoContext(context.Background(), info), dnsTimeout)
+	defer cancel()
+	s.SetWriteContext(ctx)
+	h.ServeDNS(ctx, w, req)
+	if !w.written && !w.hijacked {
+		s.Reset(uint64(DoQInternalError))
+		s.CloseRead()
+	}
+}
+
+// quicResponse implements ResponseWriter for DNS over QUIC.
+type quicResponse struct {
+	conn     *quic.Conn
+	s        *quic.Stream
+	written  bool
+	hijacked bool
+}
+
+// WriteMsg implements the ResponseWriter.WriteMsg method.
+func (w *quicResponse) WriteMsg(m *Msg) error {
+	if err := m.Pack(); err != nil {
+		return err
+	}
+	_, err := w.Write(m.Data)
+	return err
+}
+
+// Write implements the ResponseWriter.Write method. The ID in b is set to zero before it is sent.
+func (w *quicResponse) Write(b []byte) (int, error) {
+	if w.written {
+		return 0, &Error{err: "reply already written"}
+	}
+	if len(b) < 2 {
+		return 0, ErrShortRead
+	}
+	w.written = true
+
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	buf[2], buf[3] = 0, 0
+	if _, err := w.s.Write(buf); err != nil {
+		return 0, doqError(err)
+	}
+	w.s.CloseWrite()
+	w.s.CloseRead()
+	return len(b), nil
+}
+
+// LocalAddr implements the ResponseWriter.LocalAddr method.
+func (w *quicResponse) LocalAddr() net.Addr { return net.UDPAddrFromAddrPort(w.conn.LocalAddr()) }
+
+// RemoteAddr implements the ResponseWriter.RemoteAddr method.
+func (w *quicResponse) RemoteAddr() net.Addr { return net.UDPAddrFromAddrPort(w.conn.RemoteAddr()) }
+
+// Close implements the ResponseWriter.Close method, it closes the QUIC connection.
+func (w *quicResponse) Close() error {
+	w.conn.Abort(&quic.ApplicationError{Code: uint64(DoQNoError)})
+	return nil
+}
+
+// TsigStatus implements the ResponseWriter.TsigStatus method.
+func (w *quicResponse) TsigStatus() error { return nil }
+
+// TsigTimersOnly implements the ResponseWriter.TsigTimersOnly method.
+func (w *quicResponse) TsigTimersOnly(bool) {}
+
+// Hijack implements the ResponseWriter.Hijack method.
+func (w *quicResponse) Hijack() { w.hijacked = true }
+
+// ConnectionState implements the ConnectionStater.ConnectionState interface.
+func (w *quicResponse) ConnectionState() *tls.ConnectionState {
+	cs := w.conn.ConnectionState()
+	return &cs
+}
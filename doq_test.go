@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+func TestClientQUIC(t *testing.T) {
+	cert, pool := selfSignedCert(t, "dns.example.org")
+	l, err := quic.Listen("udp", "127.0.0.1:0", &quic.Config{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}, MinVersion: tls.VersionTLS13},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close(context.Background())
+
+	mux := NewServeMux()
+	mux.HandleFunc("miek.nl.", func(ctx context.Context, w ResponseWriter, req *Msg) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected a deadline on the handler's context")
+		}
+		m := new(Msg).SetReply(req)
+		ip := w.RemoteAddr().(*net.UDPAddr).IP
+		m.Answer = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET, TTL: 3600}, A: ip.To4()}}
+		w.WriteMsg(m)
+	})
+	mux.HandleFunc("example.org.", func(ctx context.Context, w ResponseWriter, req *Msg) {}) // no reply
+	go ServeQUIC(l, mux)
+
+	c := &Client{Transport: &Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for range 2 {
+		m := &Msg{MsgHeader: MsgHeader{ID: ID() | 1, RecursionDesired: true}}
+		m.Question = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+		m.Pack()
+
+		r, _, err := c.Exchange(ctx, m, "quic", l.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ID != m.ID || len(r.Answer) != 1 || !r.Answer[0].(*A).A.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("expected reply with ID %d and 1 answer, got:\n%s", m.ID, r)
+		}
+	}
+	if n := len(c.Transport.quic.conns); n != 1 {
+		t.Errorf("expected 1 QUIC connection, got %d", n)
+	}
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID()}}
+	m.Question = []RR{&A{Hdr: Header{Name: "example.org.", Class: ClassINET}}}
+	m.Pack()
+	if _, _, err := c.Exchange(ctx, m, "quic", l.LocalAddr().String()); !errors.Is(err, DoQInternalError) {
+		t.Errorf("expected %v, got %v", DoQInternalError, err)
+	}
+
+	if err := c.Transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Transport.quic.endpoint != nil || len(c.Transport.quic.conns) != 0 {
+		t.Errorf("expected the QUIC endpoint and connections to be gone after Close")
+	}
+	// A closed Transport creates a new endpoint.
+	m = &Msg{MsgHeader: MsgHeader{ID: ID()}}
+	m.Question = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+	m.Pack()
+	if _, _, err := c.Exchange(ctx, m, "quic", l.LocalAddr().String()); err != nil {
+		t.Errorf("expected reply after Close, got %v", err)
+	}
+	c.Transport.Close()
+}
@@ -3,6 +3,8 @@ package dns
 import (
 	"encoding/hex"
 	"fmt"
+	"strconv"
+	"time"
 
 	"golang.org/x/crypto/cryptobyte"
 )
@@ -94,11 +96,33 @@ func unpackOptionCode(option EDNS0, s *cryptobyte.String) error {
 		return x.unpack(s)
 	case *PADDING:
 		return x.unpack(s)
+	case *TCPKEEPALIVE:
+		return x.unpack(s)
+	case *COOKIE:
+		return x.unpack(s)
+	case *EDE:
+		return x.unpack(s)
 	}
 	// Coder() check, abuse Type()?
 	return fmt.Errorf("no option unpack defined")
 }
 
+func packOptionCode(option EDNS0, msg []byte, off int) (int, error) {
+	switch x := option.(type) {
+	case *NSID:
+		return x.pack(msg, off)
+	case *PADDING:
+		return x.pack(msg, off)
+	case *TCPKEEPALIVE:
+		return x.pack(msg, off)
+	case *COOKIE:
+		return x.pack(msg, off)
+	case *EDE:
+		return x.pack(msg, off)
+	}
+	return len(msg), fmt.Errorf("no option pack defined")
+}
+
 // NSID EDNS0 option is used to retrieve a nameserver identifier. When sending a request Nsid must be empty.
 // The identifier is an opaque string encoded as hex.
 type NSID struct {
@@ -123,6 +147,8 @@ func (o *NSID) unpack(s *cryptobyte.String) error {
 	return nil
 }
 
+func (o *NSID) pack(msg []byte, off int) (int, error) { return packStringHex(o.Nsid, msg, off) }
+
 // PADDING option is used to add padding to a request/response. The default value of padding SHOULD be 0x0 but
 // other values MAY be used.
 type PADDING struct {
@@ -130,6 +156,142 @@ type PADDING struct {
 	Padding string `dns:"octet"`
 }
 
-func (o *PADDING) Len() int                          { return 0 }
+func (o *PADDING) Len() int                          { return 4 + len(o.Padding) }
 func (o *PADDING) String() string                    { return "" }
-func (o *PADDING) unpack(s *cryptobyte.String) error { return nil }
+func (o *PADDING) unpack(s *cryptobyte.String) error { o.Padding = string(*s); return nil }
+
+func (o *PADDING) pack(msg []byte, off int) (int, error) {
+	if off+len(o.Padding) > len(msg) {
+		return len(msg), &Error{err: "overflow packing padding"}
+	}
+	return off + copy(msg[off:], o.Padding), nil
+}
+
+// TCPKEEPALIVE is an EDNS0 option that asks the server to keep the TCP connection open, see RFC 7828. In a
+// query the Timeout must be zero, the option is then sent without data. In a reply Timeout is the idle
+// timeout the server uses for the connection, in units of 100 milliseconds.
+type TCPKEEPALIVE struct {
+	Hdr     Header
+	Timeout uint16
+}
+
+func (o *TCPKEEPALIVE) Len() int {
+	if o.Timeout == 0 {
+		return 4
+	}
+	return 6
+}
+
+func (o *TCPKEEPALIVE) String() string {
+	sb := sprintOptionHeader(o)
+	sb.WriteString(strconv.FormatUint(uint64(o.Timeout)*100, 10))
+	sb.WriteString("ms")
+	return sb.String()
+}
+
+func (o *TCPKEEPALIVE) unpack(s *cryptobyte.String) error {
+	if s.Empty() {
+		o.Timeout = 0
+		return nil
+	}
+	if !s.ReadUint16(&o.Timeout) {
+		return ErrUnpackOverflow
+	}
+	return nil
+}
+
+func (o *TCPKEEPALIVE) pack(msg []byte, off int) (int, error) {
+	if o.Timeout == 0 {
+		return off, nil
+	}
+	return packUint16(o.Timeout, msg, off)
+}
+
+// timeout returns the idle timeout as a duration.
+func (o *TCPKEEPALIVE) timeout() time.Duration {
+	return time.Duration(o.Timeout) * 100 * time.Millisecond
+}
+
+// COOKIE EDNS0 option is used to carry DNS cookies, see RFC 7873. Cookie holds the client cookie (8 bytes)
+// followed by the server cookie (8 to 32 bytes) if there is one, encoded as hex. See [CookieJar] and
+// [CookieServer] for the client and server side handling of cookies.
+type COOKIE struct {
+	Hdr    Header
+	Cookie string `dns:"hex"`
+}
+
+func (o *COOKIE) Len() int { return 4 + len(o.Cookie)/2 }
+
+func (o *COOKIE) String() string {
+	sb := sprintOptionHeader(o)
+	sb.WriteString(o.Cookie)
+	return sb.String()
+}
+
+func (o *COOKIE) unpack(s *cryptobyte.String) error {
+	if l := len(*s); l != 8 && (l < 16 || l > 40) {
+		return &Error{err: "bad cookie length"}
+	}
+	o.Cookie = hex.EncodeToString(*s)
+	return nil
+}
+
+func (o *COOKIE) pack(msg []byte, off int) (int, error) { return packStringHex(o.Cookie, msg, off) }
+
+// Client returns the client cookie part of the cookie, encoded as hex.
+func (o *COOKIE) Client() string {
+	if len(o.Cookie) < 16 {
+		return o.Cookie
+	}
+	return o.Cookie[:16]
+}
+
+// Server returns the server cookie part of the cookie, encoded as hex. If there is none, the empty string is
+// returned.
+func (o *COOKIE) Server() string {
+	if len(o.Cookie) < 16 {
+		return ""
+	}
+	return o.Cookie[16:]
+}
+
+// EDE EDNS0 option is used to return extended error information, see RFC 8914. InfoCode is one of the
+// ExtendedErrorXXX constants and ExtraText is an optional human readable text.
+type EDE struct {
+	Hdr       Header
+	InfoCode  uint16
+	ExtraText string
+}
+
+func (o *EDE) Len() int { return 6 + len(o.ExtraText) }
+
+func (o *EDE) String() string {
+	sb := sprintOptionHeader(o)
+	sb.WriteString(strconv.FormatUint(uint64(o.InfoCode), 10))
+	if s, ok := ExtendedErrorToString[o.InfoCode]; ok {
+		sb.WriteString(" (")
+		sb.WriteString(s)
+		sb.WriteByte(')')
+	}
+	if o.ExtraText != "" {
+		sb.WriteString(": ")
+		sb.WriteString(strconv.Quote(o.ExtraText))
+	}
+	return sb.String()
+}
+
+func (o *EDE) unpack(s *cryptobyte.String) error {
+	if !s.ReadUint16(&o.InfoCode) {
+		return ErrUnpackOverflow
+	}
+	o.ExtraText = string(*s)
+	return nil
+}
+
+func (o *EDE) pack(msg []byte, off int) (int, error) {
+	off, err := packUint16(o.InfoCode, msg, off)
+	if err != nil {
+		return len(msg), err
+	}
+	return packStringAny(o.ExtraText, msg, off)
+}
@@ -10,12 +10,17 @@ func (e *Error) Error() string { return "dns: " + e.err }
 var (
 	ErrAlg              = &Error{err: "bad algorithm"}          // ErrAlg indicates an error with the (DNSSEC) algorithm.
 	ErrAuth             = &Error{err: "bad authentication"}     // ErrAuth indicates an error in the TSIG authentication.
+	ErrBadKey           = &Error{err: "bad TSIG key"}           // ErrBadKey indicates the TSIG key is not known to the other side.
 	ErrBuf              = &Error{err: "buffer size too small"}  // ErrBuf indicates that the buffer used is too small for the message.
+	ErrCookie           = &Error{err: "bad cookie"}             // ErrCookie indicates a malformed cookie or a cookie that is not ours.
 	ErrConnEmpty        = &Error{err: "conn has no connection"} // ErrConnEmpty indicates a connection is being used before it is initialized.
 	ErrExtendedRcode    = &Error{err: "bad extended rcode"}
 	ErrFqdn             = &Error{err: "domain must be fully qualified"} // ErrFqdn indicates that a domain name does not have a closing dot.
+	ErrNoData           = &Error{err: "no data"}                        // ErrNoData indicates a name exists, but has no records of the requested type.
+	ErrNXDomain         = &Error{err: "no such name"}                   // ErrNXDomain indicates a name does not exist.
 	ErrName             = &Error{err: "bad domain name"}
 	ErrLabel            = &Error{err: "bad label type"}
+	ErrHandlerTimeout   = &Error{err: "handler timeout"}   // ErrHandlerTimeout is returned by writes of a handler that ran past its Timeout.
 	ErrId               = &Error{err: "id mismatch"}       // ErrId indicates there is a mismatch with the message's ID.
 	ErrKeyAlg           = &Error{err: "bad key algorithm"} // ErrKeyAlg indicates that the algorithm in the key is not valid.
 	ErrKey              = &Error{err: "bad key"}
@@ -23,12 +28,14 @@ var (
 	ErrLongDomain       = &Error{err: fmt.Sprintf("domain name exceeded %d wire-format octets", maxDomainNameWireOctets)}
 	ErrNoSig            = &Error{err: "no signature found"}
 	ErrPrivKey          = &Error{err: "bad private key"}
+	ErrQuestion         = &Error{err: "question mismatch"} // ErrQuestion indicates the question in a reply is not the question asked.
 	ErrRcode            = &Error{err: "bad rcode"}
 	ErrRRset            = &Error{err: "bad rrset"}
 	ErrSecret           = &Error{err: "no secrets defined"}
 	ErrShortRead        = &Error{err: "short read"}
-	ErrSig              = &Error{err: "bad signature"} // ErrSig indicates that a signature can not be cryptographically validated.
-	ErrSoa              = &Error{err: "no SOA"}        // ErrSOA indicates that no SOA RR was seen when doing zone transfers.
+	ErrSig              = &Error{err: "bad signature"}                // ErrSig indicates that a signature can not be cryptographically validated.
+	ErrSource           = &Error{err: "reply from unexpected source"} // ErrSource indicates a reply was received from another address than the query was sent to.
+	ErrSoa              = &Error{err: "no SOA"}                       // ErrSOA indicates that no SOA RR was seen when doing zone transfers.
 	ErrOpt              = &Error{err: "unknown OPT code"}
 	ErrTime             = &Error{err: "bad time"} // ErrTime indicates a timing error in TSIG authentication.
 	ErrTruncatedMessage = &Error{err: "overflow unpacking truncated message"}
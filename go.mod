@@ -3,9 +3,9 @@ module github.com/miekg/dnsv2
 go 1.24
 
 require (
-	golang.org/x/crypto v0.14.0
-	golang.org/x/net v0.17.0
-	golang.org/x/sys v0.13.0
+	golang.org/x/crypto v0.41.0
+	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.35.0
 	golang.org/x/tools v0.13.0
 )
 
@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// Handler is implemented by any value that implements ServeDNS. The context given to ServeDNS is done when
+// the reply can no longer be written in time, and it carries the [ConnInfo] of the connection the request
+// was received on.
+type Handler interface {
+	ServeDNS(ctx context.Context, w ResponseWriter, r *Msg)
+}
+
+// The HandlerFunc type is an adapter to allow the use of
+// ordinary functions as DNS handlers.  If f is a function
+// with the appropriate signature, HandlerFunc(f) is a
+// Handler object that calls f.
+type HandlerFunc func(context.Context, ResponseWriter, *Msg)
+
+// ServeDNS calls f(ctx, w, r).
+func (f HandlerFunc) ServeDNS(ctx context.Context, w ResponseWriter, r *Msg) {
+	f(ctx, w, r)
+}
+
+// ConnInfo describes the connection a request was received on.
+type ConnInfo struct {
+	// Network is the network the request was received on: "udp", "tcp", "tcp-tls", "https" or "quic".
+	Network string
+	// LocalAddr is the address the request was received on.
+	LocalAddr net.Addr
+	// RemoteAddr is the address of the client that sent the request.
+	RemoteAddr net.Addr
+	// TLS holds the state of the TLS connection, it is nil when the request was not received over TLS.
+	TLS *tls.ConnectionState
+	// Proxy holds the PROXY protocol header the connection or datagram started with, it is nil when there was
+	// none. See Server.ProxyTrusted.
+	Proxy *ProxyHeader
+}
+
+type connInfoKey struct{}
+
+// NewConnInfoContext returns a new context based on ctx that carries info.
+func NewConnInfoContext(ctx context.Context, info *ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// ContextConnInfo returns the ConnInfo associated with ctx. If none, it returns nil.
+func ContextConnInfo(ctx context.Context) *ConnInfo {
+	info, _ := ctx.Value(connInfoKey{}).(*ConnInfo)
+	return info
+}
+
+// A ResponseWriter interface is used by an DNS handler to
+// construct an DNS response.
+type ResponseWriter interface {
+	// LocalAddr returns the net.Addr of the server
+	LocalAddr() net.Addr
+	// RemoteAddr returns the net.Addr of the client that sent the current request.
+	RemoteAddr() net.Addr
+	// WriteMsg writes a reply back to the client.
+	WriteMsg(*Msg) error
+	// Write writes a raw buffer back to the client.
+	Write([]byte) (int, error)
+	// Close closes the connection.
+	Close() error
+	// TsigStatus returns the status of the Tsig.
+	TsigStatus() error
+	// TsigTimersOnly sets the tsig timers only boolean.
+	TsigTimersOnly(bool)
+	// Hijack lets the caller take over the connection.
+	// After a call to Hijack(), the DNS package will not do anything with the connection.
+	Hijack()
+}
+
+// A ConnectionStater interface is used by a DNS Handler to access TLS connection state
+// when available.
+type ConnectionStater interface {
+	ConnectionState() *tls.ConnectionState
+}
+
+// handleRefused returns a HandlerFunc that returns REFUSED for every request it gets.
+func handleRefused(_ context.Context, w ResponseWriter, r *Msg) {
+	m := new(Msg)
+	m.SetRcode(r, RcodeRefused)
+	w.WriteMsg(m)
+}
@@ -0,0 +1,261 @@
+package dns
+
+// Handler middleware, modelled after the usual net/http middleware.
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a Handler to add behaviour before or after it is called. Middleware is attached to a
+// [Server] with its Middleware field, and to a pattern of a [ServeMux] with [ServeMux.Handle]:
+//
+//	mux.Handle("example.org.", h, dns.Recover, dns.Timeout(time.Second))
+type Middleware func(Handler) Handler
+
+// Chain returns h wrapped in middleware. The first middleware is the outermost one: it sees the request first
+// and the reply last.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Recover is middleware that recovers from a panic in the handler. The panic is logged and, when no reply has
+// been written yet, the client gets a SERVFAIL reply with the extended error (RFC 8914) Other.
+func Recover(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Msg) {
+		rw := &recorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("dns: panic serving %s: %v\n%s", w.RemoteAddr(), p, buf)
+			if !rw.written {
+				w.WriteMsg(serverFailure(r))
+			}
+		}()
+		next.ServeDNS(ctx, rw, r)
+	})
+}
+
+// Timeout returns middleware that gives the handler d to write its reply, the context of the handler is done
+// after d. When the handler has not written a reply by then, the client gets a SERVFAIL reply with the extended
+// error (RFC 8914) Other, and later writes of the handler return [ErrHandlerTimeout].
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Msg) {
+			// The handler's context is only cancelled after the SERVFAIL is written, so that a handler that
+			// writes as soon as its context is done can't get its reply in first.
+			hctx, cancel := context.WithCancelCause(ctx)
+			defer cancel(nil)
+
+			tw := &timeoutWriter{ResponseWriter: w}
+			timedOut := make(chan struct{})
+			timer := time.AfterFunc(d, func() {
+				tw.mu.Lock()
+				if !tw.written {
+					w.WriteMsg(serverFailure(r))
+				}
+				tw.timedOut = true
+				tw.mu.Unlock()
+				cancel(context.DeadlineExceeded)
+				close(timedOut)
+			})
+
+			done := make(chan struct{})
+			panicked := make(chan any, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+				}()
+				next.ServeDNS(&timeoutContext{Context: hctx, deadline: time.Now().Add(d)}, tw, r)
+				close(done)
+			}()
+
+			select {
+			case p := <-panicked:
+				if !timer.Stop() {
+					<-timedOut
+				}
+				panic(p)
+			case <-done:
+				if !timer.Stop() {
+					<-timedOut
+				}
+			case <-timedOut:
+			}
+		})
+	}
+}
+
+// Observation describes a request that has been handled, see [Metrics].
+type Observation struct {
+	Network  string        // Network the request was received on, empty when unknown.
+	Request  *Msg          // The request.
+	Replied  bool          // Replied is true when the handler has written a reply.
+	Rcode    uint16        // Rcode of the reply.
+	Size     int           // Size of the reply in octets.
+	Duration time.Duration // Time it took the handler to return.
+}
+
+// Metrics returns middleware that calls observe for each request after the handler has returned.
+func Metrics(observe func(context.Context, Observation)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Msg) {
+			rw := &recorder{ResponseWriter: w}
+			start := time.Now()
+			next.ServeDNS(ctx, rw, r)
+
+			o := Observation{Request: r, Replied: rw.written, Rcode: rw.rcode, Size: rw.size, Duration: time.Since(start)}
+			if info := ContextConnInfo(ctx); info != nil {
+				o.Network = info.Network
+			}
+			observe(ctx, o)
+		})
+	}
+}
+
+// Logger returns middleware that logs each request to l after the handler has returned, with the client's
+// address, the question, the rcode of the reply and the time the handler took.
+func Logger(l *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return Metrics(func(ctx context.Context, o Observation) {
+			attrs := []slog.Attr{slog.String("network", o.Network)}
+			if info := ContextConnInfo(ctx); info != nil && info.RemoteAddr != nil {
+				attrs = append(attrs, slog.String("remote", info.RemoteAddr.String()))
+			}
+			if len(o.Request.Question) > 0 {
+				q := o.Request.Question[0]
+				attrs = append(attrs, slog.String("name", q.Header().Name), slog.String("type", sprintType(RRToType(q))))
+			}
+			if o.Replied {
+				attrs = append(attrs, slog.String("rcode", RcodeToString[o.Rcode]), slog.Int("size", o.Size))
+			}
+			attrs = append(attrs, slog.Duration("duration", o.Duration))
+			l.LogAttrs(ctx, slog.LevelInfo, "dns request", attrs...)
+		})(next)
+	}
+}
+
+// serverFailure returns the SERVFAIL reply for r, with the extended error Other when r has EDNS.
+func serverFailure(r *Msg) *Msg {
+	m := new(Msg).SetRcode(r, RcodeServerFailure)
+	if r.UDPSize != 0 {
+		m.UDPSize = r.UDPSize
+		m.Pseudo = []RR{&EDE{InfoCode: ExtendedErrorOther}}
+	}
+	return m
+}
+
+// recorder is a ResponseWriter that records the reply written through it.
+type recorder struct {
+	ResponseWriter
+	written bool
+	rcode   uint16
+	size    int
+}
+
+func (w *recorder) WriteMsg(m *Msg) error {
+	err := w.ResponseWriter.WriteMsg(m)
+	if err == nil {
+		w.written, w.rcode, w.size = true, m.Rcode, len(m.Data)
+	}
+	return err
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if err == nil && len(b) >= 4 {
+		w.written, w.rcode, w.size = true, uint16(b[3]&0xF), len(b)
+	}
+	return n, err
+}
+
+// timeoutWriter is the ResponseWriter of a handler that runs with a Timeout, it discards writes after the
+// timeout.
+type timeoutWriter struct {
+	ResponseWriter
+	mu       sync.Mutex
+	written  bool
+	timedOut bool
+}
+
+func (w *timeoutWriter) WriteMsg(m *Msg) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return ErrHandlerTimeout
+	}
+	w.written = true
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, ErrHandlerTimeout
+	}
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timeoutWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return ErrHandlerTimeout
+	}
+	return w.ResponseWriter.Close()
+}
+
+// Hijack and TsigTimersOnly do nothing after the timeout, the server may be using the ResponseWriter for the
+// next request on the connection by then.
+func (w *timeoutWriter) Hijack() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.timedOut {
+		w.ResponseWriter.Hijack()
+	}
+}
+
+func (w *timeoutWriter) TsigTimersOnly(b bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.timedOut {
+		w.ResponseWriter.TsigTimersOnly(b)
+	}
+}
+
+// timeoutContext is the context of a handler that runs with a Timeout. It is cancelled by Timeout itself, and
+// reports the timeout as its deadline.
+type timeoutContext struct {
+	context.Context
+	deadline time.Time
+}
+
+func (c *timeoutContext) Deadline() (time.Time, bool) {
+	if d, ok := c.Context.Deadline(); ok && d.Before(c.deadline) {
+		return d, true
+	}
+	return c.deadline, true
+}
+
+func (c *timeoutContext) Err() error {
+	err := c.Context.Err()
+	if err != nil && context.Cause(c.Context) == context.DeadlineExceeded {
+		return context.DeadlineExceeded
+	}
+	return err
+}
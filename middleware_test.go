@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	timedOut := make(chan error, 1)
+	mux := NewServeMux()
+	mux.HandleFunc("example.org.", func(ctx context.Context, w ResponseWriter, req *Msg) {
+		w.WriteMsg(new(Msg).SetReply(req))
+	})
+	mux.HandleFunc("panic.example.org.", func(ctx context.Context, w ResponseWriter, req *Msg) {
+		panic("boom")
+	})
+	mux.HandleFunc("slow.example.org.", func(ctx context.Context, w ResponseWriter, req *Msg) {
+		<-ctx.Done()
+		timedOut <- w.WriteMsg(new(Msg).SetReply(req))
+	}, Timeout(50*time.Millisecond))
+
+	observations := make(chan Observation, 10)
+	// Logger is inside Metrics, so what is logged can be read after an observation is received.
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(buf, nil))
+	addr := runServer(t, func() *Server {
+		return &Server{Handler: mux, Middleware: []Middleware{
+			Metrics(func(_ context.Context, o Observation) { observations <- o }),
+			Logger(logger),
+			Recover,
+		}}
+	})
+
+	c := new(Client)
+	exchange := func(name string) *Msg {
+		t.Helper()
+		m := &Msg{MsgHeader: MsgHeader{ID: ID(), UDPSize: 1232}, Question: []RR{&A{Hdr: Header{Name: name, Class: ClassINET}}}}
+		if err := m.Pack(); err != nil {
+			t.Fatal(err)
+		}
+		r, _, err := c.Exchange(context.Background(), m, "udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	if r := exchange("example.org."); r.Rcode != RcodeSuccess {
+		t.Errorf("expected rcode %s, got %s", RcodeToString[RcodeSuccess], RcodeToString[r.Rcode])
+	}
+	if o := <-observations; o.Network != "udp" || !o.Replied || o.Rcode != RcodeSuccess || o.Size == 0 {
+		t.Errorf("expected observation of a NOERROR reply over udp, got %+v", o)
+	}
+
+	for _, name := range []string{"panic.example.org.", "slow.example.org."} {
+		r := exchange(name)
+		if r.Rcode != RcodeServerFailure {
+			t.Errorf("expected rcode %s for %s, got %s", RcodeToString[RcodeServerFailure], name, RcodeToString[r.Rcode])
+		}
+		if len(r.Pseudo) != 1 || r.Pseudo[0].(*EDE).InfoCode != ExtendedErrorOther {
+			t.Errorf("expected EDE Other for %s, got %v", name, r.Pseudo)
+		}
+		if o := <-observations; o.Rcode != RcodeServerFailure {
+			t.Errorf("expected observation of a SERVFAIL reply for %s, got %+v", name, o)
+		}
+	}
+	if err := <-timedOut; err != ErrHandlerTimeout {
+		t.Errorf("expected %v for a write after the timeout, got %v", ErrHandlerTimeout, err)
+	}
+
+	if !strings.Contains(buf.String(), "name=panic.example.org. type=A rcode=SERVFAIL") {
+		t.Errorf("expected SERVFAIL to be logged, got %s", buf.String())
+	}
+}
+
+// hijackWriter is a ResponseWriter that records calls to Hijack and TsigTimersOnly.
+type hijackWriter struct {
+	ResponseWriter
+	calls []string
+}
+
+func (w *hijackWriter) WriteMsg(m *Msg) error { return m.Pack() }
+func (w *hijackWriter) Hijack()               { w.calls = append(w.calls, "Hijack") }
+func (w *hijackWriter) TsigTimersOnly(bool)   { w.calls = append(w.calls, "TsigTimersOnly") }
+
+func TestTimeoutHijack(t *testing.T) {
+	done := make(chan struct{})
+	h := Timeout(10 * time.Millisecond)(HandlerFunc(func(ctx context.Context, w ResponseWriter, req *Msg) {
+		<-ctx.Done()
+		w.Hijack()
+		w.TsigTimersOnly(true)
+		close(done)
+	}))
+	w := &hijackWriter{}
+	h.ServeDNS(context.Background(), w, &Msg{MsgHeader: MsgHeader{ID: ID()}, Question: []RR{&A{Hdr: Header{Name: "example.org.", Class: ClassINET}}}})
+	<-done
+	if len(w.calls) != 0 {
+		t.Errorf("expected no calls after the timeout, got %v", w.calls)
+	}
+}
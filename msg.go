@@ -499,10 +499,19 @@ func (m *Msg) pack(compression map[string]uint16) (err error) {
 		dh.Bits |= _CD
 	}
 
+	opt := m.opt()
 	dh.Qdcount = uint16(len(m.Question))
 	dh.Ancount = uint16(len(m.Answer))
 	dh.Nscount = uint16(len(m.Ns))
 	dh.Arcount = uint16(len(m.Extra))
+	if opt != nil {
+		dh.Arcount++
+	}
+	for _, r := range m.Pseudo {
+		if _, ok := r.(EDNS0); !ok {
+			dh.Arcount++
+		}
+	}
 
 	// We need the uncompressed length here, because we first pack it and then compress it.
 	uncompressedLen := m.Len()
@@ -541,8 +550,16 @@ func (m *Msg) pack(compression map[string]uint16) (err error) {
 			return err
 		}
 	}
+	if opt != nil {
+		_, off, err = packRR(opt, m.Data, off, compression)
+		if err != nil {
+			return err
+		}
+	}
 	for _, r := range m.Pseudo {
-		// not tsig and sig0 - added OPT RR and unpack things in there.
+		if _, ok := r.(EDNS0); ok {
+			continue // in the OPT RR
+		}
 		_, off, err = packRR(r, m.Data, off, compression)
 		if err != nil {
 			return err
@@ -552,6 +569,26 @@ func (m *Msg) pack(compression map[string]uint16) (err error) {
 	return nil
 }
 
+// opt returns the OPT RR that carries the EDNS0 settings of m, the upper bits of an extended rcode and the EDNS0
+// options from the pseudo section. If m does not use EDNS0, nil is returned.
+func (m *Msg) opt() *OPT {
+	var options []EDNS0
+	for _, r := range m.Pseudo {
+		if o, ok := r.(EDNS0); ok {
+			options = append(options, o)
+		}
+	}
+	if m.UDPSize == 0 && !m.Security && !m.CompatAnswers && m.Version == 0 && len(options) == 0 && m.Rcode <= 0xF {
+		return nil
+	}
+	opt := &OPT{Hdr: Header{Name: ".", TTL: uint32(m.Rcode>>4) << 24}, Options: options}
+	opt.SetUDPSize(max(m.UDPSize, MinMsgSize))
+	opt.SetVersion(m.Version)
+	opt.SetSecurity(m.Security)
+	opt.SetCompactAnswers(m.CompatAnswers)
+	return opt
+}
+
 // We only allow a single question in the question section.
 func unpackQuestion(msg *cryptobyte.String, msgBuf []byte) (RR, error) {
 	// TODO(tmthrgd): Stop accepting partial questions. These are here
@@ -643,30 +680,35 @@ func (m *Msg) unpack(dh header, msg, msgBuf []byte) error {
 	// Check for the OPT RR and remove it entirely, unpack the OPT for option code and put those in the Pseudo
 	// section. Any TSIG and SIG0 records will also be put in the pseudo section, but after the options.
 
-	j := 0
-	for i := 0; i < len(m.Extra)-j; i++ {
-		rr := m.Extra[i]
-		if opt, ok := rr.(*OPT); ok {
-			// move to end, so it can be removed latter and unpack the opt for the settings.
-			m.Security = opt.Security()
-			m.CompatAnswers = opt.CompactAnswers()
-			// m.Rcode == something someting, TODO
-			m.Version = opt.Version()
-			m.UDPSize = opt.UDPSize()
-
-			m.Pseudo = make([]RR, len(opt.Options))
-			for i, o := range opt.Options {
-				m.Pseudo[i] = RR(o)
+	m.Pseudo = nil
+	m.ps = 0
+	var tsig RR
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		switch x := rr.(type) {
+		case *OPT:
+			// Unpack the OPT for the settings, the options go into the pseudo section.
+			m.Security = x.Security()
+			m.CompatAnswers = x.CompactAnswers()
+			m.Rcode |= uint16(x.Hdr.TTL>>24) << 4
+			m.Version = x.Version()
+			m.UDPSize = x.UDPSize()
+
+			for _, o := range x.Options {
+				m.Pseudo = append(m.Pseudo, RR(o))
 			}
-
-			m.Extra[len(m.Extra)-j-1] = rr
-			j++
+			m.ps++
+		case *TSIG:
+			tsig = x
+			m.ps++
+		default:
+			extra = append(extra, rr)
 		}
 	}
-	// remove the option
-	m.Extra = m.Extra[:len(m.Extra)-j]
-
-	m.ps = 0 // unless TSIG, SIG(0)
+	m.Extra = extra
+	if tsig != nil {
+		m.Pseudo = append(m.Pseudo, tsig)
+	}
 
 	if !s.Empty() {
 		return &Error{err: "trailing message data"}
@@ -819,6 +861,17 @@ func (m *Msg) Len() int {
 			l += r.Len()
 		}
 	}
+	if opt := m.opt(); opt != nil {
+		l += 11 // root name, type, class, ttl and rdlength
+		for _, o := range opt.Options {
+			l += o.Len()
+		}
+	}
+	for _, r := range m.Pseudo {
+		if _, ok := r.(EDNS0); !ok {
+			l += r.Len()
+		}
+	}
 
 	return l
 }
@@ -106,8 +106,8 @@ func (h Header) packHeader(msg []byte, off int, rrtype uint16, compress map[stri
 		return len(msg), err
 	}
 
-	class := uint16(0)
-	if h.Class == 0 {
+	class := h.Class
+	if class == 0 {
 		class = ClassINET
 	}
 	off, err = packUint16(class, msg, off)
@@ -363,7 +363,24 @@ func unpackOpt(s *cryptobyte.String) ([]EDNS0, error) {
 }
 
 func packOpt(options []EDNS0, msg []byte, off int) (int, error) {
-	return 0, nil
+	var err error
+	for _, option := range options {
+		off, err = packUint16(RRToCode(option), msg, off)
+		if err != nil {
+			return len(msg), err
+		}
+		// The option length is set after the option data is packed.
+		start, err := packUint16(0, msg, off)
+		if err != nil {
+			return len(msg), err
+		}
+		off, err = packOptionCode(option, msg, start)
+		if err != nil {
+			return len(msg), err
+		}
+		binary.BigEndian.PutUint16(msg[start-2:], uint16(off-start))
+	}
+	return off, nil
 }
 
 func unpackStringOctet(s *cryptobyte.String) (string, error) {
@@ -60,3 +60,35 @@ func TestUnpackName(t *testing.T) {
 		})
 	}
 }
+
+func TestPackEDNS0(t *testing.T) {
+	msg := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true, UDPSize: 1232, Security: true}}
+	msg.Question = []RR{&MX{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+	msg.Pseudo = []RR{&NSID{Nsid: "6d69656b"}, &PADDING{Padding: "\x00\x00"}, &TCPKEEPALIVE{Timeout: 100}, &EDE{InfoCode: ExtendedErrorStaleAnswer, ExtraText: "stale"}}
+	if err := msg.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Data) != 67 {
+		t.Errorf("expected packed length %d, got %d", 67, len(msg.Data))
+	}
+
+	m := &Msg{Data: msg.Data}
+	if err := m.Unpack(); err != nil {
+		t.Fatal(err)
+	}
+	if m.UDPSize != 1232 || !m.Security || len(m.Extra) != 0 || len(m.Pseudo) != 4 {
+		t.Fatalf("expected EDNS0 message with 4 options, got:\n%s", m)
+	}
+	if nsid := m.Pseudo[0].(*NSID); nsid.Nsid != "6d69656b" {
+		t.Errorf("expected NSID %q, got %q", "6d69656b", nsid.Nsid)
+	}
+	if padding := m.Pseudo[1].(*PADDING); padding.Padding != "\x00\x00" {
+		t.Errorf("expected padding %q, got %q", "\x00\x00", padding.Padding)
+	}
+	if ka := m.Pseudo[2].(*TCPKEEPALIVE); ka.Timeout != 100 {
+		t.Errorf("expected keepalive timeout %d, got %d", 100, ka.Timeout)
+	}
+	if ede := m.Pseudo[3].(*EDE); ede.InfoCode != ExtendedErrorStaleAnswer || ede.ExtraText != "stale" {
+		t.Errorf("expected extended error %d %q, got %d %q", ExtendedErrorStaleAnswer, "stale", ede.InfoCode, ede.ExtraText)
+	}
+}
@@ -1,11 +1,11 @@
-//go:build ignore
-
 package dns
 
 import (
 	"crypto/sha1"
 	"encoding/hex"
 	"strings"
+
+	"github.com/miekg/dnsv2/dnsutil"
 )
 
 // HashName hashes a string (label) according to RFC 5155. It returns the hashed string in uppercase.
@@ -14,15 +14,13 @@ func HashName(label string, ha uint8, iter uint16, salt string) string {
 		return ""
 	}
 
-	wireSalt := make([]byte, hex.DecodedLen(len(salt)))
-	n, err := packStringHex(salt, wireSalt, 0)
+	wireSalt, err := hex.DecodeString(salt)
 	if err != nil {
 		return ""
 	}
-	wireSalt = wireSalt[:n]
 
 	name := make([]byte, 255)
-	off, err := PackDomainName(strings.ToLower(label), name, 0, nil, false)
+	off, err := packDomainName(dnsutil.Canonical(label), name, 0, nil, false)
 	if err != nil {
 		return ""
 	}
@@ -49,17 +47,17 @@ func HashName(label string, ha uint8, iter uint16, salt string) string {
 func (rr *NSEC3) Cover(name string) bool {
 	nameHash := HashName(name, rr.Hash, rr.Iterations, rr.Salt)
 	owner := strings.ToUpper(rr.Hdr.Name)
-	labelIndices := Split(owner)
+	labelIndices := dnsutil.Split(owner)
 	if len(labelIndices) < 2 {
 		return false
 	}
 	ownerHash := owner[:labelIndices[1]-1]
 	ownerZone := owner[labelIndices[1]:]
-	if !IsSubDomain(ownerZone, strings.ToUpper(name)) { // name is outside owner zone
+	if !dnsutil.IsSubDomain(ownerZone, name) { // name is outside owner zone
 		return false
 	}
 
-	nextHash := rr.NextDomain
+	nextHash := strings.ToUpper(rr.NextDomain)
 
 	// if empty interval found, try cover wildcard hashes so nameHash shouldn't match with ownerHash
 	if ownerHash == nextHash && nameHash != ownerHash { // empty interval
@@ -81,13 +79,13 @@ func (rr *NSEC3) Cover(name string) bool {
 func (rr *NSEC3) Match(name string) bool {
 	nameHash := HashName(name, rr.Hash, rr.Iterations, rr.Salt)
 	owner := strings.ToUpper(rr.Hdr.Name)
-	labelIndices := Split(owner)
+	labelIndices := dnsutil.Split(owner)
 	if len(labelIndices) < 2 {
 		return false
 	}
 	ownerHash := owner[:labelIndices[1]-1]
 	ownerZone := owner[labelIndices[1]:]
-	if !IsSubDomain(ownerZone, strings.ToUpper(name)) { // name is outside owner zone
+	if !dnsutil.IsSubDomain(ownerZone, name) { // name is outside owner zone
 		return false
 	}
 	if ownerHash == nameHash {
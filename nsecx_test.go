@@ -0,0 +1,33 @@
+package dns
+
+import "testing"
+
+func TestHashName(t *testing.T) {
+	// RFC 5155 appendix A.
+	if x := HashName("example.", SHA1, 12, "aabbccdd"); x != "0P9MHAVEQVM6T7VBL5LOP2U3T2RP3TOM" {
+		t.Errorf("expected hash %s, got %s", "0P9MHAVEQVM6T7VBL5LOP2U3T2RP3TOM", x)
+	}
+	if x := HashName("a.example.", SHA1, 12, "aabbccdd"); x != "35MTHGPGCU1QG68FAB165KLNSNK3DPVL" {
+		t.Errorf("expected hash %s, got %s", "35MTHGPGCU1QG68FAB165KLNSNK3DPVL", x)
+	}
+}
+
+func TestNSEC3Cover(t *testing.T) {
+	// RFC 5155 appendix A.
+	rr, err := New("b4um86eghhds6nea196smvmlo4ors995.example. 3600 IN NSEC3 1 1 12 aabbccdd gjeqe526plbf1g8mklp59enfd789njgi MX RRSIG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nsec3 := rr.(*NSEC3)
+	if !nsec3.Cover("x.example.") { // B76EQLMTQ7S6IULHLPOQGM1COPU2PCA6
+		t.Errorf("expected %s to be covered", "x.example.")
+	}
+	if nsec3.Cover("a.example.") || nsec3.Cover("x.example.org.") {
+		t.Errorf("expected names not to be covered")
+	}
+
+	rr, _ = New("0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example. 3600 IN NSEC3 1 1 12 aabbccdd 2t7b4g4vsa5smi47k61mv5bv1a22bojr NS SOA MX RRSIG DNSKEY NSEC3PARAM")
+	if nsec3 := rr.(*NSEC3); !nsec3.Match("example.") || nsec3.Match("a.example.") {
+		t.Errorf("expected only %s to match", "example.")
+	}
+}
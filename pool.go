@@ -0,0 +1,447 @@
+package dns
+
+// Connection reuse and query pipelining for TCP and DNS over TLS, RFC 7766 and RFC 7828.
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxIdleConnsPerHost is the default value of Transport's MaxIdleConnsPerHost.
+const DefaultMaxIdleConnsPerHost = 2
+
+// maxPipelined is the number of outstanding queries on a connection above which another connection to the
+// same address is dialed.
+const maxPipelined = 16
+
+// connPool holds the open stream connections of a Transport, keyed on network and address.
+type connPool struct {
+	mu    sync.Mutex
+	hosts map[string]*hostConns
+}
+
+type hostConns struct {
+	conns   []*pipeConn
+	dialing chan struct{} // non-nil while a connection is being dialed, closed when done
+}
+
+// pipeConn is a stream connection that can have multiple outstanding queries. Replies are matched to their
+// query by message ID, so they may arrive in any order.
+type pipeConn struct {
+	net.Conn
+	key string
+
+	wmu sync.Mutex // serializes writes
+
+	mu      sync.Mutex
+	pending map[uint16]*pending // outstanding queries, keyed on the ID used on the wire
+	err     error               // why the connection was closed
+
+	// Protected by the connPool's mutex.
+	inflight  int           // number of queries using this connection
+	closed    bool          // connection is closed and removed from the pool
+	keepalive time.Duration // idle timeout from the server's edns-tcp-keepalive option, -1 if not seen
+	idle      *time.Timer   // closes the connection when it has been idle for too long
+}
+
+// pending is an outstanding query on a pipeConn.
+type pending struct {
+	ch    chan *Msg     // the reply is sent on ch, it is closed when the connection is closed
+	first chan struct{} // closed when the reply starts to arrive
+}
+
+// isStream returns true if network is one of the TCP or DNS over TLS networks.
+func isStream(network string) bool {
+	return network == "tcp" || network == "tcp4" || network == "tcp6" || isTLS(network)
+}
+
+// exchangePipelined sends m over a pooled connection to address and waits for the reply. A query that fails
+// because a reused connection was closed by the server is retried once.
+func (t *Transport) exchangePipelined(ctx context.Context, m *Msg, network, address string) (*Msg, error) {
+	if len(m.Data) < 2 {
+		return nil, ErrShortRead
+	}
+	if m.tsig() == nil { // a signed query gets the option from the Client, before it is signed
+		var err error
+		if m, err = withKeepalive(m); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		pc, reused, err := t.getConn(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		ContextClientTrace(ctx).gotConn(pc.Conn, reused)
+		r, err := t.roundTripConn(ctx, pc, m)
+		t.putConn(pc)
+		if err != nil && reused && attempt == 0 && ctx.Err() == nil && pc.error() != nil {
+			continue
+		}
+		return r, err
+	}
+}
+
+// withKeepalive returns a copy of m with an empty edns-tcp-keepalive option, a server only sends its idle
+// timeout when the query has one (RFC 7828, section 3.3.2). The copy is packed. When m does not use EDNS0 or
+// already has the option, m itself is returned.
+func withKeepalive(m *Msg) (*Msg, error) {
+	if m.opt() == nil {
+		return m, nil
+	}
+	for _, rr := range m.Pseudo {
+		if _, ok := rr.(*TCPKEEPALIVE); ok {
+			return m, nil
+		}
+	}
+	return withOption(m, &TCPKEEPALIVE{})
+}
+
+// roundTripConn writes m to pc and waits for the reply. The reply has the ID of m, even when a different ID
+// was used on the wire to make it unique on the connection.
+func (t *Transport) roundTripConn(ctx context.Context, pc *pipeConn, m *Msg) (*Msg, error) {
+	trace := ContextClientTrace(ctx)
+	id, p, err := pc.register(m.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 2+len(m.Data))
+	binary.BigEndian.PutUint16(buf, uint16(len(m.Data)))
+	copy(buf[2:], m.Data)
+	binary.BigEndian.PutUint16(buf[2:], id)
+	n, err := t.write(ctx, pc, buf)
+	trace.wroteQuery(n, err)
+	if err != nil {
+		pc.unregister(id, p)
+		return nil, err
+	}
+
+	// The read loop signals when the reply starts to arrive, the hook is called from here so that it comes
+	// after WroteQuery.
+	first := p.first
+	for {
+		select {
+		case <-first:
+			trace.gotFirstResponseByte()
+			first = nil
+		case r, ok := <-p.ch:
+			if !ok {
+				return nil, pc.error()
+			}
+			if first != nil {
+				trace.gotFirstResponseByte()
+			}
+			binary.BigEndian.PutUint16(r.Data, m.ID)
+			if err := r.Unpack(); err != nil {
+				return r, err
+			}
+			if err := isReply(m, r); err != nil {
+				return nil, err
+			}
+			for _, rr := range r.Pseudo {
+				if ka, ok := rr.(*TCPKEEPALIVE); ok {
+					t.pool.mu.Lock()
+					pc.keepalive = ka.timeout()
+					t.pool.mu.Unlock()
+				}
+			}
+			return r, nil
+		case <-ctx.Done():
+			pc.unregister(id, p)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// getConn returns a connection to address. The open connection with the fewest outstanding queries is
+// reused, unless it has maxPipelined of them. Otherwise a new connection is dialed, while that happens other
+// queries for the same address use the busy connection, or wait for the dial if there is none.
+func (t *Transport) getConn(ctx context.Context, network, address string) (pc *pipeConn, reused bool, err error) {
+	key := network + "|" + address
+	p := &t.pool
+	for {
+		p.mu.Lock()
+		if p.hosts == nil {
+			p.hosts = map[string]*hostConns{}
+		}
+		h := p.hosts[key]
+		if h == nil {
+			h = &hostConns{}
+			p.hosts[key] = h
+		}
+		if pc := h.least(); pc != nil && (pc.inflight < maxPipelined || h.dialing != nil) {
+			pc.inflight++
+			if pc.idle != nil {
+				pc.idle.Stop()
+				pc.idle = nil
+			}
+			p.mu.Unlock()
+			return pc, true, nil
+		}
+		if dialing := h.dialing; dialing != nil {
+			p.mu.Unlock()
+			select {
+			case <-dialing:
+				continue
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+		}
+		dialing := make(chan struct{})
+		h.dialing = dialing
+		p.mu.Unlock()
+
+		conn, err := t.dial(ctx, network, address)
+
+		p.mu.Lock()
+		h.dialing = nil
+		close(dialing)
+		if err != nil {
+			p.mu.Unlock()
+			return nil, false, err
+		}
+		pc := &pipeConn{Conn: conn, key: key, pending: map[uint16]*pending{}, inflight: 1, keepalive: -1}
+		h.conns = append(h.conns, pc)
+		p.mu.Unlock()
+
+		go t.readLoop(pc)
+		return pc, false, nil
+	}
+}
+
+// putConn returns pc to the pool after a query is done with it. When pc becomes idle it is closed if there
+// are too many idle connections for its address, or if the server asked for that. Otherwise it is closed
+// after the idle timeout.
+func (t *Transport) putConn(pc *pipeConn) {
+	p := &t.pool
+	p.mu.Lock()
+	pc.inflight--
+	if pc.inflight > 0 || pc.closed {
+		p.mu.Unlock()
+		return
+	}
+
+	idle := 0
+	for _, c := range p.hosts[pc.key].conns {
+		if c.inflight == 0 {
+			idle++
+		}
+	}
+	timeout := t.IdleConnTimeout
+	if pc.keepalive >= 0 && (timeout == 0 || pc.keepalive < timeout) {
+		timeout = pc.keepalive
+	}
+	if idle > t.maxIdleConnsPerHost() || pc.keepalive == 0 {
+		p.mu.Unlock()
+		t.closeConn(pc, io.EOF)
+		return
+	}
+	if timeout > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(timeout, func() {
+			p.mu.Lock()
+			expired := pc.idle == timer
+			p.mu.Unlock()
+			if expired {
+				t.closeConn(pc, io.EOF)
+			}
+		})
+		pc.idle = timer
+	}
+	p.mu.Unlock()
+}
+
+// closeConn closes pc and removes it from the pool. Queries waiting for a reply on pc get err.
+func (t *Transport) closeConn(pc *pipeConn, err error) {
+	p := &t.pool
+	p.mu.Lock()
+	if pc.closed {
+		p.mu.Unlock()
+		return
+	}
+	pc.closed = true
+	if pc.idle != nil {
+		pc.idle.Stop()
+		pc.idle = nil
+	}
+	if h := p.hosts[pc.key]; h != nil {
+		for i, c := range h.conns {
+			if c == pc {
+				h.conns = append(h.conns[:i], h.conns[i+1:]...)
+				break
+			}
+		}
+		if len(h.conns) == 0 && h.dialing == nil {
+			delete(p.hosts, pc.key)
+		}
+	}
+	p.mu.Unlock()
+
+	pc.Conn.Close()
+
+	pc.mu.Lock()
+	pc.err = err
+	for _, p := range pc.pending {
+		close(p.ch)
+	}
+	pc.pending = nil
+	pc.mu.Unlock()
+}
+
+// CloseIdleConnections closes the TCP and DNS over TLS connections that have no outstanding queries.
+func (t *Transport) CloseIdleConnections() {
+	var idle []*pipeConn
+	t.pool.mu.Lock()
+	for _, h := range t.pool.hosts {
+		for _, pc := range h.conns {
+			if pc.inflight == 0 {
+				idle = append(idle, pc)
+			}
+		}
+	}
+	t.pool.mu.Unlock()
+
+	for _, pc := range idle {
+		t.closeConn(pc, io.EOF)
+	}
+}
+
+// Close closes the idle TCP and DNS over TLS connections, like CloseIdleConnections, and the QUIC endpoint
+// of t, which aborts all its DNS over QUIC connections, including those with outstanding queries. The
+// Transport can be used after Close, a new endpoint is created when needed.
+func (t *Transport) Close() error {
+	t.CloseIdleConnections()
+	return t.closeQUIC()
+}
+
+// readLoop reads the replies from pc and hands them to the waiting queries. Replies for unknown IDs are
+// dropped. On a read error the connection is closed. A query is signalled as soon as the ID of its reply is
+// read, before the rest of the reply, for the GotFirstResponseByte hook of its trace.
+func (t *Transport) readLoop(pc *pipeConn) {
+	for {
+		var length uint16
+		if err := binary.Read(pc.Conn, binary.BigEndian, &length); err != nil {
+			t.closeConn(pc, err)
+			return
+		}
+		data := make([]byte, length)
+		if length < 2 {
+			if _, err := io.ReadFull(pc.Conn, data); err != nil {
+				t.closeConn(pc, err)
+				return
+			}
+			continue
+		}
+		if _, err := io.ReadFull(pc.Conn, data[:2]); err != nil {
+			t.closeConn(pc, err)
+			return
+		}
+
+		// The query is taken out of pending now, so the ID can not be handed to a new query before the rest
+		// of its reply is read.
+		id := binary.BigEndian.Uint16(data)
+		pc.mu.Lock()
+		p := pc.pending[id]
+		delete(pc.pending, id)
+		pc.mu.Unlock()
+		if p != nil {
+			close(p.first)
+		}
+
+		if _, err := io.ReadFull(pc.Conn, data[2:]); err != nil {
+			t.closeConn(pc, err)
+			if p != nil {
+				close(p.ch)
+			}
+			return
+		}
+		if p != nil {
+			p.ch <- &Msg{Data: data}
+		}
+	}
+}
+
+// write writes buf to pc, honouring the deadline from ctx, and returns the number of bytes written. A failed
+// write closes the connection, as the stream can not be trusted anymore.
+func (t *Transport) write(ctx context.Context, pc *pipeConn, buf []byte) (int, error) {
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	pc.SetWriteDeadline(deadline)
+	n, err := pc.Write(buf)
+	if err != nil {
+		t.closeConn(pc, err)
+	}
+	return n, err
+}
+
+// dial dials a new connection to address.
+func (t *Transport) dial(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	trace := ContextClientTrace(ctx)
+	trace.dialStart(network, address)
+	if isTLS(network) {
+		conn, err = t.dialTLS(ctx, network, address)
+	} else {
+		conn, err = t.DialContext(ctx, network, address)
+	}
+	trace.dialDone(network, address, err)
+	return conn, err
+}
+
+func (t *Transport) maxIdleConnsPerHost() int {
+	if t.MaxIdleConnsPerHost > 0 {
+		return t.MaxIdleConnsPerHost
+	}
+	return DefaultMaxIdleConnsPerHost
+}
+
+// least returns the open connection with the fewest outstanding queries, or nil if there is none.
+func (h *hostConns) least() *pipeConn {
+	var least *pipeConn
+	for _, pc := range h.conns {
+		if least == nil || pc.inflight < least.inflight {
+			least = pc
+		}
+	}
+	return least
+}
+
+// register returns the ID to use on the wire for a query with ID id, and the registration the reply is send
+// on. When id is already in use on pc, a random unused one is returned.
+func (pc *pipeConn) register(id uint16) (uint16, *pending, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.pending == nil {
+		return 0, nil, pc.err
+	}
+	for pc.pending[id] != nil {
+		id = ID()
+	}
+	p := &pending{ch: make(chan *Msg, 1), first: make(chan struct{})}
+	pc.pending[id] = p
+	return id, p, nil
+}
+
+// unregister removes the registration p for id, unless the read loop already took it out or id was handed
+// out again.
+func (pc *pipeConn) unregister(id uint16, p *pending) {
+	pc.mu.Lock()
+	if pc.pending[id] == p {
+		delete(pc.pending, id)
+	}
+	pc.mu.Unlock()
+}
+
+// error returns the reason pc was closed, or nil if it is still open.
+func (pc *pipeConn) error() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err
+}
@@ -0,0 +1,254 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// servePipelined starts a TCP responder that reads n queries from a connection before it replies to them, in
+// reverse order. Each reply has a TXT record with the query name and the extra RRs in its pseudo section, an
+// edns-tcp-keepalive option only when the query has one. It returns the address and the number of accepted
+// connections.
+func servePipelined(t *testing.T, n int, extra ...RR) (string, *atomic.Int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					reqs := make([]*Msg, n)
+					for i := range reqs {
+						var length uint16
+						if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+							return
+						}
+						reqs[i] = &Msg{Data: make([]byte, length)}
+						if _, err := io.ReadFull(conn, reqs[i].Data); err != nil || reqs[i].Unpack() != nil {
+							return
+						}
+					}
+					for i := len(reqs) - 1; i >= 0; i-- {
+						r := &Msg{MsgHeader: MsgHeader{ID: reqs[i].ID, Response: true}, Question: reqs[i].Question}
+						name := reqs[i].Question[0].Header().Name
+						r.Answer = []RR{&TXT{Hdr: Header{Name: name, Class: ClassINET, TTL: 3600}, Txt: []string{name}}}
+						for _, rr := range extra {
+							if _, ok := rr.(*TCPKEEPALIVE); !ok || hasKeepalive(reqs[i]) {
+								r.Pseudo = append(r.Pseudo, rr)
+							}
+						}
+						r.Pack()
+						conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(r.Data))), r.Data...))
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), accepted
+}
+
+func hasKeepalive(m *Msg) bool {
+	for _, rr := range m.Pseudo {
+		if _, ok := rr.(*TCPKEEPALIVE); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClientPipelining(t *testing.T) {
+	addr, accepted := servePipelined(t, 2)
+	c := &Client{Transport: &Transport{DialContext: DefaultTransport.DialContext}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id := ID()
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.miek.nl.", "b.miek.nl."} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Both queries use the same ID, the transport must make them unique on the connection.
+			m := &Msg{MsgHeader: MsgHeader{ID: id, RecursionDesired: true}}
+			m.Question = []RR{&TXT{Hdr: Header{Name: name, Class: ClassINET}}}
+			m.Pack()
+
+			r, _, err := c.Exchange(ctx, m, "tcp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if r.ID != id || len(r.Answer) != 1 || r.Answer[0].(*TXT).Txt[0] != name {
+				t.Errorf("expected reply with ID %d for %s, got:\n%s", id, name, r)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("expected queries to be pipelined on 1 connection, got %d", n)
+	}
+	c.Transport.CloseIdleConnections()
+	if n := len(c.Transport.pool.hosts); n != 0 {
+		t.Errorf("expected no open connections, got %d", n)
+	}
+}
+
+func TestClientPipeliningBusy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The responder holds the replies until all queries are in, so they are outstanding at the same time.
+	const n = 2 * maxPipelined
+	type query struct {
+		conn net.Conn
+		req  *Msg
+	}
+	queries := make(chan query, n)
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				for {
+					var length uint16
+					if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+						return
+					}
+					req := &Msg{Data: make([]byte, length)}
+					if _, err := io.ReadFull(conn, req.Data); err != nil || req.Unpack() != nil {
+						return
+					}
+					queries <- query{conn, req}
+				}
+			}()
+		}
+	}()
+	go func() {
+		var held []query
+		for q := range queries {
+			if held = append(held, q); len(held) < n {
+				continue
+			}
+			for _, q := range held {
+				r := &Msg{MsgHeader: MsgHeader{ID: q.req.ID, Response: true}, Question: q.req.Question}
+				r.Pack()
+				q.conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(r.Data))), r.Data...))
+			}
+			held = nil
+		}
+	}()
+
+	c := &Client{Transport: &Transport{DialContext: DefaultTransport.DialContext, MaxIdleConnsPerHost: 1}}
+	defer c.Transport.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+			m.Question = []RR{&TXT{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+			m.Pack()
+			if _, _, err := c.Exchange(ctx, m, "tcp", l.Addr().String()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := accepted.Load(); n < 2 {
+		t.Errorf("expected busy connections to make the transport dial more, got %d connection", n)
+	}
+	c.Transport.pool.mu.Lock()
+	defer c.Transport.pool.mu.Unlock()
+	if n := len(c.Transport.pool.hosts["tcp|"+l.Addr().String()].conns); n != 1 {
+		t.Errorf("expected 1 idle connection to be kept, got %d", n)
+	}
+}
+
+func TestClientKeepalive(t *testing.T) {
+	addr, accepted := servePipelined(t, 1, &TCPKEEPALIVE{Timeout: 0})
+	c := &Client{Transport: &Transport{DialContext: DefaultTransport.DialContext}}
+
+	// The transport adds the option to a query that uses EDNS0.
+	m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true, UDPSize: 1232}}
+	m.Question = []RR{&TXT{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+	m.Pack()
+
+	for range 2 {
+		if _, _, err := c.Exchange(context.Background(), m, "tcp", addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A zero keepalive timeout from the server closes the connection after each reply.
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("expected %d connections, got %d", 2, n)
+	}
+}
+
+func TestPipeConnReplyAfterCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	tr := &Transport{}
+	pc := &pipeConn{Conn: client, pending: map[uint16]*pending{}, keepalive: -1}
+	go tr.readLoop(pc)
+	defer tr.closeConn(pc, io.EOF)
+
+	id, old, _ := pc.register(1)
+	server.Write([]byte{0, 3, byte(id >> 8), byte(id)}) // the start of a 3 octet reply
+	<-old.first
+
+	// The query is canceled and its ID is handed out again, while the rest of its reply is in transit.
+	pc.unregister(id, old)
+	id2, p, _ := pc.register(id)
+	if id2 != id {
+		t.Fatalf("expected ID %d to be reused, got %d", id, id2)
+	}
+	server.Write([]byte{0xff})
+	server.Write([]byte{0, 4, byte(id >> 8), byte(id), 0xfe, 0xfe})
+
+	select {
+	case r := <-p.ch:
+		if len(r.Data) != 4 {
+			t.Errorf("expected the 4 octet reply for the new query, got %d octets", len(r.Data))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a reply for the new query")
+	}
+	select {
+	case r := <-old.ch:
+		if len(r.Data) != 3 {
+			t.Errorf("expected the 3 octet reply for the canceled query, got %d octets", len(r.Data))
+		}
+	default:
+		t.Error("expected the reply of the canceled query to go to that query")
+	}
+}
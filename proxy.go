@@ -0,0 +1,231 @@
+package dns
+
+// PROXY protocol, https://www.haproxy.org/download/3.0/doc/proxy-protocol.txt.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PROXY protocol version 2 TLV types.
+const (
+	ProxyTLVALPN      uint8 = 0x01 // Application-Layer Protocol Negotiation.
+	ProxyTLVAuthority uint8 = 0x02 // Host name the client used, from TLS SNI for instance.
+	ProxyTLVCRC32C    uint8 = 0x03 // CRC32c checksum of the header.
+	ProxyTLVNoop      uint8 = 0x04 // Padding.
+	ProxyTLVUniqueID  uint8 = 0x05 // Opaque identifier of the connection.
+	ProxyTLVSSL       uint8 = 0x20 // Information about the TLS connection of the client.
+	ProxyTLVNetNS     uint8 = 0x30 // Network namespace.
+)
+
+// ProxyHeader is a PROXY protocol header, as sent by a load balancer in front of a server to relay the
+// addresses of the client. See [Server.ProxyTrusted].
+type ProxyHeader struct {
+	// Version is the version of the PROXY protocol, 1 or 2.
+	Version int
+	// Source is the address of the client and Destination the address the client connected to. They are nil
+	// when no connection is relayed, as with the LOCAL command that is used for health checks, or when the
+	// addresses are not IP addresses.
+	Source, Destination net.Addr
+	// TLVs holds the type-length-value vectors of a version 2 header.
+	TLVs []ProxyTLV
+}
+
+// ProxyTLV is a type-length-value vector of a PROXY protocol version 2 header.
+type ProxyTLV struct {
+	Type  uint8
+	Value []byte
+}
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = &Error{err: "bad PROXY protocol header"}
+)
+
+const (
+	proxyV1MaxLen    = 107                       // Maximum length of a version 1 header, including the CRLF.
+	proxyV2HeaderLen = 16                        // Length of the fixed part of a version 2 header.
+	proxyV2MaxLen    = proxyV2HeaderLen + 0xFFFF // Maximum length of a version 2 header.
+)
+
+// readProxyHeader reads a version 1 or version 2 header from r.
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	b, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, proxyV1Prefix) {
+		line, err := r.ReadSlice('\n')
+		if err != nil || len(line) > proxyV1MaxLen {
+			return nil, errProxyHeader
+		}
+		return parseProxyV1(line)
+	}
+	if !bytes.Equal(b, proxyV2Signature) {
+		return nil, errProxyHeader
+	}
+
+	buf := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	buf = append(buf, make([]byte, binary.BigEndian.Uint16(buf[14:]))...)
+	if _, err := io.ReadFull(r, buf[proxyV2HeaderLen:]); err != nil {
+		return nil, err
+	}
+	h, _, err := parseProxyV2(buf)
+	return h, err
+}
+
+// parseProxyV1 parses the version 1 header in line, which ends in CRLF.
+func parseProxyV1(line []byte) (*ProxyHeader, error) {
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errProxyHeader
+	}
+	fields := strings.Split(s, " ")
+	h := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	src, err1 := netip.ParseAddr(fields[2])
+	dst, err2 := netip.ParseAddr(fields[3])
+	sport, err3 := strconv.ParseUint(fields[4], 10, 16)
+	dport, err4 := strconv.ParseUint(fields[5], 10, 16)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || src.Is4() != (fields[1] == "TCP4") || dst.Is4() != src.Is4() {
+		return nil, errProxyHeader
+	}
+	h.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(sport)))
+	h.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, uint16(dport)))
+	return h, nil
+}
+
+// parseProxyV2 parses the version 2 header at the start of b, it returns the header and its length.
+func parseProxyV2(b []byte) (*ProxyHeader, int, error) {
+	if len(b) < proxyV2HeaderLen || !bytes.Equal(b[:len(proxyV2Signature)], proxyV2Signature) || b[12]>>4 != 2 {
+		return nil, 0, errProxyHeader
+	}
+	n := proxyV2HeaderLen + int(binary.BigEndian.Uint16(b[14:]))
+	if len(b) < n {
+		return nil, 0, errProxyHeader
+	}
+	h := &ProxyHeader{Version: 2}
+	body := b[proxyV2HeaderLen:n]
+
+	var addrLen int
+	switch b[13] >> 4 {
+	case 0x1: // AF_INET
+		addrLen = 2*4 + 4
+	case 0x2: // AF_INET6
+		addrLen = 2*16 + 4
+	case 0x3: // AF_UNIX
+		addrLen = 2 * 108
+	}
+	if len(body) < addrLen {
+		return nil, 0, errProxyHeader
+	}
+
+	switch cmd := b[12] & 0xF; {
+	case cmd == 0x0: // LOCAL, the addresses are ignored
+	case cmd != 0x1:
+		return nil, 0, errProxyHeader
+	case addrLen == 12 || addrLen == 36:
+		ipLen := (addrLen - 4) / 2
+		src, _ := netip.AddrFromSlice(body[:ipLen])
+		dst, _ := netip.AddrFromSlice(body[ipLen : 2*ipLen])
+		sport := binary.BigEndian.Uint16(body[2*ipLen:])
+		dport := binary.BigEndian.Uint16(body[2*ipLen+2:])
+		h.Source, h.Destination = proxyAddr(b[13]&0xF, src, sport), proxyAddr(b[13]&0xF, dst, dport)
+	}
+
+	for tlvs := body[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, 0, errProxyHeader
+		}
+		l := 3 + int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < l {
+			return nil, 0, errProxyHeader
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: bytes.Clone(tlvs[3:l])})
+		tlvs = tlvs[l:]
+	}
+	return h, n, nil
+}
+
+// proxyAddr returns the address of a version 2 header with transport protocol proto.
+func proxyAddr(proto byte, ip netip.Addr, port uint16) net.Addr {
+	if proto == 0x2 { // DGRAM
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, port))
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port))
+}
+
+// proxyListener is a listener whose connections from trusted addresses start with a PROXY protocol header.
+type proxyListener struct {
+	net.Listener
+	trusted func(net.Addr) bool
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn is a connection that starts with a PROXY protocol header. The header is read on the first Read,
+// so that it is done with the deadline of that read and not in Accept.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(func() { c.header, c.err = readProxyHeader(c.r) })
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// proxyHeaderOf returns the PROXY protocol header that has been read from conn, or nil if there is none.
+func proxyHeaderOf(conn net.Conn) *ProxyHeader {
+	if tc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tc.NetConn()
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		return pc.header
+	}
+	return nil
+}
+
+// addrOf returns the IP address of addr.
+func addrOf(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap.Addr().Unmap()
+}
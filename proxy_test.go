@@ -0,0 +1,154 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 returns a PROXY protocol version 2 header that relays a connection from src to dst.
+func proxyV2(src, dst netip.AddrPort, proto byte, tlvs ...ProxyTLV) []byte {
+	family := byte(0x10) // AF_INET
+	if src.Addr().Is6() {
+		family = 0x20
+	}
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, 0x21, family|proto, 0, 0)
+	b = append(b, src.Addr().AsSlice()...)
+	b = append(b, dst.Addr().AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, src.Port())
+	b = binary.BigEndian.AppendUint16(b, dst.Port())
+	for _, tlv := range tlvs {
+		b = append(b, tlv.Type)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(tlv.Value)))
+		b = append(b, tlv.Value...)
+	}
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-proxyV2HeaderLen))
+	return b
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src, dst := netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("198.51.100.1:53")
+	tests := []struct {
+		header string
+		src    string
+		tlvs   int
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n", "192.0.2.1:56324", 0},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 53\r\n", "[2001:db8::1]:56324", 0},
+		{"PROXY UNKNOWN\r\n", "", 0},
+		{string(proxyV2(src, dst, 0x1, ProxyTLV{ProxyTLVAuthority, []byte("example.org")}, ProxyTLV{ProxyTLVNoop, nil})), "192.0.2.1:56324", 2},
+		{"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00", "", 0}, // LOCAL
+	}
+	for _, tc := range tests {
+		r := bufio.NewReader(strings.NewReader(tc.header + "rest"))
+		h, err := readProxyHeader(r)
+		if err != nil {
+			t.Errorf("%q: %v", tc.header, err)
+			continue
+		}
+		if (h.Source == nil && tc.src != "") || (h.Source != nil && h.Source.String() != tc.src) {
+			t.Errorf("%q: expected source %q, got %v", tc.header, tc.src, h.Source)
+		}
+		if len(h.TLVs) != tc.tlvs {
+			t.Errorf("%q: expected %d TLVs, got %v", tc.header, tc.tlvs, h.TLVs)
+		}
+		if rest, _ := r.ReadString(0); rest != "rest" {
+			t.Errorf("%q: expected the header to be consumed, got %q left", tc.header, rest)
+		}
+	}
+
+	for _, header := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 53\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x00\x00\x00\x00",
+		"\x00\x12\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+	} {
+		if _, err := readProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("%q: expected error", header)
+		}
+	}
+}
+
+func TestServerProxy(t *testing.T) {
+	handler := HandlerFunc(func(ctx context.Context, w ResponseWriter, req *Msg) {
+		r := new(Msg).SetReply(req)
+		txt := []string{w.RemoteAddr().String(), w.LocalAddr().String()}
+		if proxy := ContextConnInfo(ctx).Proxy; proxy != nil {
+			for _, tlv := range proxy.TLVs {
+				txt = append(txt, string(tlv.Value))
+			}
+		}
+		r.Answer = []RR{&TXT{Hdr: Header{Name: req.Question[0].Header().Name, Class: ClassINET}, Txt: txt}}
+		w.WriteMsg(r)
+	})
+	addr := runServer(t, func() *Server {
+		return &Server{Handler: handler, ProxyTrusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	})
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID()}, Question: []RR{&TXT{Hdr: Header{Name: "example.org.", Class: ClassINET}}}}
+	if err := m.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	exchange := func(network string, header []byte) []string {
+		t.Helper()
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		query := header
+		if network == "tcp" {
+			query = binary.BigEndian.AppendUint16(query, uint16(len(m.Data)))
+		}
+		query = append(query, m.Data...)
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		r, err := readMsg(conn, m, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Answer[0].(*TXT).Txt
+	}
+
+	if txt := exchange("tcp", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n")); txt[0] != "192.0.2.1:56324" || txt[1] != "198.51.100.1:53" {
+		t.Errorf("expected the addresses from the v1 header, got %v", txt)
+	}
+	src, dst := netip.MustParseAddrPort("[2001:db8::1]:56324"), netip.MustParseAddrPort("[2001:db8::53]:53")
+	header := proxyV2(src, dst, 0x2, ProxyTLV{ProxyTLVAuthority, []byte("dns.example.org")})
+	if txt := exchange("udp", header); txt[0] != src.String() || txt[1] != dst.String() || len(txt) != 3 || txt[2] != "dns.example.org" {
+		t.Errorf("expected the addresses and TLV from the v2 header, got %v", txt)
+	}
+	// A query of close to 512 octets still fits with the header in front of it.
+	m.UDPSize, m.Pseudo, m.Data = 1232, []RR{&PADDING{Padding: strings.Repeat("\x00", 460)}}, nil
+	if err := m.Pack(); err != nil || len(m.Data) > MinMsgSize || len(m.Data)+len(header) <= MinMsgSize {
+		t.Fatalf("expected a query that only fits in %d octets without the header, got %d octets: %v", MinMsgSize, len(m.Data), err)
+	}
+	if txt := exchange("udp", header); txt[0] != src.String() {
+		t.Errorf("expected the source from the v2 header, got %v", txt)
+	}
+	if txt := exchange("tcp", proxyV2(src, dst, 0x1)); txt[0] != src.String() {
+		t.Errorf("expected the source from the v2 header, got %v", txt)
+	}
+
+	// Without a header from a trusted address the query is dropped.
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	conn.Write(m.Data)
+	if _, err := conn.Read(make([]byte, MinMsgSize)); err == nil {
+		t.Error("expected query without PROXY header to be dropped")
+	}
+}
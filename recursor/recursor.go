@@ -0,0 +1,433 @@
+// Package recursor implements an iterative resolver. Starting at the root name servers it follows the
+// referrals down the tree until it reaches the name servers that are authoritative for the name, as a
+// recursive name server does.
+//
+//	r := &recursor.Recursor{}
+//	m, err := r.Resolve(ctx, "www.example.org.", dns.TypeA)
+package recursor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dnsv2"
+	"github.com/miekg/dnsv2/dnsutil"
+)
+
+var (
+	ErrLoop       = errors.New("recursor: loop detected")           // ErrLoop is returned when an alias chain or the lookup of name server addresses loops.
+	ErrMaxQueries = errors.New("recursor: too many queries")        // ErrMaxQueries is returned when a resolution needs more than MaxQueries queries.
+	ErrNoServers  = errors.New("recursor: no name server answered") // ErrNoServers is returned when none of the name servers of a zone gave a usable reply.
+)
+
+const (
+	maxAliases        = 16 // CNAME and DNAME records that are followed in a single resolution
+	defaultMaxQueries = 100
+	defaultTimeout    = 2 * time.Second
+	defaultLameTTL    = 15 * time.Minute
+	udpSize           = 1232 // EDNS0 buffer size advertised in queries, see https://dnsflagday.net/2020/
+)
+
+// A Recursor resolves names by iterating from the root name servers. A name server is lame for a zone when
+// it refuses queries for it, or replies without being authoritative and without referring to a zone closer
+// to the name; it is then not asked again for that zone for LameTTL. The zero Recursor is ready to use.
+type Recursor struct {
+	// Client is used for the queries to the name servers, if nil a Client with dns.DefaultTransport is used.
+	// Queries are sent over UDP and are retried over TCP when the reply is truncated.
+	Client *dns.Client
+	// Roots are the name servers to start with, if nil RootHints is used.
+	Roots []Hint
+	// Port is the port the name servers listen on, if empty "53" is used.
+	Port string
+	// Timeout is the timeout of a single query, if zero 2 seconds is used.
+	Timeout time.Duration
+	// MaxQueries limits the number of queries for a single resolution, if zero 100 is used.
+	MaxQueries int
+	// LameTTL is how long a lame name server is not used for a zone, if zero 15 minutes is used.
+	LameTTL time.Duration
+
+	mu   sync.Mutex
+	lame map[string]time.Time // zone and address of lame servers, until when they are lame
+}
+
+type nameserver struct {
+	name  string
+	addrs []string // when empty the addresses must be looked up: the delegation is glueless
+}
+
+// resolution holds the state of a single call to Resolve.
+type resolution struct {
+	*Recursor
+	queries int
+	active  map[string]bool // name and type of the resolutions in progress, to detect loops
+}
+
+// Resolve resolves name with type qtype. The returned message holds the answer, including the CNAME and
+// DNAME records that lead to it, with the rcode of the last authoritative reply. For NXDOMAIN and NODATA
+// replies the SOA record of the zone is put in the authority section. An error is returned when the
+// resolution does not lead to an authoritative reply.
+func (r *Recursor) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	if _, ok := dns.TypeToRR[qtype]; !ok {
+		return nil, fmt.Errorf("recursor: unknown type %d", qtype)
+	}
+	s := &resolution{Recursor: r, active: map[string]bool{}}
+	return s.resolve(ctx, dnsutil.Canonical(name), qtype)
+}
+
+// ServeDNS implements dns.Handler. It resolves the question of req and writes the reply, when the resolution
+// fails the reply has rcode SERVFAIL. The resolution ends with the deadline of ctx: a dns.Server sets that
+// to its WriteTimeout, 2 seconds by default, which is too short to resolve a name from the root. Raise
+// WriteTimeout of the Server that serves a Recursor:
+//
+//	srv := &dns.Server{Addr: ":53", Net: "udp", Handler: &recursor.Recursor{}, WriteTimeout: 10 * time.Second}
+func (r *Recursor) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	reply := new(dns.Msg).SetReply(req)
+	reply.RecursionAvailable = true
+	reply.UDPSize = req.UDPSize
+	if len(req.Question) == 0 {
+		reply.Rcode = dns.RcodeFormatError
+		w.WriteMsg(reply)
+		return
+	}
+	q := req.Question[0]
+	m, err := r.Resolve(ctx, q.Header().Name, dns.RRToType(q))
+	if err != nil {
+		reply.Rcode = dns.RcodeServerFailure
+	} else {
+		reply.Rcode, reply.Answer, reply.Ns = m.Rcode, m.Answer, m.Ns
+	}
+	w.WriteMsg(reply)
+}
+
+func (s *resolution) resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	key := name + " " + strconv.Itoa(int(qtype))
+	if s.active[key] {
+		return nil, fmt.Errorf("%w: %s", ErrLoop, name)
+	}
+	s.active[key] = true
+	defer delete(s.active, key)
+
+	reply := &dns.Msg{MsgHeader: dns.MsgHeader{Response: true, RecursionAvailable: true}}
+	seen := map[string]bool{name: true}
+	for {
+		m, zone, err := s.iterate(ctx, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		reply.Rcode = m.Rcode
+		reply.Ns = nil
+		for _, rr := range m.Ns {
+			if _, ok := rr.(*dns.SOA); ok {
+				reply.Ns = append(reply.Ns, rr)
+			}
+		}
+
+		name, err = chase(m, zone, name, qtype, seen, &reply.Answer)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return reply, nil
+		}
+	}
+}
+
+// iterate queries the name servers, starting at the root, for name and qtype and follows the referrals. It
+// returns the authoritative reply and the zone it came from.
+func (s *resolution) iterate(ctx context.Context, name string, qtype uint16) (*dns.Msg, string, error) {
+	zone, servers := ".", s.roots()
+	for {
+		m, err := s.ask(ctx, zone, servers, name, qtype)
+		if err != nil {
+			return nil, "", err
+		}
+		child, ns := referral(m, zone, name)
+		if child == "" {
+			return m, zone, nil
+		}
+		zone, servers = child, ns
+	}
+}
+
+// ask asks the name servers of zone in turn for name and qtype, until one of them gives an authoritative
+// reply or a referral. The addresses of servers without glue are looked up first.
+func (s *resolution) ask(ctx context.Context, zone string, servers []nameserver, name string, qtype uint16) (*dns.Msg, error) {
+	var last error
+	for _, ns := range servers {
+		addrs := ns.addrs
+		if len(addrs) == 0 {
+			var err error
+			if addrs, err = s.lookupAddrs(ctx, ns.name); err != nil {
+				if errors.Is(err, ErrMaxQueries) || ctx.Err() != nil {
+					return nil, err
+				}
+				last = err
+				continue
+			}
+		}
+
+		for _, addr := range addrs {
+			if s.isLame(zone, addr) {
+				continue
+			}
+			if s.queries >= s.maxQueries() {
+				return nil, ErrMaxQueries
+			}
+			s.queries++
+
+			m, err := s.query(ctx, addr, name, qtype)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				last = err
+				continue
+			}
+			switch m.Rcode {
+			case dns.RcodeSuccess, dns.RcodeNameError:
+				if m.Authoritative {
+					return m, nil
+				}
+				if child, _ := referral(m, zone, name); child != "" {
+					return m, nil
+				}
+			case dns.RcodeServerFailure:
+				last = fmt.Errorf("recursor: %s replied %s", addr, dns.RcodeToString[m.Rcode])
+				continue
+			}
+			s.setLame(zone, addr)
+			last = fmt.Errorf("recursor: %s is lame for %s", addr, zone)
+		}
+	}
+	if last != nil {
+		return nil, fmt.Errorf("%w for %s: %w", ErrNoServers, zone, last)
+	}
+	return nil, fmt.Errorf("%w for %s", ErrNoServers, zone)
+}
+
+// query sends a single query for name and qtype to the name server at addr.
+func (s *resolution) query(ctx context.Context, addr, name string, qtype uint16) (*dns.Msg, error) {
+	q := dns.TypeToRR[qtype]()
+	*q.Header() = dns.Header{Name: name, Class: dns.ClassINET}
+	m := &dns.Msg{MsgHeader: dns.MsgHeader{ID: dns.ID()}, Question: []dns.RR{q}}
+	m.UDPSize = udpSize
+	if err := m.Pack(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout())
+	defer cancel()
+	c := s.Client
+	if c == nil {
+		c = &dns.Client{Transport: dns.DefaultTransport}
+	}
+	r, _, _, err := c.ExchangeWithFallback(ctx, m, net.JoinHostPort(addr, s.port()))
+	return r, err
+}
+
+// lookupAddrs resolves the addresses of the name server host, for a glueless delegation. IPv6 addresses are
+// only looked up when host has no IPv4 addresses.
+func (s *resolution) lookupAddrs(ctx context.Context, host string) ([]string, error) {
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m, err := s.resolve(ctx, host, qtype)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range m.Answer {
+			switch a := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, a.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, a.AAAA.String())
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, fmt.Errorf("recursor: no addresses for %s", host)
+}
+
+// chase follows the answer in m, that came from zone, for name and qtype. The records found are appended to
+// answer; for a DNAME a CNAME is synthesized. It returns the name an alias points to that must be resolved
+// with new queries, or the empty string when the resolution is complete. The names in seen have been
+// visited, seeing one of them again is a loop.
+func chase(m *dns.Msg, zone, name string, qtype uint16, seen map[string]bool, answer *[]dns.RR) (string, error) {
+	for {
+		var (
+			data  []dns.RR
+			cname *dns.CNAME
+			dname *dns.DNAME
+		)
+		for _, rr := range m.Answer {
+			owner := dnsutil.Canonical(rr.Header().Name)
+			switch {
+			case owner == name && dns.RRToType(rr) == qtype:
+				data = append(data, rr)
+			case owner == name:
+				if c, ok := rr.(*dns.CNAME); ok {
+					cname = c
+				}
+			case dnsutil.IsSubDomain(owner, name):
+				if d, ok := rr.(*dns.DNAME); ok {
+					dname = d
+				}
+			}
+		}
+		if len(data) > 0 {
+			*answer = append(*answer, data...)
+			return "", nil
+		}
+
+		var target string
+		switch {
+		case dname != nil:
+			owner := dnsutil.Canonical(dname.Hdr.Name)
+			target = name[:len(name)-len(owner)]
+			if t := dnsutil.Canonical(dname.Target); t != "." {
+				target += t
+			}
+			if _, ok := dnsutil.IsName(target); !ok {
+				return "", fmt.Errorf("recursor: bad DNAME substitution for %s", name)
+			}
+			synth := &dns.CNAME{Hdr: dns.Header{Name: name, Class: dname.Hdr.Class, TTL: dname.Hdr.TTL}, Target: target}
+			*answer = append(*answer, dname, synth)
+		case cname != nil:
+			target = dnsutil.Canonical(cname.Target)
+			*answer = append(*answer, cname)
+		default:
+			return "", nil // NXDOMAIN or NODATA for name
+		}
+
+		if seen[target] || len(seen) > maxAliases {
+			return "", fmt.Errorf("%w: %s", ErrLoop, target)
+		}
+		seen[target] = true
+		// The target can only be taken from this reply when it is within zone, and the reply has something
+		// for it. If the target does not exist, the rcode is NXDOMAIN, RFC 6604.
+		if !dnsutil.IsSubDomain(zone, target) || (m.Rcode != dns.RcodeNameError && !covers(m, target)) {
+			return target, nil
+		}
+		name = target
+	}
+}
+
+// covers returns true if the answer section of m has records for name, or a DNAME above it.
+func covers(m *dns.Msg, name string) bool {
+	for _, rr := range m.Answer {
+		owner := rr.Header().Name
+		if dnsutil.Canonical(owner) == name {
+			return true
+		}
+		if _, ok := rr.(*dns.DNAME); ok && dnsutil.IsSubDomain(owner, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// referral returns the zone m delegates to and its name servers, if m is a referral from zone to a zone
+// closer to name. Glue is only used when it is within zone, otherwise the server's addresses must be looked
+// up.
+func referral(m *dns.Msg, zone, name string) (string, []nameserver) {
+	if m.Authoritative || m.Rcode != dns.RcodeSuccess || len(m.Answer) > 0 {
+		return "", nil
+	}
+	var (
+		child   string
+		servers []nameserver
+	)
+	for _, rr := range m.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dnsutil.Canonical(ns.Hdr.Name)
+		if owner == zone || !dnsutil.IsSubDomain(zone, owner) || !dnsutil.IsSubDomain(owner, name) {
+			continue
+		}
+		if child == "" {
+			child = owner
+		}
+		if owner == child {
+			servers = append(servers, nameserver{name: dnsutil.Canonical(ns.Ns)})
+		}
+	}
+
+	for i := range servers {
+		if !dnsutil.IsSubDomain(zone, servers[i].name) {
+			continue
+		}
+		for _, rr := range m.Extra {
+			if dnsutil.Canonical(rr.Header().Name) != servers[i].name {
+				continue
+			}
+			switch a := rr.(type) {
+			case *dns.A:
+				servers[i].addrs = append(servers[i].addrs, a.A.String())
+			case *dns.AAAA:
+				servers[i].addrs = append(servers[i].addrs, a.AAAA.String())
+			}
+		}
+	}
+	return child, servers
+}
+
+func (r *Recursor) roots() []nameserver {
+	hints := r.Roots
+	if hints == nil {
+		hints = RootHints
+	}
+	servers := make([]nameserver, len(hints))
+	for i, h := range hints {
+		servers[i] = nameserver{name: dnsutil.Canonical(h.Name), addrs: h.Addrs}
+	}
+	return servers
+}
+
+func (r *Recursor) isLame(zone, addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	until, ok := r.lame[zone+" "+addr]
+	return ok && time.Now().Before(until)
+}
+
+func (r *Recursor) setLame(zone, addr string) {
+	ttl := r.LameTTL
+	if ttl == 0 {
+		ttl = defaultLameTTL
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lame == nil {
+		r.lame = map[string]time.Time{}
+	}
+	r.lame[zone+" "+addr] = time.Now().Add(ttl)
+}
+
+func (r *Recursor) port() string {
+	if r.Port != "" {
+		return r.Port
+	}
+	return "53"
+}
+
+func (r *Recursor) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return defaultTimeout
+}
+
+func (r *Recursor) maxQueries() int {
+	if r.MaxQueries > 0 {
+		return r.MaxQueries
+	}
+	return defaultMaxQueries
+}
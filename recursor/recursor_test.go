@@ -0,0 +1,229 @@
+package recursor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dnsv2"
+	"github.com/miekg/dnsv2/dnsutil"
+)
+
+// zone is a minimal authoritative zone used by the test servers.
+type zone struct {
+	origin string
+	rrs    []dns.RR
+}
+
+func newZone(t *testing.T, origin string, records ...string) zone {
+	t.Helper()
+	z := zone{origin: origin}
+	for _, s := range records {
+		rr, err := dns.New(s)
+		if err != nil {
+			t.Fatalf("bad record %q: %v", s, err)
+		}
+		z.rrs = append(z.rrs, rr)
+	}
+	return z
+}
+
+// answer returns the authoritative answer, or the referral, for the question in req.
+func (z zone) answer(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg).SetReply(req)
+	q := req.Question[0]
+	name, qtype := dnsutil.Canonical(q.Header().Name), dns.RRToType(q)
+
+	// Delegations below the apex.
+	var cut []dns.RR
+	for _, rr := range z.rrs {
+		owner := rr.Header().Name
+		if _, ok := rr.(*dns.NS); ok && owner != z.origin && dnsutil.IsSubDomain(owner, name) {
+			if len(cut) == 0 || owner == cut[0].Header().Name {
+				cut = append(cut, rr)
+			}
+		}
+	}
+	if len(cut) > 0 {
+		m.Ns = cut
+		for _, ns := range cut {
+			for _, rr := range z.rrs {
+				switch rr.(type) {
+				case *dns.A, *dns.AAAA:
+					if rr.Header().Name == ns.(*dns.NS).Ns {
+						m.Extra = append(m.Extra, rr)
+					}
+				}
+			}
+		}
+		return m
+	}
+
+	m.Authoritative = true
+	exists := false
+	for _, rr := range z.rrs {
+		owner := rr.Header().Name
+		switch {
+		case owner == name && (dns.RRToType(rr) == qtype || dns.RRToType(rr) == dns.TypeCNAME):
+			m.Answer = append(m.Answer, rr)
+		case owner != name && dnsutil.IsSubDomain(owner, name) && dns.RRToType(rr) == dns.TypeDNAME:
+			m.Answer = append(m.Answer, rr)
+			return m
+		}
+		exists = exists || dnsutil.IsSubDomain(name, owner)
+	}
+	if len(m.Answer) == 0 {
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+		for _, rr := range z.rrs {
+			if _, ok := rr.(*dns.SOA); ok {
+				m.Ns = append(m.Ns, rr)
+			}
+		}
+	}
+	return m
+}
+
+// serveZones serves the zones on UDP at addr, queries outside of those zones are refused.
+func serveZones(t *testing.T, addr string, zones ...zone) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := &dns.Msg{Data: append([]byte{}, buf[:n]...)}
+			if req.Unpack() != nil || len(req.Question) == 0 {
+				continue
+			}
+			name := req.Question[0].Header().Name
+			m := new(dns.Msg).SetRcode(req, dns.RcodeRefused)
+			best := ""
+			for _, z := range zones {
+				if dnsutil.IsSubDomain(z.origin, name) && len(z.origin) > len(best) {
+					best, m = z.origin, z.answer(req)
+				}
+			}
+			if m.Pack() == nil {
+				pc.WriteTo(m.Data, from)
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestRecursor(t *testing.T) {
+	root := newZone(t, ".",
+		". IN SOA a.root. hostmaster.root. 1 2 3 4 60",
+		". IN NS a.root.",
+		"test. IN NS ns1.test.",
+		"ns1.test. IN A 127.0.0.2",
+		"net. IN NS ns.net.",
+		"ns.net. IN A 127.0.0.3",
+		"example. IN NS ns.example.net.",
+		"loopy. IN NS ns.loopy2.",
+		"loopy2. IN NS ns.loopy.",
+	)
+	addr := serveZones(t, "127.0.0.1:0", root)
+	_, port, _ := net.SplitHostPort(addr)
+	serve := func(ip string, zones ...zone) { serveZones(t, net.JoinHostPort(ip, port), zones...) }
+
+	serve("127.0.0.2", newZone(t, "test.",
+		"test. IN SOA ns1.test. hostmaster.test. 1 2 3 4 60",
+		"test. IN NS ns1.test.",
+		"ns1.test. IN A 127.0.0.2",
+		"www.test. IN A 192.0.2.1",
+		"alias.test. IN CNAME www.test.",
+		"ext.test. IN CNAME www.example.",
+		"loop1.test. IN CNAME loop2.test.",
+		"loop2.test. IN CNAME loop1.test.",
+		"d.test. IN DNAME example.",
+		"sub.test. IN NS ns1.sub.test.",
+		"sub.test. IN NS ns2.sub.test.",
+		"ns1.sub.test. IN A 127.0.0.5",
+		"ns2.sub.test. IN A 127.0.0.6",
+	))
+	serve("127.0.0.3", newZone(t, "net.",
+		"net. IN SOA ns.net. hostmaster.net. 1 2 3 4 60",
+		"ns.example.net. IN A 127.0.0.4",
+	))
+	serve("127.0.0.4", newZone(t, "example.",
+		"example. IN SOA ns.example.net. hostmaster.example. 1 2 3 4 60",
+		"www.example. IN A 192.0.2.2",
+	))
+	serve("127.0.0.5") // lame, refuses everything
+	serve("127.0.0.6", newZone(t, "sub.test.",
+		"sub.test. IN SOA ns2.sub.test. hostmaster.sub.test. 1 2 3 4 60",
+		"host.sub.test. IN A 192.0.2.3",
+	))
+
+	r := &Recursor{Roots: []Hint{{"a.root.", []string{"127.0.0.1"}}}, Port: port}
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		rcode  uint16
+		answer []string // owner names in the answer section
+		addr   string   // address in the final A record
+	}{
+		{"www.test.", dns.RcodeSuccess, []string{"www.test."}, "192.0.2.1"},
+		{"WWW.Test.", dns.RcodeSuccess, []string{"www.test."}, "192.0.2.1"},
+		{"alias.test.", dns.RcodeSuccess, []string{"alias.test.", "www.test."}, "192.0.2.1"},
+		{"ext.test.", dns.RcodeSuccess, []string{"ext.test.", "www.example."}, "192.0.2.2"},
+		{"www.d.test.", dns.RcodeSuccess, []string{"d.test.", "www.d.test.", "www.example."}, "192.0.2.2"},
+		{"host.sub.test.", dns.RcodeSuccess, []string{"host.sub.test."}, "192.0.2.3"},
+		{"nope.test.", dns.RcodeNameError, nil, ""},
+		{"ns1.test.", dns.RcodeSuccess, []string{"ns1.test."}, "127.0.0.2"},
+	}
+	for _, tc := range tests {
+		m, err := r.Resolve(ctx, tc.name, dns.TypeA)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if m.Rcode != tc.rcode {
+			t.Errorf("%s: expected rcode %s, got %s", tc.name, dns.RcodeToString[tc.rcode], dns.RcodeToString[m.Rcode])
+		}
+		owners := []string{}
+		for _, rr := range m.Answer {
+			owners = append(owners, rr.Header().Name)
+		}
+		if strings.Join(owners, " ") != strings.Join(tc.answer, " ") {
+			t.Errorf("%s: expected answer for %v, got %v", tc.name, tc.answer, m.Answer)
+			continue
+		}
+		if tc.addr != "" && m.Answer[len(m.Answer)-1].(*dns.A).A.String() != tc.addr {
+			t.Errorf("%s: expected address %s, got %v", tc.name, tc.addr, m.Answer[len(m.Answer)-1])
+		}
+		if tc.rcode == dns.RcodeNameError && len(m.Ns) != 1 {
+			t.Errorf("%s: expected SOA in authority section, got %v", tc.name, m.Ns)
+		}
+	}
+
+	if !r.isLame("sub.test.", "127.0.0.5") {
+		t.Errorf("expected 127.0.0.5 to be lame for sub.test.")
+	}
+
+	if _, err := r.Resolve(ctx, "loop1.test.", dns.TypeA); !errors.Is(err, ErrLoop) {
+		t.Errorf("expected %v for CNAME loop, got %v", ErrLoop, err)
+	}
+	if _, err := r.Resolve(ctx, "www.loopy.", dns.TypeA); !errors.Is(err, ErrLoop) || !errors.Is(err, ErrNoServers) {
+		t.Errorf("expected %v for glueless loop, got %v", ErrLoop, err)
+	}
+
+	r.MaxQueries = 2
+	if _, err := r.Resolve(ctx, "ext.test.", dns.TypeA); !errors.Is(err, ErrMaxQueries) {
+		t.Errorf("expected %v, got %v", ErrMaxQueries, err)
+	}
+}
@@ -0,0 +1,24 @@
+package recursor
+
+// A Hint is a name server together with its addresses.
+type Hint struct {
+	Name  string   // Name is the name of the name server.
+	Addrs []string // Addrs holds the IPv4 and IPv6 addresses of the name server.
+}
+
+// RootHints are the root name servers, as published by IANA in https://www.internic.net/domain/named.root.
+var RootHints = []Hint{
+	{"a.root-servers.net.", []string{"198.41.0.4", "2001:503:ba3e::2:30"}},
+	{"b.root-servers.net.", []string{"170.247.170.2", "2801:1b8:10::b"}},
+	{"c.root-servers.net.", []string{"192.33.4.12", "2001:500:2::c"}},
+	{"d.root-servers.net.", []string{"199.7.91.13", "2001:500:2d::d"}},
+	{"e.root-servers.net.", []string{"192.203.230.10", "2001:500:a8::e"}},
+	{"f.root-servers.net.", []string{"192.5.5.241", "2001:500:2f::f"}},
+	{"g.root-servers.net.", []string{"192.112.36.4", "2001:500:12::d0d"}},
+	{"h.root-servers.net.", []string{"198.97.190.53", "2001:500:1::53"}},
+	{"i.root-servers.net.", []string{"192.36.148.17", "2001:7fe::53"}},
+	{"j.root-servers.net.", []string{"192.58.128.30", "2001:503:c27::2:30"}},
+	{"k.root-servers.net.", []string{"193.0.14.129", "2001:7fd::1"}},
+	{"l.root-servers.net.", []string{"199.7.83.42", "2001:500:9f::42"}},
+	{"m.root-servers.net.", []string{"202.12.27.33", "2001:dc3::35"}},
+}
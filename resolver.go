@@ -0,0 +1,344 @@
+package dns
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dnsconf "github.com/miekg/dnsv2/dnsconf"
+)
+
+// A Resolver sends queries to the name servers found in its Config, like the stub resolver in the C
+// library does. Each server is tried in turn, for Config.Attempts rounds. Every attempt is limited to
+// Config.Timeout seconds. With Config.Rotate set the first server used is selected round robin. The Lookup
+// methods expand names with Config.Search, as the C library does.
+//
+// The zero Resolver is not usable, use [NewResolver] to create one.
+type Resolver struct {
+	// Client is used to perform the queries, if nil a Client with [DefaultTransport] is used.
+	*Client
+	// Config holds the servers, port, timeout and attempts to use.
+	Config *dnsconf.Config
+
+	next atomic.Uint32 // server to start with when rotating
+}
+
+// NewResolver returns a resolver that uses the settings in conf.
+func NewResolver(conf *dnsconf.Config) *Resolver {
+	return &Resolver{Client: &Client{Transport: DefaultTransport}, Config: conf}
+}
+
+// ServerError is the failure of a single server in a [ResolverError].
+type ServerError struct {
+	Server string // Server is the address of the server.
+	Err    error  // Err is the last error seen while talking to this server.
+}
+
+func (e *ServerError) Error() string { return e.Server + ": " + e.Err.Error() }
+func (e *ServerError) Unwrap() error { return e.Err }
+
+// ResolverError is returned when none of the servers in a [Resolver] returned a usable reply. It lists the
+// failure of each server, in the order they were tried.
+type ResolverError struct {
+	Errors []*ServerError
+}
+
+func (e *ResolverError) Error() string {
+	sb := strings.Builder{}
+	sb.WriteString("dns: all servers failed")
+	for i, err := range e.Errors {
+		if i == 0 {
+			sb.WriteString(": ")
+		} else {
+			sb.WriteString("; ")
+		}
+		sb.WriteString(err.Error())
+	}
+	return sb.String()
+}
+
+// Unwrap returns the errors of the servers.
+func (e *ResolverError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i := range e.Errors {
+		errs[i] = e.Errors[i]
+	}
+	return errs
+}
+
+// Exchange sends m to the servers from the configuration and returns the first usable reply. The message
+// is sent over UDP and retried over TCP when the reply is truncated. Replies with rcode SERVFAIL, NOTIMP or
+// REFUSED are not usable and the next server is tried. If all servers fail, a *ResolverError is returned,
+// together with the last unusable reply, if there was one. The message's Data buffer must have been
+// written to by calling m.Pack() before calling Exchange.
+func (r *Resolver) Exchange(ctx context.Context, m *Msg) (*Msg, error) {
+	servers := r.Config.Servers
+	if len(servers) == 0 {
+		return nil, &Error{err: "no servers configured"}
+	}
+	attempts := max(r.Config.Attempts, 1)
+	timeout := time.Duration(max(r.Config.Timeout, 1)) * time.Second
+
+	start := 0
+	if r.Config.Rotate {
+		start = int((r.next.Add(1) - 1) % uint32(len(servers)))
+	}
+
+	errs := make([]*ServerError, len(servers))
+	var last *Msg
+	for range attempts {
+		for i := range servers {
+			j := (start + i) % len(servers)
+			server := net.JoinHostPort(servers[j], r.Config.Port)
+
+			reply, err := r.exchange(ctx, m, server, timeout)
+			if err == nil {
+				switch reply.Rcode {
+				case RcodeServerFailure, RcodeNotImplemented, RcodeRefused:
+					err = &Error{err: "server replied " + RcodeToString[reply.Rcode]}
+					last = reply
+				default:
+					return reply, nil
+				}
+			}
+			if errs[j] == nil {
+				errs[j] = &ServerError{Server: server}
+			}
+			errs[j].Err = err
+
+			if ctx.Err() != nil {
+				return last, &ResolverError{Errors: tried(errs, start)}
+			}
+		}
+	}
+	return last, &ResolverError{Errors: tried(errs, start)}
+}
+
+func (r *Resolver) exchange(ctx context.Context, m *Msg, server string, timeout time.Duration) (*Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c := r.Client
+	if c == nil {
+		c = &Client{Transport: DefaultTransport}
+	}
+	reply, _, _, err := c.exchangeWithFallback(ctx, m, "udp", server)
+	return reply, err
+}
+
+// tried returns the non nil server errors in the order the servers were tried.
+func tried(errs []*ServerError, start int) []*ServerError {
+	t := make([]*ServerError, 0, len(errs))
+	for i := range errs {
+		if err := errs[(start+i)%len(errs)]; err != nil {
+			t = append(t, err)
+		}
+	}
+	return t
+}
+
+// Lookup looks up name with type qtype. Unless name is fully qualified it is expanded with the search list
+// of the configuration, see [dnsconf.Config.NameList]. The candidate names are queried in order and the
+// first reply with records of type qtype in the answer section is returned.
+//
+// Like in the C library a candidate that does not exist (NXDOMAIN), that has no records of type qtype
+// (NODATA), or for which the servers failed with SERVFAIL, makes the next candidate be tried. Any other
+// failure stops the search. When none of the candidates has data the error is ErrNoData if one of them had
+// NODATA, the *ResolverError if one failed with SERVFAIL and ErrNXDomain otherwise. The reply that goes with
+// that error is returned as well.
+func (r *Resolver) Lookup(ctx context.Context, name string, qtype uint16) (*Msg, error) {
+	replies, err := r.search(ctx, name, qtype)
+	return replies[0], err
+}
+
+// LookupHost looks up the A and AAAA records of host, see [Resolver.Lookup]. The returned RRs are of type
+// *A or *AAAA, the A records come first. When one of the two queries fails, the records of the other are
+// returned.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]RR, error) {
+	replies, err := r.search(ctx, host, TypeA, TypeAAAA)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []RR
+	for _, a := range answers[*A](replies[0]) {
+		rrs = append(rrs, a)
+	}
+	for _, aaaa := range answers[*AAAA](replies[1]) {
+		rrs = append(rrs, aaaa)
+	}
+	return rrs, nil
+}
+
+// LookupMX looks up the MX records of name, see [Resolver.Lookup]. The records are sorted by preference.
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*MX, error) {
+	m, err := r.Lookup(ctx, name, TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	mxs := answers[*MX](m)
+	slices.SortStableFunc(mxs, func(a, b *MX) int { return cmp.Compare(a.Preference, b.Preference) })
+	return mxs, nil
+}
+
+// LookupSRV looks up the SRV records of _service._proto.name, see [Resolver.Lookup]. If service and proto
+// are both empty, name is looked up as is. The records are sorted by priority and, within a priority, put
+// in the weighted random order of RFC 2782.
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) ([]*SRV, error) {
+	if service != "" || proto != "" {
+		name = "_" + service + "._" + proto + "." + name
+	}
+	m, err := r.Lookup(ctx, name, TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	srvs := answers[*SRV](m)
+	slices.SortStableFunc(srvs, func(a, b *SRV) int { return cmp.Compare(a.Priority, b.Priority) })
+	for i := 0; i < len(srvs); {
+		j := i + 1
+		for j < len(srvs) && srvs[j].Priority == srvs[i].Priority {
+			j++
+		}
+		shuffleByWeight(srvs[i:j])
+		i = j
+	}
+	return srvs, nil
+}
+
+// shuffleByWeight orders srvs, that all have the same priority, as RFC 2782 describes: each next record is
+// picked at random, with a chance proportional to its weight. Records with weight zero are put first, so
+// they have a very small chance of being picked early.
+func shuffleByWeight(srvs []*SRV) {
+	slices.SortStableFunc(srvs, func(a, b *SRV) int { return cmp.Compare(min(a.Weight, 1), min(b.Weight, 1)) })
+	sum := 0
+	for _, srv := range srvs {
+		sum += int(srv.Weight)
+	}
+	for len(srvs) > 1 {
+		n, running := rand.IntN(sum+1), 0
+		for i, srv := range srvs {
+			running += int(srv.Weight)
+			if running >= n {
+				copy(srvs[1:i+1], srvs[:i])
+				srvs[0] = srv
+				break
+			}
+		}
+		sum -= int(srvs[0].Weight)
+		srvs = srvs[1:]
+	}
+}
+
+// LookupTXT looks up the TXT records of name, see [Resolver.Lookup].
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]*TXT, error) {
+	m, err := r.Lookup(ctx, name, TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	return answers[*TXT](m), nil
+}
+
+// search walks the search list for name and queries each candidate for all qtypes. It returns the replies,
+// in the order of qtypes, for the first candidate that has data for at least one of them.
+func (r *Resolver) search(ctx context.Context, name string, qtypes ...uint16) ([]*Msg, error) {
+	var (
+		nodata   []*Msg
+		servfail []*Msg
+		srvErr   error
+		last     []*Msg
+	)
+	for _, candidate := range r.Config.NameList(name) {
+		replies, errs := r.query(ctx, candidate, qtypes)
+		last = replies
+
+		for i, reply := range replies {
+			if errs[i] == nil && reply.Rcode == RcodeSuccess && hasType(reply, qtypes[i]) {
+				return replies, nil
+			}
+		}
+
+		for i, reply := range replies {
+			switch {
+			case errs[i] != nil && (reply == nil || reply.Rcode != RcodeServerFailure):
+				return replies, errs[i] // timeouts, REFUSED and such end the search
+			case errs[i] != nil:
+				if servfail == nil {
+					servfail, srvErr = replies, errs[i]
+				}
+			case reply.Rcode == RcodeSuccess:
+				if nodata == nil {
+					nodata = replies
+				}
+			case reply.Rcode != RcodeNameError:
+				return replies, &Error{err: "server replied " + RcodeToString[reply.Rcode]}
+			}
+		}
+	}
+
+	switch {
+	case nodata != nil:
+		return nodata, fmt.Errorf("%w: %s", ErrNoData, name)
+	case servfail != nil:
+		return servfail, srvErr
+	}
+	return last, fmt.Errorf("%w: %s", ErrNXDomain, name)
+}
+
+// query sends queries for name with each of the qtypes concurrently and returns the replies and errors in
+// the order of qtypes.
+func (r *Resolver) query(ctx context.Context, name string, qtypes []uint16) ([]*Msg, []error) {
+	replies := make([]*Msg, len(qtypes))
+	errs := make([]error, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var q RR
+			if newFn, ok := TypeToRR[qtype]; ok {
+				q = newFn()
+				*q.Header() = Header{Name: name, t: qtype, Class: ClassINET}
+			} else {
+				q = &RFC3597{Hdr: Header{Name: name, t: qtype, Class: ClassINET}}
+			}
+			m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}, Question: []RR{q}}
+			if errs[i] = m.Pack(); errs[i] != nil {
+				return
+			}
+			replies[i], errs[i] = r.Exchange(ctx, m)
+		}()
+	}
+	wg.Wait()
+	return replies, errs
+}
+
+// hasType returns true if the answer section of m has records of type qtype.
+func hasType(m *Msg, qtype uint16) bool {
+	for _, rr := range m.Answer {
+		if RRToType(rr) == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// answers returns the RRs of type T from the answer section of m. A nil m, the reply of a failed query, has
+// none.
+func answers[T RR](m *Msg) []T {
+	if m == nil {
+		return nil
+	}
+	var rrs []T
+	for _, rr := range m.Answer {
+		if t, ok := rr.(T); ok {
+			rrs = append(rrs, t)
+		}
+	}
+	return rrs
+}
@@ -0,0 +1,162 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	dnsconf "github.com/miekg/dnsv2/dnsconf"
+)
+
+func TestResolverFailover(t *testing.T) {
+	addr := serveLocal(t, "127.0.0.1:0", func(network string, req *Msg) *Msg {
+		return &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true}, Question: req.Question}
+	})
+	_, port, _ := net.SplitHostPort(addr)
+	serveLocal(t, net.JoinHostPort("127.0.0.3", port), func(network string, req *Msg) *Msg {
+		return &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true, Rcode: RcodeServerFailure}, Question: req.Question}
+	})
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+	m.Question = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+	m.Pack()
+
+	// 127.0.0.2 has nothing listening, 127.0.0.3 returns SERVFAIL.
+	conf := &dnsconf.Config{Servers: []string{"127.0.0.2", "127.0.0.3", "127.0.0.1"}, Port: port, Timeout: 1, Attempts: 2}
+	r, err := NewResolver(conf).Exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != RcodeSuccess {
+		t.Errorf("expected rcode %s, got %s", RcodeToString[RcodeSuccess], RcodeToString[r.Rcode])
+	}
+
+	conf.Servers = conf.Servers[:2]
+	r, err = NewResolver(conf).Exchange(context.Background(), m)
+	rerr := &ResolverError{}
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected ResolverError, got %v", err)
+	}
+	if len(rerr.Errors) != 2 {
+		t.Fatalf("expected %d server errors, got %d: %s", 2, len(rerr.Errors), err)
+	}
+	if rerr.Errors[0].Server != net.JoinHostPort("127.0.0.2", port) {
+		t.Errorf("expected first failure from %s, got %s", "127.0.0.2", rerr.Errors[0].Server)
+	}
+	if r == nil || r.Rcode != RcodeServerFailure {
+		t.Errorf("expected last SERVFAIL reply to be returned")
+	}
+}
+
+func TestResolverSearch(t *testing.T) {
+	addr := serveLocal(t, "127.0.0.1:0", func(network string, req *Msg) *Msg {
+		r := new(Msg).SetReply(req)
+		q := req.Question[0]
+		name, qtype := q.Header().Name, RRToType(q)
+		hdr := Header{Name: name, Class: ClassINET, TTL: 3600}
+		switch name {
+		case "www.b.test.":
+			if qtype == TypeA {
+				r.Answer = []RR{&A{Hdr: hdr, A: net.IPv4(192, 0, 2, 1)}}
+			}
+		case "v4.b.test.": // AAAA queries time out
+			if qtype == TypeAAAA {
+				return nil
+			}
+			r.Answer = []RR{&A{Hdr: hdr, A: net.IPv4(192, 0, 2, 4)}}
+		case "v6.b.test.": // A queries time out
+			if qtype == TypeA {
+				return nil
+			}
+			r.Answer = []RR{&AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::6")}}
+		case "mail.a.test.": // exists, NODATA for all types
+		case "b.test.":
+			switch qtype {
+			case TypeMX:
+				r.Answer = []RR{&MX{Hdr: hdr, Preference: 20, Mx: "mx2.b.test."}, &MX{Hdr: hdr, Preference: 10, Mx: "mx1.b.test."}}
+			case TypeTXT:
+				r.Answer = []RR{&TXT{Hdr: hdr, Txt: []string{"v=spf1 -all"}}}
+			}
+		case "_sip._udp.b.test.":
+			if qtype == TypeSRV {
+				r.Answer = []RR{
+					&SRV{Hdr: hdr, Priority: 10, Weight: 5, Port: 5060, Target: "sip2.b.test."},
+					&SRV{Hdr: hdr, Priority: 10, Weight: 50, Port: 5060, Target: "sip1.b.test."},
+				}
+			}
+		case "fail.a.test.":
+			r.Rcode = RcodeServerFailure
+		default:
+			r.Rcode = RcodeNameError
+		}
+		return r
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	res := NewResolver(&dnsconf.Config{Servers: []string{host}, Port: port, Search: []string{"a.test", "b.test"}, Ndots: 1, Timeout: 1, Attempts: 1})
+	ctx := context.Background()
+
+	rrs, err := res.LookupHost(ctx, "www")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 || rrs[0].(*A).Hdr.Name != "www.b.test." {
+		t.Errorf("expected A record for www.b.test., got %v", rrs)
+	}
+
+	// One of the types timing out still returns the records of the other.
+	if rrs, err := res.LookupHost(ctx, "v4"); err != nil || len(rrs) != 1 {
+		t.Errorf("expected A record for v4.b.test., got %v, %v", rrs, err)
+	}
+	if rrs, err := res.LookupHost(ctx, "v6"); err != nil || len(rrs) != 1 {
+		t.Errorf("expected AAAA record for v6.b.test., got %v, %v", rrs, err)
+	}
+
+	if _, err := res.LookupHost(ctx, "mail"); !errors.Is(err, ErrNoData) {
+		t.Errorf("expected %v, got %v", ErrNoData, err)
+	}
+	if _, err := res.LookupHost(ctx, "none"); !errors.Is(err, ErrNXDomain) {
+		t.Errorf("expected %v, got %v", ErrNXDomain, err)
+	}
+	if _, err := res.LookupHost(ctx, "fail"); !errors.As(err, new(*ResolverError)) {
+		t.Errorf("expected ResolverError for SERVFAIL, got %v", err)
+	}
+	if _, err := res.LookupHost(ctx, "www.a.test."); !errors.Is(err, ErrNXDomain) {
+		t.Errorf("expected fully qualified name not to be expanded, got %v", err)
+	}
+
+	mxs, err := res.LookupMX(ctx, "b.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mxs) != 2 || mxs[0].Mx != "mx1.b.test." {
+		t.Errorf("expected MX records sorted by preference, got %v", mxs)
+	}
+	srvs, err := res.LookupSRV(ctx, "sip", "udp", "b.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 2 || srvs[0].Weight+srvs[1].Weight != 55 {
+		t.Errorf("expected 2 SRV records, got %v", srvs)
+	}
+	txts, err := res.LookupTXT(ctx, "b.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txts) != 1 || txts[0].Txt[0] != "v=spf1 -all" {
+		t.Errorf("expected TXT record, got %v", txts)
+	}
+}
+
+func TestShuffleByWeight(t *testing.T) {
+	first := map[uint16]int{}
+	for range 1000 {
+		srvs := []*SRV{{Weight: 50}, {Weight: 5}, {Weight: 0}}
+		shuffleByWeight(srvs)
+		first[srvs[0].Weight]++
+	}
+	// The chances are 50/56, 5/56 and 1/56.
+	if first[50] < first[5] || first[5] < first[0] || first[0] == 0 {
+		t.Errorf("expected each record to be picked first, by weight, got %v", first)
+	}
+}
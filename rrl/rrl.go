@@ -0,0 +1,298 @@
+// Package rrl implements Response Rate Limiting (RRL) for authoritative servers, as done by BIND. RRL limits
+// the rate of identical responses sent to a client network, which makes a server much less useful for
+// reflection and amplification attacks with spoofed source addresses.
+//
+// Responses are accounted in buckets keyed on the network of the client, the question name and type, and
+// the class of the response. NXDOMAIN responses are accounted to the zone instead of the question name, so
+// that random names do not each get their own bucket, and errors are accounted to the client network
+// alone. When a bucket runs out, its responses are dropped, except that every Slip-th one is replaced by a
+// truncated response without records: a real client will retry over TCP, which is not rate limited.
+//
+// An RRL is attached to a Server as middleware:
+//
+//	limiter := &rrl.RRL{ResponsesPerSecond: 5}
+//	srv := &dns.Server{Handler: h, Middleware: []dns.Middleware{limiter.Handler}}
+package rrl
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dnsv2"
+)
+
+const (
+	// DefaultWindow is the default time over which the rate of responses is averaged.
+	DefaultWindow = 15 * time.Second
+	// DefaultSlip is the default ratio of limited responses that are sent truncated instead of dropped.
+	DefaultSlip = 2
+	// DefaultIPv4PrefixLength is the default length of the prefix that groups IPv4 clients.
+	DefaultIPv4PrefixLength = 24
+	// DefaultIPv6PrefixLength is the default length of the prefix that groups IPv6 clients.
+	DefaultIPv6PrefixLength = 56
+)
+
+// Action is what to do with a response, see RRL.Action.
+type Action int
+
+const (
+	Send Action = iota // Send the response.
+	Drop               // Drop the response.
+	Slip               // Send a truncated response without records instead of the response.
+)
+
+// RRL is a response rate limiter. The zero RRL does not limit anything, ResponsesPerSecond must be set. An
+// RRL is safe for concurrent use.
+type RRL struct {
+	// ResponsesPerSecond is the number of responses a client network gets each second for a name and type.
+	// If zero, responses are not limited.
+	ResponsesPerSecond int
+	// NXDomainsPerSecond is the number of NXDOMAIN responses a client network gets each second for a zone.
+	// If zero, ResponsesPerSecond is used.
+	NXDomainsPerSecond int
+	// ErrorsPerSecond is the number of error responses, such as REFUSED and SERVFAIL, a client network gets
+	// each second. If zero, ResponsesPerSecond is used.
+	ErrorsPerSecond int
+	// Window is the time over which the rate of responses is averaged: a client network that has been
+	// limited is let through again when it has stayed below the rate for this long. If zero, DefaultWindow is
+	// used.
+	Window time.Duration
+	// Slip is the ratio of limited responses that are sent truncated: 1 sends all of them truncated, 2 every
+	// other one and so on, the others are dropped. If zero, DefaultSlip is used. If negative, all limited
+	// responses are dropped.
+	Slip int
+	// IPv4PrefixLength is the length of the prefix that groups IPv4 clients in the same bucket, if zero
+	// DefaultIPv4PrefixLength is used. A length over 32 is taken as 32.
+	IPv4PrefixLength int
+	// IPv6PrefixLength is the length of the prefix that groups IPv6 clients in the same bucket, if zero
+	// DefaultIPv6PrefixLength is used. A length over 128 is taken as 128.
+	IPv6PrefixLength int
+	// Exempt holds the prefixes of the clients that are never limited.
+	Exempt []netip.Prefix
+
+	mu      sync.Mutex
+	buckets map[key]*bucket
+	swept   time.Time // when idle buckets were last removed
+
+	now func() time.Time // for testing
+}
+
+type class uint8
+
+const (
+	classResponse class = iota
+	classNXDomain
+	classError
+)
+
+type key struct {
+	prefix netip.Prefix
+	name   string
+	qtype  uint16
+	class  class
+}
+
+// bucket is a token bucket, it gets rate tokens each second and a response takes one.
+type bucket struct {
+	balance float64
+	last    time.Time // when the balance was last updated
+	limited int       // number of limited responses, for slipping
+}
+
+// Action returns what to do with the response m to the client with address addr.
+func (r *RRL) Action(addr netip.Addr, m *dns.Msg) Action {
+	addr = addr.Unmap()
+	for _, p := range r.Exempt {
+		if p.Contains(addr) {
+			return Send
+		}
+	}
+	k := r.keyOf(addr, m)
+	rate := float64(r.rate(k.class))
+	if rate <= 0 {
+		return Send
+	}
+
+	now := r.clock()
+	window := r.window()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweep(now, window)
+	b, ok := r.buckets[k]
+	if !ok {
+		if r.buckets == nil {
+			r.buckets = map[key]*bucket{}
+		}
+		b = &bucket{balance: rate, last: now}
+		r.buckets[k] = b
+	}
+	b.balance = min(rate, b.balance+now.Sub(b.last).Seconds()*rate) - 1
+	b.last = now
+	if b.balance >= 0 {
+		b.limited = 0
+		return Send
+	}
+
+	b.balance = max(b.balance, -rate*window.Seconds())
+	slip := r.slip()
+	if slip < 0 {
+		return Drop
+	}
+	b.limited++
+	if b.limited%slip == 0 {
+		return Slip
+	}
+	return Drop
+}
+
+// Handler returns a handler that rate limits the responses next writes to clients over UDP, responses over
+// other networks are not limited. Handler is a dns.Middleware.
+func (r *RRL) Handler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+		if info := dns.ContextConnInfo(ctx); info != nil && info.Network != "udp" {
+			next.ServeDNS(ctx, w, req)
+			return
+		}
+		next.ServeDNS(ctx, &writer{ResponseWriter: w, rrl: r, req: req}, req)
+	})
+}
+
+// writer is the ResponseWriter given to the handler by RRL.Handler.
+type writer struct {
+	dns.ResponseWriter
+	rrl *RRL
+	req *dns.Msg
+}
+
+func (w *writer) WriteMsg(m *dns.Msg) error {
+	switch w.rrl.Action(remoteAddr(w.RemoteAddr()), m) {
+	case Drop:
+		return nil
+	case Slip:
+		return w.ResponseWriter.WriteMsg(truncated(w.req))
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	m := &dns.Msg{Data: b}
+	if m.Unpack() != nil {
+		return w.ResponseWriter.Write(b)
+	}
+	switch w.rrl.Action(remoteAddr(w.RemoteAddr()), m) {
+	case Drop:
+		return len(b), nil
+	case Slip:
+		return len(b), w.ResponseWriter.WriteMsg(truncated(w.req))
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// truncated returns the truncated response without records that is sent instead of a limited response.
+func truncated(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg).SetReply(req)
+	m.Truncated = true
+	m.UDPSize = req.UDPSize
+	return m
+}
+
+func (r *RRL) keyOf(addr netip.Addr, m *dns.Msg) key {
+	bits := r.IPv6PrefixLength
+	if bits == 0 {
+		bits = DefaultIPv6PrefixLength
+	}
+	if addr.Is4() {
+		bits = r.IPv4PrefixLength
+		if bits == 0 {
+			bits = DefaultIPv4PrefixLength
+		}
+	}
+	// An invalid length would give the zero prefix, with all clients in the same bucket.
+	prefix, _ := addr.Prefix(min(max(bits, 0), addr.BitLen()))
+	k := key{prefix: prefix}
+
+	switch m.Rcode {
+	case dns.RcodeSuccess:
+		k.class = classResponse
+	case dns.RcodeNameError:
+		k.class = classNXDomain
+	default:
+		k.class = classError
+		return k
+	}
+	if len(m.Question) > 0 {
+		k.name = strings.ToLower(m.Question[0].Header().Name)
+		k.qtype = dns.RRToType(m.Question[0])
+	}
+	if k.class == classNXDomain {
+		k.qtype = 0
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				k.name = strings.ToLower(soa.Hdr.Name)
+				break
+			}
+		}
+	}
+	return k
+}
+
+// sweep removes the buckets that have been idle for longer than the window, these are full again. It is
+// called with r.mu held.
+func (r *RRL) sweep(now time.Time, window time.Duration) {
+	if now.Sub(r.swept) < window {
+		return
+	}
+	for k, b := range r.buckets {
+		if now.Sub(b.last) > window {
+			delete(r.buckets, k)
+		}
+	}
+	r.swept = now
+}
+
+func remoteAddr(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr()
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap.Addr()
+}
+
+func (r *RRL) rate(c class) int {
+	switch {
+	case c == classNXDomain && r.NXDomainsPerSecond != 0:
+		return r.NXDomainsPerSecond
+	case c == classError && r.ErrorsPerSecond != 0:
+		return r.ErrorsPerSecond
+	}
+	return r.ResponsesPerSecond
+}
+
+func (r *RRL) window() time.Duration {
+	if r.Window != 0 {
+		return r.Window
+	}
+	return DefaultWindow
+}
+
+func (r *RRL) slip() int {
+	if r.Slip != 0 {
+		return r.Slip
+	}
+	return DefaultSlip
+}
+
+func (r *RRL) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,136 @@
+package rrl
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dnsv2"
+)
+
+// newRRL sets up r with a fake clock, the returned function advances it.
+func newRRL(r *RRL) (*RRL, func(time.Duration)) {
+	now := time.Unix(1700000000, 0)
+	r.now = func() time.Time { return now }
+	return r, func(d time.Duration) { now = now.Add(d) }
+}
+
+func reply(name string, qtype, rcode uint16, ns ...dns.RR) *dns.Msg {
+	q := dns.TypeToRR[qtype]()
+	*q.Header() = dns.Header{Name: name, Class: dns.ClassINET}
+	return &dns.Msg{MsgHeader: dns.MsgHeader{ID: dns.ID(), Response: true, Rcode: rcode}, Question: []dns.RR{q}, Ns: ns}
+}
+
+func actions(r *RRL, addr string, m *dns.Msg, n int) []Action {
+	var a []Action
+	for range n {
+		a = append(a, r.Action(netip.MustParseAddr(addr), m))
+	}
+	return a
+}
+
+func TestRRL(t *testing.T) {
+	r, advance := newRRL(&RRL{ResponsesPerSecond: 2, Window: 5 * time.Second})
+	m := reply("www.example.org.", dns.TypeA, dns.RcodeSuccess)
+
+	if a := actions(r, "192.0.2.1", m, 6); !slices.Equal(a, []Action{Send, Send, Drop, Slip, Drop, Slip}) {
+		t.Errorf("expected two responses to be sent and the rest to slip every other one, got %v", a)
+	}
+	// Same /24, same bucket.
+	if a := r.Action(netip.MustParseAddr("192.0.2.200"), m); a == Send {
+		t.Errorf("expected client in the same network to be limited")
+	}
+	if a := actions(r, "198.51.100.1", m, 2); !slices.Equal(a, []Action{Send, Send}) {
+		t.Errorf("expected client in another network not to be limited, got %v", a)
+	}
+	if a := r.Action(netip.MustParseAddr("192.0.2.1"), reply("www.example.org.", dns.TypeAAAA, dns.RcodeSuccess)); a != Send {
+		t.Errorf("expected another type not to be limited, got %v", a)
+	}
+
+	// The balance went negative, it takes more than a second to be allowed again.
+	advance(time.Second)
+	if a := r.Action(netip.MustParseAddr("192.0.2.1"), m); a == Send {
+		t.Errorf("expected client to still be limited after a second")
+	}
+	advance(5 * time.Second)
+	if a := r.Action(netip.MustParseAddr("192.0.2.1"), m); a != Send {
+		t.Errorf("expected client to be let through after the window, got %v", a)
+	}
+}
+
+func TestRRLNXDomain(t *testing.T) {
+	r, _ := newRRL(&RRL{ResponsesPerSecond: 10, NXDomainsPerSecond: 1, Slip: -1})
+	soa := &dns.SOA{Hdr: dns.Header{Name: "example.org.", Class: dns.ClassINET}, Ns: "ns.example.org.", Mbox: "admin.example.org."}
+
+	addr := netip.MustParseAddr("2001:db8::1")
+	if a := r.Action(addr, reply("a.example.org.", dns.TypeA, dns.RcodeNameError, soa)); a != Send {
+		t.Errorf("expected first NXDOMAIN to be sent, got %v", a)
+	}
+	// Random names in the same zone share the bucket of the zone, the /56 is shared too.
+	if a := r.Action(netip.MustParseAddr("2001:db8:0:ff::1"), reply("b.example.org.", dns.TypeMX, dns.RcodeNameError, soa)); a != Drop {
+		t.Errorf("expected NXDOMAIN for another name in the zone to be dropped, got %v", a)
+	}
+	if a := r.Action(addr, reply("a.example.org.", dns.TypeA, dns.RcodeSuccess)); a != Send {
+		t.Errorf("expected positive response to be sent, got %v", a)
+	}
+}
+
+func TestRRLExempt(t *testing.T) {
+	r, _ := newRRL(&RRL{ResponsesPerSecond: 1, Exempt: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}})
+	m := reply("www.example.org.", dns.TypeA, dns.RcodeRefused)
+	if a := actions(r, "::ffff:192.0.2.1", m, 3); !slices.Equal(a, []Action{Send, Send, Send}) {
+		t.Errorf("expected exempt client not to be limited, got %v", a)
+	}
+	if a := actions(r, "198.51.100.1", m, 2); !slices.Equal(a, []Action{Send, Drop}) {
+		t.Errorf("expected errors to be limited, got %v", a)
+	}
+}
+
+func TestRRLPrefixLength(t *testing.T) {
+	r, _ := newRRL(&RRL{ResponsesPerSecond: 1, Slip: -1, IPv4PrefixLength: 40})
+	m := reply("www.example.org.", dns.TypeA, dns.RcodeSuccess)
+	for _, addr := range []string{"192.0.2.1", "198.51.100.1"} {
+		if a := r.Action(netip.MustParseAddr(addr), m); a != Send {
+			t.Errorf("expected %s to have its own bucket, got %v", addr, a)
+		}
+	}
+}
+
+type recorder struct {
+	dns.ResponseWriter
+	written []*dns.Msg
+}
+
+func (w *recorder) RemoteAddr() net.Addr { return &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53} }
+
+func (w *recorder) WriteMsg(m *dns.Msg) error {
+	w.written = append(w.written, m)
+	return nil
+}
+
+func TestRRLHandler(t *testing.T) {
+	r, _ := newRRL(&RRL{ResponsesPerSecond: 1, Slip: 1})
+	h := r.Handler(dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg).SetReply(req)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.Header{Name: "www.example.org.", Class: dns.ClassINET}, A: net.ParseIP("192.0.2.53")}}
+		w.WriteMsg(m)
+	}))
+
+	req := reply("www.example.org.", dns.TypeA, dns.RcodeSuccess)
+	req.Response = false
+	w := &recorder{}
+	for range 2 {
+		h.ServeDNS(dns.NewConnInfoContext(context.Background(), &dns.ConnInfo{Network: "udp"}), w, req)
+	}
+	if len(w.written) != 2 || len(w.written[0].Answer) != 1 || !w.written[1].Truncated || len(w.written[1].Answer) != 0 {
+		t.Fatalf("expected a response and a truncated one, got %v", w.written)
+	}
+
+	h.ServeDNS(dns.NewConnInfoContext(context.Background(), &dns.ConnInfo{Network: "tcp"}), w, req)
+	if len(w.written) != 3 || w.written[2].Truncated {
+		t.Errorf("expected response over TCP not to be limited, got %v", w.written[2:])
+	}
+}
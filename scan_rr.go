@@ -1828,6 +1828,11 @@ func (rr *TKEY) parse(c *zlexer, o string) *ParseError {
 	return nil
 }
 
+func (rr *TSIG) parse(c *zlexer, o string) *ParseError {
+	l, _ := c.Next()
+	return &ParseError{"", "TSIG records do not have a presentation format", l}
+}
+
 func (rr *APL) parse(c *zlexer, o string) *ParseError {
 	var prefixes []APLPrefix
 
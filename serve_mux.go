@@ -1,9 +1,10 @@
-//go:build ignore
-
 package dns
 
 import (
+	"context"
 	"sync"
+
+	"github.com/miekg/dnsv2/dnsutil"
 )
 
 // ServeMux is an DNS request multiplexer. It matches the zone name of
@@ -37,10 +38,10 @@ func (mux *ServeMux) match(q string, t uint16) Handler {
 		return nil
 	}
 
-	q = CanonicalName(q)
+	q = dnsutil.Canonical(q)
 
 	var handler Handler
-	for off, end := 0, false; !end; off, end = NextLabel(q, off) {
+	for off, end := 0, false; !end; off, end = dnsutil.Next(q, off) {
 		if h, ok := mux.z[q[off:]]; ok {
 			if t != TypeDS {
 				return h
@@ -58,8 +59,8 @@ func (mux *ServeMux) match(q string, t uint16) Handler {
 	return handler
 }
 
-// Handle adds a handler to the ServeMux for pattern.
-func (mux *ServeMux) Handle(pattern string, handler Handler) {
+// Handle adds a handler to the ServeMux for pattern. The handler is wrapped in middleware, see Chain.
+func (mux *ServeMux) Handle(pattern string, handler Handler, middleware ...Middleware) {
 	if pattern == "" {
 		panic("dns: invalid pattern " + pattern)
 	}
@@ -67,13 +68,14 @@ func (mux *ServeMux) Handle(pattern string, handler Handler) {
 	if mux.z == nil {
 		mux.z = make(map[string]Handler)
 	}
-	mux.z[CanonicalName(pattern)] = handler
+	mux.z[dnsutil.Canonical(pattern)] = Chain(handler, middleware...)
 	mux.m.Unlock()
 }
 
-// HandleFunc adds a handler function to the ServeMux for pattern.
-func (mux *ServeMux) HandleFunc(pattern string, handler func(ResponseWriter, *Msg)) {
-	mux.Handle(pattern, HandlerFunc(handler))
+// HandleFunc adds a handler function to the ServeMux for pattern. The handler is wrapped in middleware, see
+// Chain.
+func (mux *ServeMux) HandleFunc(pattern string, handler func(context.Context, ResponseWriter, *Msg), middleware ...Middleware) {
+	mux.Handle(pattern, HandlerFunc(handler), middleware...)
 }
 
 // HandleRemove deregisters the handler specific for pattern from the ServeMux.
@@ -82,7 +84,7 @@ func (mux *ServeMux) HandleRemove(pattern string) {
 		panic("dns: invalid pattern " + pattern)
 	}
 	mux.m.Lock()
-	delete(mux.z, CanonicalName(pattern))
+	delete(mux.z, dnsutil.Canonical(pattern))
 	mux.m.Unlock()
 }
 
@@ -95,23 +97,25 @@ func (mux *ServeMux) HandleRemove(pattern string) {
 //
 // If no handler is found, or there is no question, a standard REFUSED
 // message is returned
-func (mux *ServeMux) ServeDNS(w ResponseWriter, req *Msg) {
+func (mux *ServeMux) ServeDNS(ctx context.Context, w ResponseWriter, req *Msg) {
 	var h Handler
 	if len(req.Question) >= 1 { // allow more than one question
-		h = mux.match(req.Question[0].Name, req.Question[0].Qtype)
+		h = mux.match(req.Question[0].Header().Name, RRToType(req.Question[0]))
 	}
 
 	if h != nil {
-		h.ServeDNS(w, req)
+		h.ServeDNS(ctx, w, req)
 	} else {
-		handleRefused(w, req)
+		handleRefused(ctx, w, req)
 	}
 }
 
 // Handle registers the handler with the given pattern
 // in the DefaultServeMux. The documentation for
 // ServeMux explains how patterns are matched.
-func Handle(pattern string, handler Handler) { DefaultServeMux.Handle(pattern, handler) }
+func Handle(pattern string, handler Handler, middleware ...Middleware) {
+	DefaultServeMux.Handle(pattern, handler, middleware...)
+}
 
 // HandleRemove deregisters the handle with the given pattern
 // in the DefaultServeMux.
@@ -119,6 +123,6 @@ func HandleRemove(pattern string) { DefaultServeMux.HandleRemove(pattern) }
 
 // HandleFunc registers the handler function with the given pattern
 // in the DefaultServeMux.
-func HandleFunc(pattern string, handler func(ResponseWriter, *Msg)) {
-	DefaultServeMux.HandleFunc(pattern, handler)
+func HandleFunc(pattern string, handler func(context.Context, ResponseWriter, *Msg), middleware ...Middleware) {
+	DefaultServeMux.HandleFunc(pattern, handler, middleware...)
 }
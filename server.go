@@ -1,72 +1,32 @@
-//go:build ignore
-
 package dns
 
+// A DNS server implementation, modelled after http.Server.
+
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"io"
 	"net"
+	"net/netip"
 	"strings"
 	"sync"
 	"time"
-
-	"golang.org/x/crypto/cryptobyte"
 )
 
-// Default maximum number of TCP queries before we close the socket.
-const maxTCPQueries = 128
+const (
+	maxTCPQueries  = 128             // Default maximum number of TCP queries before we close the socket.
+	dnsTimeout     = 2 * time.Second // Default read and write timeout.
+	tcpIdleTimeout = 8 * time.Second // Default TCP idle timeout, RFC 7766.
+)
 
 // aLongTimeAgo is a non-zero time, far in the past, used for
 // immediate cancellation of network operations.
 var aLongTimeAgo = time.Unix(1, 0)
 
-// Handler is implemented by any value that implements ServeDNS.
-type Handler interface {
-	ServeDNS(w ResponseWriter, r *Msg)
-}
-
-// The HandlerFunc type is an adapter to allow the use of
-// ordinary functions as DNS handlers.  If f is a function
-// with the appropriate signature, HandlerFunc(f) is a
-// Handler object that calls f.
-type HandlerFunc func(ResponseWriter, *Msg)
-
-// ServeDNS calls f(w, r).
-func (f HandlerFunc) ServeDNS(w ResponseWriter, r *Msg) {
-	f(w, r)
-}
-
-// A ResponseWriter interface is used by an DNS handler to
-// construct an DNS response.
-type ResponseWriter interface {
-	// LocalAddr returns the net.Addr of the server
-	LocalAddr() net.Addr
-	// RemoteAddr returns the net.Addr of the client that sent the current request.
-	RemoteAddr() net.Addr
-	// WriteMsg writes a reply back to the client.
-	WriteMsg(*Msg) error
-	// Write writes a raw buffer back to the client.
-	Write([]byte) (int, error)
-	// Close closes the connection.
-	Close() error
-	// TsigStatus returns the status of the Tsig.
-	TsigStatus() error
-	// TsigTimersOnly sets the tsig timers only boolean.
-	TsigTimersOnly(bool)
-	// Hijack lets the caller take over the connection.
-	// After a call to Hijack(), the DNS package will not do anything with the connection.
-	Hijack()
-}
-
-// A ConnectionStater interface is used by a DNS Handler to access TLS connection state
-// when available.
-type ConnectionStater interface {
-	ConnectionState() *tls.ConnectionState
-}
-
+// response implements ResponseWriter for the UDP, TCP and DNS over TLS connections of a Server.
 type response struct {
 	closed         bool // connection has been closed
 	hijacked       bool // connection has been hijacked by handler
@@ -74,23 +34,18 @@ type response struct {
 	tsigStatus     error
 	tsigRequestMAC string
 	tsigProvider   TsigProvider
+	udpSize        int            // buffer size of the requester, zero when it has no EDNS
 	udp            net.PacketConn // i/o connection if UDP was used
 	tcp            net.Conn       // i/o connection if TCP was used
 	udpSession     *SessionUDP    // oob data to get egress interface right
 	pcSession      net.Addr       // address to use when writing to a generic net.PacketConn
+	proxy          *ProxyHeader   // PROXY protocol header of the connection or datagram
 	writer         Writer         // writer to output the raw DNS bits
 }
 
-// handleRefused returns a HandlerFunc that returns REFUSED for every request it gets.
-func handleRefused(w ResponseWriter, r *Msg) {
-	m := new(Msg)
-	m.SetRcode(r, RcodeRefused)
-	w.WriteMsg(m)
-}
-
 // HandleFailed returns a HandlerFunc that returns SERVFAIL for every request it gets.
 // Deprecated: This function is going away.
-func HandleFailed(w ResponseWriter, r *Msg) {
+func HandleFailed(ctx context.Context, w ResponseWriter, r *Msg) {
 	m := new(Msg)
 	m.SetRcode(r, RcodeServerFailure)
 	// does not matter if this write fails
@@ -192,7 +147,7 @@ type DecorateWriter func(Writer) Writer
 
 // A Server defines parameters for running an DNS server.
 type Server struct {
-	// Address to listen on, ":dns" if empty.
+	// Address to listen on, ":domain" if empty.
 	Addr string
 	// if "tcp" or "tcp-tls" (DNS over TLS) it will invoke a TCP listener, otherwise an UDP one
 	Net string
@@ -204,14 +159,19 @@ type Server struct {
 	PacketConn net.PacketConn
 	// Handler to invoke, dns.DefaultServeMux if nil.
 	Handler Handler
+	// Middleware the handler is wrapped in, the first is the outermost one. See Chain.
+	Middleware []Middleware
 	// Default buffer size to use to read incoming UDP messages. If not set
 	// it defaults to MinMsgSize (512 B).
 	UDPSize int
 	// The net.Conn.SetReadTimeout value for new connections, defaults to 2 * time.Second.
 	ReadTimeout time.Duration
-	// The net.Conn.SetWriteTimeout value for new connections, defaults to 2 * time.Second.
+	// The net.Conn.SetWriteTimeout value for new connections, defaults to 2 * time.Second. It is also the
+	// time a handler has to write its reply: the context given to the handler has this as its deadline.
+	// Handlers that query other servers, like a recursor.Recursor, need more time than the default and are
+	// cut off by it; raise WriteTimeout for them.
 	WriteTimeout time.Duration
-	// TCP idle timeout for multiple queries, if nil, defaults to 8 * time.Second (RFC 5966).
+	// TCP idle timeout for multiple queries, if nil, defaults to 8 * time.Second (RFC 7766).
 	IdleTimeout func() time.Duration
 	// An implementation of the TsigProvider interface. If defined it replaces TsigSecret and is used for all TSIG operations.
 	TsigProvider TsigProvider
@@ -219,18 +179,26 @@ type Server struct {
 	TsigSecret map[string]string
 	// If NotifyStartedFunc is set it is called once the server has started listening.
 	NotifyStartedFunc func()
-	// DecorateReader is optional, allows customization of the process that reads raw DNS messages.
-	DecorateReader DecorateReader
-	// DecorateWriter is optional, allows customization of the process that writes raw DNS messages.
-	DecorateWriter DecorateWriter
 	// Maximum number of TCP queries before we close the socket. Default is maxTCPQueries (unlimited if -1).
 	MaxTCPQueries int
 	// Whether to set the SO_REUSEPORT socket option, allowing multiple listeners to be bound to a single address.
 	// It is only supported on certain GOOSes and when using ListenAndServe.
 	ReusePort bool
-	// AcceptMsgFunc will check the incoming message and will reject it early in the process.
-	// By default DefaultMsgAcceptFunc will be used.
-	MsgAcceptFunc MsgAcceptFunc
+	// DecorateReader is optional, allows customization of the process that reads raw DNS messages. With
+	// ProxyTrusted, a UDP message that is read still starts with the PROXY protocol header.
+	DecorateReader DecorateReader
+	// DecorateWriter is optional, allows customization of the process that writes raw DNS messages.
+	DecorateWriter DecorateWriter
+	// ProxyTrusted holds the prefixes of the load balancers that relay the addresses of their clients with the
+	// PROXY protocol. TCP connections from these addresses must start with a version 1 or 2 header and UDP
+	// datagrams with a version 2 header, otherwise they are dropped. The addresses in the header are returned by
+	// the ResponseWriter's RemoteAddr and LocalAddr, and the header is in the ConnInfo given to the handler.
+	// Connections and datagrams from other addresses are served as is. For DNS over TLS the header precedes the
+	// TLS handshake, which is only supported with ListenAndServe.
+	ProxyTrusted []netip.Prefix
+
+	// The handler wrapped in the middleware.
+	handler Handler
 
 	// Shutdown handling
 	lock     sync.RWMutex
@@ -252,6 +220,25 @@ func (srv *Server) tsigProvider() TsigProvider {
 	return nil
 }
 
+// proxyTrusted returns true if addr is in ProxyTrusted.
+func (srv *Server) proxyTrusted(addr net.Addr) bool {
+	ip := addrOf(addr)
+	for _, p := range srv.ProxyTrusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyListener returns l with its connections from ProxyTrusted reading a PROXY protocol header first.
+func (srv *Server) proxyListener(l net.Listener) net.Listener {
+	if len(srv.ProxyTrusted) == 0 {
+		return l
+	}
+	return &proxyListener{Listener: l, trusted: srv.proxyTrusted}
+}
+
 func (srv *Server) isStarted() bool {
 	srv.lock.RLock()
 	started := srv.started
@@ -259,8 +246,8 @@ func (srv *Server) isStarted() bool {
 	return started
 }
 
-func makeUDPBuffer(size int) func() interface{} {
-	return func() interface{} {
+func makeUDPBuffer(size int) func() any {
+	return func() any {
 		return make([]byte, size)
 	}
 }
@@ -272,14 +259,16 @@ func (srv *Server) init() {
 	if srv.UDPSize == 0 {
 		srv.UDPSize = MinMsgSize
 	}
-	if srv.MsgAcceptFunc == nil {
-		srv.MsgAcceptFunc = DefaultMsgAcceptFunc
-	}
 	if srv.Handler == nil {
 		srv.Handler = DefaultServeMux
 	}
+	srv.handler = Chain(srv.Handler, srv.Middleware...)
 
-	srv.udpPool.New = makeUDPBuffer(srv.UDPSize)
+	size := srv.UDPSize
+	if len(srv.ProxyTrusted) > 0 {
+		size += proxyV2MaxLen // room for the PROXY protocol header in front of the message
+	}
+	srv.udpPool.New = makeUDPBuffer(size)
 }
 
 func unlockOnce(l sync.Locker) func() {
@@ -310,6 +299,7 @@ func (srv *Server) ListenAndServe() error {
 		if err != nil {
 			return err
 		}
+		l = srv.proxyListener(l)
 		srv.Listener = l
 		srv.started = true
 		unlock()
@@ -323,13 +313,17 @@ func (srv *Server) ListenAndServe() error {
 		if err != nil {
 			return err
 		}
-		l = tls.NewListener(l, srv.TLSConfig)
+		l = tls.NewListener(srv.proxyListener(l), srv.TLSConfig)
 		srv.Listener = l
 		srv.started = true
 		unlock()
 		return srv.serveTCP(l)
-	case "udp", "udp4", "udp6":
-		l, err := listenUDP(srv.Net, addr, srv.ReusePort)
+	case "", "udp", "udp4", "udp6":
+		network := srv.Net
+		if network == "" {
+			network = "udp"
+		}
+		l, err := listenUDP(network, addr, srv.ReusePort)
 		if err != nil {
 			return err
 		}
@@ -374,7 +368,7 @@ func (srv *Server) ActivateAndServe() error {
 	if srv.Listener != nil {
 		srv.started = true
 		unlock()
-		return srv.serveTCP(srv.Listener)
+		return srv.serveTCP(srv.proxyListener(srv.Listener))
 	}
 	return &Error{err: "bad listeners"}
 }
@@ -413,10 +407,6 @@ func (srv *Server) ShutdownContext(ctx context.Context) error {
 
 	srv.lock.Unlock()
 
-	if testShutdownNotify != nil {
-		testShutdownNotify.Broadcast()
-	}
-
 	var ctxErr error
 	select {
 	case <-srv.shutdown:
@@ -431,8 +421,6 @@ func (srv *Server) ShutdownContext(ctx context.Context) error {
 	return ctxErr
 }
 
-var testShutdownNotify *sync.Cond
-
 // getReadTimeout is a helper func to use system timeout if server did not intend to change it.
 func (srv *Server) getReadTimeout() time.Duration {
 	if srv.ReadTimeout != 0 {
@@ -441,6 +429,14 @@ func (srv *Server) getReadTimeout() time.Duration {
 	return dnsTimeout
 }
 
+// getWriteTimeout is a helper func to use system timeout if server did not intend to change it.
+func (srv *Server) getWriteTimeout() time.Duration {
+	if srv.WriteTimeout != 0 {
+		return srv.WriteTimeout
+	}
+	return dnsTimeout
+}
+
 // serveTCP starts a TCP listener for the server.
 func (srv *Server) serveTCP(l net.Listener) error {
 	defer l.Close()
@@ -481,6 +477,16 @@ func (srv *Server) serveTCP(l net.Listener) error {
 func (srv *Server) serveUDP(l net.PacketConn) error {
 	defer l.Close()
 
+	if srv.NotifyStartedFunc != nil {
+		srv.NotifyStartedFunc()
+	}
+
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		close(srv.shutdown)
+	}()
+
 	reader := Reader(defaultReader{srv})
 	if srv.DecorateReader != nil {
 		reader = srv.DecorateReader(reader)
@@ -492,16 +498,6 @@ func (srv *Server) serveUDP(l net.PacketConn) error {
 		return &Error{err: "PacketConnReader was not implemented on Reader returned from DecorateReader but is required for net.PacketConn"}
 	}
 
-	if srv.NotifyStartedFunc != nil {
-		srv.NotifyStartedFunc()
-	}
-
-	var wg sync.WaitGroup
-	defer func() {
-		wg.Wait()
-		close(srv.shutdown)
-	}()
-
 	rtimeout := srv.getReadTimeout()
 	// deadline is not used here
 	for srv.isStarted() {
@@ -525,10 +521,7 @@ func (srv *Server) serveUDP(l net.PacketConn) error {
 			}
 			return err
 		}
-		if len(m) < headerSize {
-			if cap(m) == srv.UDPSize {
-				srv.udpPool.Put(m[:srv.UDPSize])
-			}
+		if len(m) < MsgHeaderSize {
 			continue
 		}
 		wg.Add(1)
@@ -552,6 +545,11 @@ func (srv *Server) serveTCPConn(wg *sync.WaitGroup, rw net.Conn) {
 		reader = srv.DecorateReader(reader)
 	}
 
+	network := "tcp"
+	if _, ok := rw.(*tls.Conn); ok {
+		network = "tcp-tls"
+	}
+
 	idleTimeout := tcpIdleTimeout
 	if srv.IdleTimeout != nil {
 		idleTimeout = srv.IdleTimeout()
@@ -567,10 +565,12 @@ func (srv *Server) serveTCPConn(wg *sync.WaitGroup, rw net.Conn) {
 	for q := 0; (q < limit || limit == -1) && srv.isStarted(); q++ {
 		m, err := reader.ReadTCP(w.tcp, timeout)
 		if err != nil {
-			// TODO(tmthrgd): handle error
 			break
 		}
-		srv.serveDNS(m, w)
+		if w.proxy == nil {
+			w.proxy = proxyHeaderOf(rw)
+		}
+		srv.serveDNS(m, w, network)
 		if w.closed {
 			break // Close() was called
 		}
@@ -595,72 +595,55 @@ func (srv *Server) serveTCPConn(wg *sync.WaitGroup, rw net.Conn) {
 
 // Serve a new UDP request.
 func (srv *Server) serveUDPPacket(wg *sync.WaitGroup, m []byte, u net.PacketConn, udpSession *SessionUDP, pcSession net.Addr) {
+	defer wg.Done()
 	w := &response{tsigProvider: srv.tsigProvider(), udp: u, udpSession: udpSession, pcSession: pcSession}
 	if srv.DecorateWriter != nil {
 		w.writer = srv.DecorateWriter(w)
 	} else {
 		w.writer = w
 	}
-
-	srv.serveDNS(m, w)
-	wg.Done()
+	if len(srv.ProxyTrusted) > 0 && srv.proxyTrusted(w.RemoteAddr()) {
+		proxy, n, err := parseProxyV2(m)
+		if err != nil {
+			return
+		}
+		w.proxy, m = proxy, m[n:]
+	}
+	srv.serveDNS(m, w, "udp")
 }
 
-func (srv *Server) serveDNS(m []byte, w *response) {
-	s := cryptobyte.String(m)
-
-	var dh Header
-	if !dh.unpack(&s) {
+// serveDNS unpacks the request in m and calls the handler with it. A request that can not be unpacked gets a
+// FORMERR reply, unless it is a response, then it is dropped as is any other response.
+func (srv *Server) serveDNS(m []byte, w *response, network string) {
+	req := &Msg{Data: m}
+	if err := req.Unpack(); err != nil {
 		// Let client hang, they are sending crap; any reply can be used to amplify.
+		if len(m) < MsgHeaderSize || m[2]&0x80 != 0 {
+			return
+		}
+		r := &Msg{MsgHeader: MsgHeader{ID: binary.BigEndian.Uint16(m), Response: true, Opcode: m[2] >> 3 & 0xF, Rcode: RcodeFormatError}}
+		w.WriteMsg(r)
 		return
 	}
-
-	req := new(Msg)
-	req.setHdr(dh)
-
-	switch action := srv.MsgAcceptFunc(dh); action {
-	case MsgAccept:
-		if req.unpack(dh, s, m) == nil {
-			break
-		}
-
-		fallthrough
-	case MsgReject, MsgRejectNotImplemented:
-		opcode := req.Opcode
-		req.SetRcodeFormatError(req)
-		req.Zero = false
-		if action == MsgRejectNotImplemented {
-			req.Opcode = opcode
-			req.Rcode = RcodeNotImplemented
-		}
-
-		// Are we allowed to delete any OPT records here?
-		req.Ns, req.Answer, req.Extra = nil, nil, nil
-
-		w.WriteMsg(req)
-		fallthrough
-	case MsgIgnore:
-		if w.udp != nil && cap(m) == srv.UDPSize {
-			srv.udpPool.Put(m[:srv.UDPSize])
-		}
-
+	if req.Response {
 		return
 	}
 
+	w.udpSize = int(req.UDPSize)
 	w.tsigStatus = nil
 	if w.tsigProvider != nil {
-		if t := req.IsTsig(); t != nil {
-			w.tsigStatus = TsigVerifyWithProvider(m, w.tsigProvider, "", false)
+		if t := req.tsig(); t != nil {
+			w.tsigStatus = TsigVerifyWithProvider(req, w.tsigProvider, "", false)
 			w.tsigTimersOnly = false
 			w.tsigRequestMAC = t.MAC
 		}
 	}
 
-	if w.udp != nil && cap(m) == srv.UDPSize {
-		srv.udpPool.Put(m[:srv.UDPSize])
-	}
+	info := &ConnInfo{Network: network, LocalAddr: w.LocalAddr(), RemoteAddr: w.RemoteAddr(), TLS: w.ConnectionState(), Proxy: w.proxy}
+	ctx, cancel := context.WithTimeout(NewConnInfoContext(context.Background(), info), srv.getWriteTimeout())
+	defer cancel()
 
-	srv.Handler.ServeDNS(w, req) // Writes back to the client
+	srv.handler.ServeDNS(ctx, w, req) // Writes back to the client
 }
 
 func (srv *Server) readTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
@@ -696,13 +679,12 @@ func (srv *Server) readUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *S
 	srv.lock.RUnlock()
 
 	m := srv.udpPool.Get().([]byte)
+	defer srv.udpPool.Put(m)
 	n, s, err := ReadFromSessionUDP(conn, m)
 	if err != nil {
-		srv.udpPool.Put(m)
 		return nil, nil, err
 	}
-	m = m[:n]
-	return m, s, nil
+	return bytes.Clone(m[:n]), s, nil
 }
 
 func (srv *Server) readPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
@@ -714,40 +696,89 @@ func (srv *Server) readPacketConn(conn net.PacketConn, timeout time.Duration) ([
 	srv.lock.RUnlock()
 
 	m := srv.udpPool.Get().([]byte)
+	defer srv.udpPool.Put(m)
 	n, addr, err := conn.ReadFrom(m)
 	if err != nil {
-		srv.udpPool.Put(m)
 		return nil, nil, err
 	}
-	m = m[:n]
-	return m, addr, nil
+	return bytes.Clone(m[:n]), addr, nil
 }
 
-// WriteMsg implements the ResponseWriter.WriteMsg method.
+// WriteMsg implements the ResponseWriter.WriteMsg method. When the server has a TsigProvider and m has a
+// TSIG RR in its pseudo section, m is signed. A reply over UDP that is larger than the buffer size of the
+// requester, or 512 octets when it has no EDNS, is truncated in place, see truncate.
 func (w *response) WriteMsg(m *Msg) (err error) {
 	if w.closed {
 		return &Error{err: "WriteMsg called after Close"}
 	}
 
-	var data []byte
+	pack := m.Pack
 	if w.tsigProvider != nil { // if no provider, dont check for the tsig (which is a longer check)
-		if t := m.IsTsig(); t != nil {
-			data, w.tsigRequestMAC, err = TsigGenerateWithProvider(m, w.tsigProvider, w.tsigRequestMAC, w.tsigTimersOnly)
-			if err != nil {
+		if m.tsig() != nil {
+			requestMAC := w.tsigRequestMAC
+			pack = func() (err error) {
+				w.tsigRequestMAC, err = TsigGenerateWithProvider(m, w.tsigProvider, requestMAC, w.tsigTimersOnly)
 				return err
 			}
-			_, err = w.writer.Write(data)
-			return err
 		}
 	}
-	data, err = m.Pack()
-	if err != nil {
+	if err := pack(); err != nil {
 		return err
 	}
-	_, err = w.writer.Write(data)
+	if w.udp != nil {
+		if err := truncate(m, max(w.udpSize, MinMsgSize), pack); err != nil {
+			return err
+		}
+	}
+	_, err = w.writer.Write(m.Data)
 	return err
 }
 
+// truncate drops whole RRsets from the end of the additional, authority and answer sections of m, in that
+// order, until m.Data as packed by pack fits in size octets. The pseudo section, with the OPT and TSIG RRs, is
+// kept. If RRsets are dropped the TC bit is set. According to RFC 2181 TC should only be set when "required" RRs
+// are omitted, but there is no way of knowing which RRs those are, so it is set when any RR is omitted.
+func truncate(m *Msg, size int, pack func() error) error {
+	for len(m.Data) > size {
+		switch {
+		case len(m.Extra) > 0:
+			m.Extra = dropRRset(m.Extra)
+		case len(m.Ns) > 0:
+			m.Ns = dropRRset(m.Ns)
+		case len(m.Answer) > 0:
+			m.Answer = dropRRset(m.Answer)
+		default:
+			return nil // nothing left to drop
+		}
+		m.Truncated = true
+		if err := pack(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropRRset returns rrs without its last RRset. The RRSIGs that cover an RRset are considered to be part of it.
+func dropRRset(rrs []RR) []RR {
+	last := rrs[len(rrs)-1]
+	i := len(rrs) - 1
+	for i > 0 && sameRRset(rrs[i-1], last) {
+		i--
+	}
+	return rrs[:i]
+}
+
+func sameRRset(a, b RR) bool {
+	return rrsetType(a) == rrsetType(b) && a.Header().Class == b.Header().Class && strings.EqualFold(a.Header().Name, b.Header().Name)
+}
+
+func rrsetType(rr RR) uint16 {
+	if sig, ok := rr.(*RRSIG); ok {
+		return sig.TypeCovered
+	}
+	return RRToType(rr)
+}
+
 // Write implements the ResponseWriter.Write method.
 func (w *response) Write(m []byte) (int, error) {
 	if w.closed {
@@ -774,9 +805,12 @@ func (w *response) Write(m []byte) (int, error) {
 	}
 }
 
-// LocalAddr implements the ResponseWriter.LocalAddr method.
+// LocalAddr implements the ResponseWriter.LocalAddr method. With the PROXY protocol it is the address the client
+// connected to.
 func (w *response) LocalAddr() net.Addr {
 	switch {
+	case w.proxy != nil && w.proxy.Destination != nil:
+		return w.proxy.Destination
 	case w.udp != nil:
 		return w.udp.LocalAddr()
 	case w.tcp != nil:
@@ -786,9 +820,12 @@ func (w *response) LocalAddr() net.Addr {
 	}
 }
 
-// RemoteAddr implements the ResponseWriter.RemoteAddr method.
+// RemoteAddr implements the ResponseWriter.RemoteAddr method. With the PROXY protocol it is the address of the
+// client.
 func (w *response) RemoteAddr() net.Addr {
 	switch {
+	case w.proxy != nil && w.proxy.Source != nil:
+		return w.proxy.Source
 	case w.udpSession != nil:
 		return w.udpSession.RemoteAddr()
 	case w.pcSession != nil:
@@ -827,7 +864,7 @@ func (w *response) Close() error {
 	}
 }
 
-// ConnectionState() implements the ConnectionStater.ConnectionState() interface.
+// ConnectionState implements the ConnectionStater.ConnectionState interface.
 func (w *response) ConnectionState() *tls.ConnectionState {
 	type tlsConnectionStater interface {
 		ConnectionState() tls.ConnectionState
@@ -0,0 +1,288 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runServer starts srv with a UDP and a TCP listener on the same loopback address, both are shut down when
+// the test ends. It returns the address.
+func runServer(t *testing.T, srv func() *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+
+	for _, s := range []*Server{srv(), srv()} {
+		if pc != nil {
+			s.PacketConn, pc = pc, nil
+		} else {
+			s.Listener = l
+		}
+		started := make(chan struct{})
+		s.NotifyStartedFunc = func() { close(started) }
+		go s.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { s.Shutdown() })
+	}
+	return l.Addr().String()
+}
+
+func TestServer(t *testing.T) {
+	handler := HandlerFunc(func(ctx context.Context, w ResponseWriter, req *Msg) {
+		r := new(Msg).SetReply(req)
+		info := ContextConnInfo(ctx)
+		if info == nil || info.RemoteAddr.String() != w.RemoteAddr().String() {
+			t.Errorf("expected connection info for %s, got %v", w.RemoteAddr(), info)
+			return
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected a deadline on the handler's context")
+		}
+		r.Answer = []RR{&TXT{Hdr: Header{Name: req.Question[0].Header().Name, Class: ClassINET}, Txt: []string{info.Network}}}
+		w.WriteMsg(r)
+	})
+	addr := runServer(t, func() *Server { return &Server{Handler: handler} })
+
+	c := new(Client)
+	for _, network := range []string{"udp", "tcp"} {
+		m := &Msg{MsgHeader: MsgHeader{ID: ID()}, Question: []RR{&TXT{Hdr: Header{Name: "example.org.", Class: ClassINET}}}}
+		if err := m.Pack(); err != nil {
+			t.Fatal(err)
+		}
+		r, _, err := c.Exchange(context.Background(), m, network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*TXT).Txt[0] != network {
+			t.Errorf("expected TXT with %s, got %v", network, r.Answer)
+		}
+	}
+}
+
+func TestServerFormErr(t *testing.T) {
+	addr := runServer(t, func() *Server {
+		return &Server{Handler: HandlerFunc(func(ctx context.Context, w ResponseWriter, req *Msg) {
+			t.Error("handler called for a malformed query")
+		})}
+	})
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// Header with one question, but the name runs off the end of the message.
+	if _, err := conn.Write([]byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 7, 'e', 'x'}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, MinMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Msg{Data: buf[:n]}
+	if err := r.Unpack(); err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != 0x1234 || !r.Response || r.Rcode != RcodeFormatError {
+		t.Errorf("expected FORMERR reply with ID 0x1234, got %v", r.MsgHeader)
+	}
+}
+
+func TestServerTsig(t *testing.T) {
+	handler := HandlerFunc(func(ctx context.Context, w ResponseWriter, req *Msg) {
+		r := new(Msg).SetReply(req)
+		if err := w.TsigStatus(); err != nil {
+			t.Errorf("expected verified query, got %v", err)
+		}
+		r.Pseudo = []RR{&TSIG{Hdr: Header{Name: req.tsig().Hdr.Name}, Algorithm: HmacSHA256}}
+		w.WriteMsg(r)
+	})
+	secret := map[string]string{"test.": tsigSecret}
+	addr := runServer(t, func() *Server { return &Server{Handler: handler, TsigSecret: secret} })
+
+	c := &Client{TsigSecret: secret}
+	m := newTsigMsg()
+	if err := m.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := c.Exchange(context.Background(), m, "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.tsig() == nil {
+		t.Error("expected signed reply")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	soa := &SOA{Hdr: Header{Name: "example.org.", Class: ClassINET, TTL: 3600}, Ns: "ns.example.org.", Mbox: "admin.example.org.", Serial: 2024010101}
+	records := []RR{
+		&A{Hdr: Header{Name: "a.example.org.", Class: ClassINET, TTL: 3600}, A: net.ParseIP("192.0.2.1")},
+		&A{Hdr: Header{Name: "b.example.org.", Class: ClassINET, TTL: 3600}, A: net.ParseIP("192.0.2.2")},
+	}
+	handler := HandlerFunc(func(ctx context.Context, w ResponseWriter, req *Msg) {
+		ch := make(chan *Envelope)
+		done := make(chan error)
+		go func() { done <- new(Transfer).Out(w, req, ch) }()
+		ch <- &Envelope{RR: []RR{soa, records[0]}}
+		ch <- &Envelope{RR: []RR{records[1], soa}}
+		close(ch)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	addr := runServer(t, func() *Server { return &Server{Handler: handler} })
+
+	m := &Msg{MsgHeader: MsgHeader{ID: ID()}, Question: []RR{&AXFR{Hdr: Header{Name: "example.org.", Class: ClassINET}}}}
+	env, err := new(Transfer).In(context.Background(), m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rrs []RR
+	for e := range env {
+		if e.Error != nil {
+			t.Fatal(e.Error)
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	if len(rrs) != 4 {
+		t.Errorf("expected 4 RRs in the transfer, got %d: %v", len(rrs), rrs)
+	}
+
+	m.Question = []RR{&MX{Hdr: Header{Name: "example.org.", Class: ClassINET}}}
+	if _, err := new(Transfer).In(context.Background(), m, addr); err == nil {
+		t.Error("expected error for a transfer with an MX question")
+	}
+}
+
+func TestServerTruncate(t *testing.T) {
+	handler := HandlerFunc(func(ctx context.Context, w ResponseWriter, req *Msg) {
+		r := new(Msg).SetReply(req)
+		r.UDPSize = req.UDPSize
+		for i := range 20 {
+			r.Answer = append(r.Answer, &A{Hdr: Header{Name: "a.example.org.", Class: ClassINET, TTL: 3600}, A: net.IPv4(192, 0, 2, byte(i))})
+		}
+		for i := range 10 {
+			r.Answer = append(r.Answer, &TXT{Hdr: Header{Name: "a.example.org.", Class: ClassINET, TTL: 3600}, Txt: []string{strings.Repeat("x", 20+i)}})
+		}
+		r.Extra = []RR{&AAAA{Hdr: Header{Name: "ns.example.org.", Class: ClassINET, TTL: 3600}, AAAA: net.ParseIP("2001:db8::1")}}
+		if req.tsig() != nil {
+			r.Pseudo = append(r.Pseudo, &TSIG{Hdr: Header{Name: req.tsig().Hdr.Name}, Algorithm: HmacSHA256})
+		}
+		if err := w.WriteMsg(r); err != nil {
+			t.Error(err)
+		}
+	})
+	secret := map[string]string{"test.": tsigSecret}
+	addr := runServer(t, func() *Server { return &Server{Handler: handler, TsigSecret: secret} })
+
+	c := &Client{TsigSecret: secret}
+	tests := []struct {
+		udpSize   uint16
+		tsig      bool
+		truncated bool
+		answers   int
+	}{
+		{0, false, true, 20},
+		{0, true, true, 20},
+		{1232, true, false, 30},
+		{1232, false, false, 30},
+	}
+	for _, tc := range tests {
+		m := &Msg{MsgHeader: MsgHeader{ID: ID(), UDPSize: tc.udpSize}, Question: []RR{&A{Hdr: Header{Name: "a.example.org.", Class: ClassINET}}}}
+		if tc.tsig {
+			m.Pseudo = []RR{&TSIG{Hdr: Header{Name: "test."}, Algorithm: HmacSHA256}}
+		}
+		if err := m.Pack(); err != nil {
+			t.Fatal(err)
+		}
+		r, _, err := c.Exchange(context.Background(), m, "udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := max(int(tc.udpSize), MinMsgSize); len(r.Data) > size {
+			t.Errorf("expected reply of at most %d octets, got %d", size, len(r.Data))
+		}
+		if r.Truncated != tc.truncated || len(r.Answer) != tc.answers {
+			t.Errorf("expected truncated %t with %d answers, got %t with %d", tc.truncated, tc.answers, r.Truncated, len(r.Answer))
+		}
+		if tc.truncated && len(r.Extra) != 0 {
+			t.Errorf("expected additional section to be dropped, got %v", r.Extra)
+		}
+		if tc.tsig && r.tsig() == nil {
+			t.Error("expected TSIG to be kept in a truncated reply")
+		}
+	}
+}
+
+type countingReader struct {
+	Reader
+	reads *atomic.Int32
+}
+
+func (r countingReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	r.reads.Add(1)
+	return r.Reader.ReadTCP(conn, timeout)
+}
+
+func (r countingReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *SessionUDP, error) {
+	r.reads.Add(1)
+	return r.Reader.ReadUDP(conn, timeout)
+}
+
+func (r countingReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	r.reads.Add(1)
+	return r.Reader.(PacketConnReader).ReadPacketConn(conn, timeout)
+}
+
+type countingWriter struct {
+	Writer
+	writes *atomic.Int32
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	w.writes.Add(1)
+	return w.Writer.Write(b)
+}
+
+func TestServerDecorate(t *testing.T) {
+	reads, writes := &atomic.Int32{}, &atomic.Int32{}
+	handler := HandlerFunc(func(ctx context.Context, w ResponseWriter, req *Msg) {
+		w.WriteMsg(new(Msg).SetReply(req))
+	})
+	addr := runServer(t, func() *Server {
+		return &Server{
+			Handler:        handler,
+			DecorateReader: func(r Reader) Reader { return countingReader{r, reads} },
+			DecorateWriter: func(w Writer) Writer { return countingWriter{w, writes} },
+		}
+	})
+
+	c := new(Client)
+	for _, network := range []string{"udp", "tcp"} {
+		m := &Msg{MsgHeader: MsgHeader{ID: ID()}, Question: []RR{&A{Hdr: Header{Name: "example.org.", Class: ClassINET}}}}
+		if err := m.Pack(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Exchange(context.Background(), m, network, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reads.Load() < 2 || writes.Load() != 2 {
+		t.Errorf("expected the decorated reader and writer to be used, got %d reads and %d writes", reads.Load(), writes.Load())
+	}
+}
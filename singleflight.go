@@ -0,0 +1,121 @@
+package dns
+
+// Suppression of concurrent identical queries, adapted from:
+// https://github.com/golang/groupcache/blob/master/singleflight/singleflight.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// call is an in-flight or completed singleflight.do call.
+type call struct {
+	done chan struct{}
+	r    *Msg
+	rtt  time.Duration
+	err  error
+	dups int
+}
+
+// singleflight represents a class of work and forms a namespace in which units of work can be executed with
+// duplicate suppression.
+type singleflight struct {
+	mu sync.Mutex
+	m  map[string]*call
+}
+
+// do executes and returns the results of fn, making sure that only one execution is in-flight for a given
+// key at a time. If a duplicate comes in, the duplicate caller waits for the original to complete and
+// receives the same results, or until its own ctx is done. When the original failed because its context is
+// done, while ctx is not, the duplicate caller tries again. The return value shared reports whether r was
+// given to multiple callers, r must then not be modified.
+func (g *singleflight) do(ctx context.Context, key string, fn func() (*Msg, time.Duration, error)) (r *Msg, rtt time.Duration, err error, shared bool) {
+	for {
+		g.mu.Lock()
+		if g.m == nil {
+			g.m = make(map[string]*call)
+		}
+		c, ok := g.m[key]
+		if !ok {
+			break
+		}
+		c.dups++
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			if isContextError(c.err) && ctx.Err() == nil {
+				continue // the context of the original caller, not ours
+			}
+			return c.r, c.rtt, c.err, true
+		case <-ctx.Done():
+			return nil, 0, ctx.Err(), false
+		}
+	}
+	c := &call{done: make(chan struct{})}
+	g.m[key] = c
+	g.mu.Unlock()
+
+	c.r, c.rtt, c.err = fn()
+
+	g.mu.Lock()
+	delete(g.m, key)
+	shared = c.dups > 0
+	g.mu.Unlock()
+	close(c.done)
+
+	return c.r, c.rtt, c.err, shared
+}
+
+// isContextError returns true if err is, or wraps, context.Canceled or context.DeadlineExceeded.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// inflightKey returns the key used to detect identical queries: the question name, type and class, the DO
+// bit and the server. If m has no question, or is signed with TSIG, the bool is false.
+func inflightKey(m *Msg, network, address string) (string, bool) {
+	if len(m.Question) == 0 || m.tsig() != nil {
+		return "", false
+	}
+	q := m.Question[0]
+	sb := strings.Builder{}
+	sb.WriteString(strings.ToLower(q.Header().Name))
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.Itoa(int(RRToType(q))))
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.Itoa(int(q.Header().Class)))
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.FormatBool(m.Security))
+	sb.WriteByte(' ')
+	sb.WriteString(network)
+	sb.WriteByte(' ')
+	sb.WriteString(address)
+	return sb.String(), true
+}
+
+// copyReply returns a copy of r with its ID set to id. The copy is made by unpacking a copy of r.Data, TTLs
+// that were changed after unpacking, i.e. when capped for DNS over HTTPS, are carried over.
+func copyReply(r *Msg, id uint16) *Msg {
+	c := &Msg{Data: bytes.Clone(r.Data), Options: r.Options}
+	if len(c.Data) >= 2 {
+		binary.BigEndian.PutUint16(c.Data, id)
+	}
+	c.Unpack() // r was unpacked from the same data, an error is also in r's error
+	c.ID = id
+
+	for _, s := range [][2][]RR{{r.Answer, c.Answer}, {r.Ns, c.Ns}, {r.Extra, c.Extra}} {
+		if len(s[0]) != len(s[1]) {
+			continue
+		}
+		for i := range s[0] {
+			s[1][i].Header().TTL = s[0][i].Header().TTL
+		}
+	}
+	return c
+}
@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientSingleInflight(t *testing.T) {
+	queries := &atomic.Int32{}
+	addr := serveLocal(t, "127.0.0.1:0", func(network string, req *Msg) *Msg {
+		queries.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		r := &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true}, Question: req.Question}
+		r.Answer = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET, TTL: 3600}, A: net.IPv4(127, 0, 0, 1).To4()}}
+		return r
+	})
+
+	c := &Client{Transport: &Transport{DialContext: DefaultTransport.DialContext}, SingleInflight: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const n = 5
+	replies := make([]*Msg, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := &Msg{MsgHeader: MsgHeader{ID: uint16(1000 + i), RecursionDesired: true}}
+			m.Question = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+			m.Pack()
+
+			r, _, err := c.Exchange(ctx, m, "udp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if r.ID != m.ID || len(r.Answer) != 1 {
+				t.Errorf("expected reply with ID %d and 1 answer, got:\n%s", m.ID, r)
+			}
+			replies[i] = r
+		}()
+	}
+	wg.Wait()
+
+	if q := queries.Load(); q != 1 {
+		t.Errorf("expected 1 query to be sent, got %d", q)
+	}
+	for i := 1; i < n; i++ {
+		if replies[i] != nil && replies[i] == replies[0] {
+			t.Errorf("expected each caller to get its own reply")
+		}
+	}
+}
+
+func TestClientSingleInflightCanceled(t *testing.T) {
+	addr := serveLocal(t, "127.0.0.1:0", func(network string, req *Msg) *Msg {
+		time.Sleep(100 * time.Millisecond)
+		r := &Msg{MsgHeader: MsgHeader{ID: req.ID, Response: true}, Question: req.Question}
+		r.Answer = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET, TTL: 3600}, A: net.IPv4(127, 0, 0, 1).To4()}}
+		return r
+	})
+	c := &Client{Transport: &Transport{DialContext: DefaultTransport.DialContext}, SingleInflight: true}
+	exchange := func(ctx context.Context) (*Msg, error) {
+		m := &Msg{MsgHeader: MsgHeader{ID: ID(), RecursionDesired: true}}
+		m.Question = []RR{&A{Hdr: Header{Name: "miek.nl.", Class: ClassINET}}}
+		m.Pack()
+		r, _, err := c.Exchange(ctx, m, "udp", addr)
+		return r, err
+	}
+
+	// The first caller gives up before the reply is in, the second caller must not get its error.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	leader := make(chan error, 1)
+	go func() {
+		_, err := exchange(ctx)
+		leader <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	r, err := exchange(context.Background())
+	if err != nil {
+		t.Fatalf("expected a reply, got %v", err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("expected 1 answer, got:\n%s", r)
+	}
+	if err := <-leader; err == nil {
+		t.Error("expected the first caller to time out")
+	}
+}
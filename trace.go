@@ -0,0 +1,136 @@
+package dns
+
+// Tracing of client exchanges, modelled after net/http/httptrace.
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+)
+
+// ClientTrace is a set of hooks to run at various stages of an exchange done by a [Client]. Any particular
+// hook may be nil. Functions may be called concurrently from different goroutines and some may be called
+// after the exchange has completed or failed. A ClientTrace is attached to a context with [WithClientTrace]:
+//
+//	trace := &dns.ClientTrace{
+//		GotConn: func(info dns.GotConnInfo) { log.Printf("connection reused: %t", info.Reused) },
+//	}
+//	ctx = dns.WithClientTrace(ctx, trace)
+//	r, rtt, err := c.Exchange(ctx, m, "tcp", "192.0.2.53:53")
+type ClientTrace struct {
+	// DialStart is called when a new connection to address is dialed.
+	DialStart func(network, address string)
+
+	// DialDone is called when a dial completes, err is nil when the connection was established. For DNS
+	// over TLS and DNS over QUIC this includes the handshake.
+	DialDone func(network, address string, err error)
+
+	// GotConn is called when a connection is obtained for the query, either a new one or a reused one.
+	GotConn func(GotConnInfo)
+
+	// WroteQuery is called with the result of writing the query.
+	WroteQuery func(WroteQueryInfo)
+
+	// GotFirstResponseByte is called when the first byte of the reply has been received.
+	GotFirstResponseByte func()
+
+	// TruncatedFallback is called when a truncated reply makes the query to be asked again over network,
+	// see [Client.ExchangeWithFallback].
+	TruncatedFallback func(network, address string)
+
+	// ResponseParsed is called when the reply has been unpacked, err is the error from unpacking it, if any.
+	ResponseParsed func(r *Msg, err error)
+}
+
+// GotConnInfo is the argument to [ClientTrace.GotConn] and contains information about the obtained
+// connection.
+type GotConnInfo struct {
+	// Conn is the connection that is used. It is nil for DNS over QUIC.
+	Conn net.Conn
+
+	// Reused is true if the connection has been used for earlier queries.
+	Reused bool
+}
+
+// WroteQueryInfo is the argument to [ClientTrace.WroteQuery].
+type WroteQueryInfo struct {
+	// Bytes is the number of bytes written, for TCP and DNS over TLS this includes the two byte length
+	// prefix.
+	Bytes int
+
+	// Err is the error that occurred while writing the query, if any.
+	Err error
+}
+
+type clientTraceKey struct{}
+
+// WithClientTrace returns a new context based on ctx that carries trace. A trace that is already in ctx is
+// replaced.
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	return context.WithValue(ctx, clientTraceKey{}, trace)
+}
+
+// ContextClientTrace returns the ClientTrace associated with ctx. If none, it returns nil.
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientTraceKey{}).(*ClientTrace)
+	return trace
+}
+
+// The methods below can be called on a nil *ClientTrace.
+
+func (t *ClientTrace) dialStart(network, address string) {
+	if t != nil && t.DialStart != nil {
+		t.DialStart(network, address)
+	}
+}
+
+func (t *ClientTrace) dialDone(network, address string, err error) {
+	if t != nil && t.DialDone != nil {
+		t.DialDone(network, address, err)
+	}
+}
+
+func (t *ClientTrace) gotConn(conn net.Conn, reused bool) {
+	if t != nil && t.GotConn != nil {
+		t.GotConn(GotConnInfo{Conn: conn, Reused: reused})
+	}
+}
+
+func (t *ClientTrace) wroteQuery(n int, err error) {
+	if t != nil && t.WroteQuery != nil {
+		t.WroteQuery(WroteQueryInfo{Bytes: n, Err: err})
+	}
+}
+
+func (t *ClientTrace) gotFirstResponseByte() {
+	if t != nil && t.GotFirstResponseByte != nil {
+		t.GotFirstResponseByte()
+	}
+}
+
+func (t *ClientTrace) truncatedFallback(network, address string) {
+	if t != nil && t.TruncatedFallback != nil {
+		t.TruncatedFallback(network, address)
+	}
+}
+
+func (t *ClientTrace) responseParsed(r *Msg, err error) {
+	if t != nil && t.ResponseParsed != nil {
+		t.ResponseParsed(r, err)
+	}
+}
+
+// httpTrace returns a context that has the hooks of t translated to an httptrace.ClientTrace, for use with
+// DNS over HTTPS. The message written is m.
+func (t *ClientTrace) httpTrace(ctx context.Context, m *Msg) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart:         t.dialStart,
+		ConnectDone:          t.dialDone,
+		GotConn:              func(info httptrace.GotConnInfo) { t.gotConn(info.Conn, info.Reused) },
+		WroteRequest:         func(info httptrace.WroteRequestInfo) { t.wroteQuery(len(m.Data), info.Err) },
+		GotFirstResponseByte: t.gotFirstResponseByte,
+	})
+}
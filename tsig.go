@@ -1,7 +1,7 @@
-//go:build ignore
-
 package dns
 
+// Transaction signatures, TSIG, RFC 8945.
+
 import (
 	"crypto/hmac"
 	"crypto/sha1"
@@ -10,8 +10,6 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"hash"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/miekg/dnsv2/dnsutil"
@@ -79,10 +77,12 @@ func (key tsigHMACProvider) Verify(msg []byte, t *TSIG) error {
 	return nil
 }
 
+// tsigSecretProvider is a TsigProvider with the base64 encoded secrets keyed on the key name, in canonical
+// form. Key names are looked up in canonical form too, as a peer may send them in another case.
 type tsigSecretProvider map[string]string
 
 func (ts tsigSecretProvider) Generate(msg []byte, t *TSIG) ([]byte, error) {
-	key, ok := ts[t.Hdr.Name]
+	key, ok := ts[dnsutil.Canonical(t.Hdr.Name)]
 	if !ok {
 		return nil, ErrSecret
 	}
@@ -90,152 +90,91 @@ func (ts tsigSecretProvider) Generate(msg []byte, t *TSIG) ([]byte, error) {
 }
 
 func (ts tsigSecretProvider) Verify(msg []byte, t *TSIG) error {
-	key, ok := ts[t.Hdr.Name]
+	key, ok := ts[dnsutil.Canonical(t.Hdr.Name)]
 	if !ok {
 		return ErrSecret
 	}
 	return tsigHMACProvider(key).Verify(msg, t)
 }
 
-// TSIG is the RR the holds the transaction signature of a message.
-// See RFC 2845 and RFC 4635.
-type TSIG struct {
-	Hdr        Header
-	Algorithm  string `dns:"domain-name"`
-	TimeSigned uint64 `dns:"uint48"`
-	Fudge      uint16
-	MACSize    uint16
-	MAC        string `dns:"size-hex:MACSize"`
-	OrigId     uint16
-	Error      uint16
-	OtherLen   uint16
-	OtherData  string `dns:"size-hex:OtherLen"`
-}
-
-func (rr *TSIG) Data() []Field {
-	return []Field{rr.Algorithm, rr.TimeSigned, rr.Fudge, rr.MACSize, rr.MAC, rr.OrigId, rr.Error, rr.OtherLen, rr.OtherData}
-}
-
-func (rr *TSIG) Header() *Header { return &rr.Hdr }
-
-// TSIG has no official presentation format, but this will suffice.
-
-func (rr *TSIG) String() string {
-	s := "\n;; TSIG PSEUDOSECTION:\n; " // add another semi-colon to signify TSIG does not have a presentation format
-	s += rr.Hdr.String(rr) +
-		" " + rr.Algorithm +
-		" " + tsigTimeToString(rr.TimeSigned) +
-		" " + strconv.Itoa(int(rr.Fudge)) +
-		" " + strconv.Itoa(int(rr.MACSize)) +
-		" " + strings.ToUpper(rr.MAC) +
-		" " + strconv.Itoa(int(rr.OrigId)) +
-		" " + strconv.Itoa(int(rr.Error)) + // BIND prints NOERROR
-		" " + strconv.Itoa(int(rr.OtherLen)) +
-		" " + rr.OtherData
-	return s
-}
-
-func (*TSIG) parse(c *zlexer, origin string) *ParseError {
-	return &ParseError{err: "TSIG records do not have a presentation format"}
-}
-
-// The following values must be put in wireformat, so that the MAC can be calculated.
-// RFC 2845, section 3.4.2. TSIG Variables.
-type tsigWireFmt struct {
-	// From RR_Header
-	Name  string `dns:"domain-name"`
-	Class uint16
-	Ttl   uint32
-	// Rdata of the TSIG
-	Algorithm  string `dns:"domain-name"`
-	TimeSigned uint64 `dns:"uint48"`
-	Fudge      uint16
-	// MACSize, MAC and OrigId excluded
-	Error     uint16
-	OtherLen  uint16
-	OtherData string `dns:"size-hex:OtherLen"`
-}
-
-// If we have the MAC use this type to convert it to wiredata. Section 3.4.3. Request MAC
-type macWireFmt struct {
-	MACSize uint16
-	MAC     string `dns:"size-hex:MACSize"`
-}
-
-// 3.3. Time values used in TSIG calculations
-type timerWireFmt struct {
-	TimeSigned uint64 `dns:"uint48"`
-	Fudge      uint16
-}
-
-// TsigGenerate fills out the TSIG record attached to the message.
-// The message should contain a "stub" TSIG RR with the algorithm, key name
-// (owner name of the RR), time fudge (defaults to 300 seconds) and the current
-// time The TSIG MAC is saved in that Tsig RR. When TsigGenerate is called for
-// the first time requestMAC should be set to the empty string and timersOnly to
-// false.
-func TsigGenerate(m *Msg, secret, requestMAC string, timersOnly bool) ([]byte, string, error) {
+// TsigGenerate signs m with the TSIG RR in its pseudo section. The TSIG RR holds the key name (its owner
+// name), the algorithm and optionally the time signed (defaults to now) and the fudge (defaults to 300
+// seconds). The MAC is saved in that TSIG RR and m.Data holds the signed message. When signing a reply,
+// requestMAC is the MAC of the request, otherwise it should be the empty string. When timersOnly is true only
+// the timers are included in the MAC, as is done for the later messages of a zone transfer. The MAC is
+// returned.
+func TsigGenerate(m *Msg, secret, requestMAC string, timersOnly bool) (string, error) {
 	return TsigGenerateWithProvider(m, tsigHMACProvider(secret), requestMAC, timersOnly)
 }
 
 // TsigGenerateWithProvider is similar to TsigGenerate, but allows for a custom TsigProvider.
-func TsigGenerateWithProvider(m *Msg, provider TsigProvider, requestMAC string, timersOnly bool) ([]byte, string, error) {
-	if m.IsTsig() == nil {
-		panic("dns: TSIG not last RR in additional")
+func TsigGenerateWithProvider(m *Msg, provider TsigProvider, requestMAC string, timersOnly bool) (string, error) {
+	rr := m.tsig()
+	if rr == nil {
+		return "", ErrNoSig
+	}
+	rr.Hdr.Class = ClassANY
+	rr.Hdr.TTL = 0
+	rr.OrigID = m.ID
+	rr.MAC, rr.MACSize = "", 0
+	if rr.TimeSigned == 0 {
+		rr.TimeSigned = uint64(time.Now().Unix())
 	}
-
-	rr := m.Extra[len(m.Extra)-1].(*TSIG)
-	m.Extra = m.Extra[0 : len(m.Extra)-1] // kill the TSIG from the msg
-	mbuf, err := m.Pack()
-	if err != nil {
-		return nil, "", err
+	if rr.Fudge == 0 {
+		rr.Fudge = 300 // Standard (RFC) default.
 	}
 
-	buf, err := tsigBuffer(mbuf, rr, requestMAC, timersOnly)
-	if err != nil {
-		return nil, "", err
+	// Pack the message without the TSIG, that is what the MAC is calculated over.
+	unsigned := *m
+	unsigned.Pseudo = make([]RR, 0, len(m.Pseudo)-1)
+	for _, r := range m.Pseudo {
+		if r != RR(rr) {
+			unsigned.Pseudo = append(unsigned.Pseudo, r)
+		}
+	}
+	unsigned.Data = nil
+	if err := unsigned.Pack(); err != nil {
+		return "", err
 	}
-
-	t := new(TSIG)
-	// Copy all TSIG fields except MAC, its size, and time signed which are filled when signing.
-	*t = *rr
-	t.TimeSigned = 0
-	t.MAC = ""
-	t.MACSize = 0
 
 	// Sign unless there is a key or MAC validation error (RFC 8945 5.3.2)
 	if rr.Error != RcodeBadKey && rr.Error != RcodeBadSig {
+		buf, err := tsigBuffer(unsigned.Data, rr, requestMAC, timersOnly)
+		if err != nil {
+			return "", err
+		}
 		mac, err := provider.Generate(buf, rr)
 		if err != nil {
-			return nil, "", err
+			return "", err
 		}
-		t.TimeSigned = rr.TimeSigned
-		t.MAC = hex.EncodeToString(mac)
-		t.MACSize = uint16(len(t.MAC) / 2) // Size is half!
+		rr.MAC = hex.EncodeToString(mac)
+		rr.MACSize = uint16(len(mac))
 	}
 
-	tbuf := make([]byte, Len(t))
-	off, err := PackRR(t, tbuf, 0, nil, false)
+	data := make([]byte, len(unsigned.Data)+rr.Len()+2) // Len does not count the root label of the two names
+	copy(data, unsigned.Data)
+	_, off, err := packRR(rr, data, len(unsigned.Data), nil)
 	if err != nil {
-		return nil, "", err
+		return "", err
 	}
-	mbuf = append(mbuf, tbuf[:off]...)
-	// Update the ArCount directly in the buffer.
-	binary.BigEndian.PutUint16(mbuf[10:], uint16(len(m.Extra)+1))
-
-	return mbuf, t.MAC, nil
+	// Update the ARCOUNT directly in the buffer.
+	binary.BigEndian.PutUint16(data[10:], binary.BigEndian.Uint16(data[10:])+1)
+	m.Data = data[:off]
+	return rr.MAC, nil
 }
 
-// TsigVerify verifies the TSIG on a message. If the signature does not
-// validate the returned error contains the cause. If the signature is OK, the
-// error is nil.
-func TsigVerify(msg []byte, secret, requestMAC string, timersOnly bool) error {
-	return tsigVerify(msg, tsigHMACProvider(secret), requestMAC, timersOnly, uint64(time.Now().Unix()))
+// TsigVerify verifies the TSIG on the message in m.Data. If the signature does not validate the returned error
+// contains the cause: ErrSig when the MAC is not correct, ErrTime when the message was signed outside of the
+// fudge window and ErrBadKey when the other side did not know our key. ErrNoSig is returned when the
+// message is not signed. When verifying a reply, requestMAC is the MAC of the request. If the signature is
+// OK, the error is nil.
+func TsigVerify(m *Msg, secret, requestMAC string, timersOnly bool) error {
+	return tsigVerify(m.Data, tsigHMACProvider(secret), requestMAC, timersOnly, uint64(time.Now().Unix()))
 }
 
 // TsigVerifyWithProvider is similar to TsigVerify, but allows for a custom TsigProvider.
-func TsigVerifyWithProvider(msg []byte, provider TsigProvider, requestMAC string, timersOnly bool) error {
-	return tsigVerify(msg, provider, requestMAC, timersOnly, uint64(time.Now().Unix()))
+func TsigVerifyWithProvider(m *Msg, provider TsigProvider, requestMAC string, timersOnly bool) error {
+	return tsigVerify(m.Data, provider, requestMAC, timersOnly, uint64(time.Now().Unix()))
 }
 
 // actual implementation of TsigVerify, taking the current time ('now') as a parameter for the convenience of tests.
@@ -246,6 +185,14 @@ func tsigVerify(msg []byte, provider TsigProvider, requestMAC string, timersOnly
 		return err
 	}
 
+	// These errors come unsigned, RFC 8945 5.3.2.
+	switch tsig.Error {
+	case RcodeBadKey:
+		return ErrBadKey
+	case RcodeBadSig:
+		return ErrSig
+	}
+
 	buf, err := tsigBuffer(stripped, tsig, requestMAC, timersOnly)
 	if err != nil {
 		return err
@@ -257,129 +204,127 @@ func tsigVerify(msg []byte, provider TsigProvider, requestMAC string, timersOnly
 
 	// Fudge factor works both ways. A message can arrive before it was signed because
 	// of clock skew.
-	// We check this after verifying the signature, following draft-ietf-dnsop-rfc2845bis
-	// instead of RFC2845, in order to prevent a security vulnerability as reported in CVE-2017-3142/3143.
+	// We check this after verifying the signature, following RFC 8945 5.2.3,
+	// in order to prevent a security vulnerability as reported in CVE-2017-3142/3143.
 	ti := now - tsig.TimeSigned
 	if now < tsig.TimeSigned {
 		ti = tsig.TimeSigned - now
 	}
-	if uint64(tsig.Fudge) < ti {
+	if uint64(tsig.Fudge) < ti || tsig.Error == RcodeBadTime {
 		return ErrTime
 	}
 
 	return nil
 }
 
-// Create a wiredata buffer for the MAC calculation.
-func tsigBuffer(msgbuf []byte, rr *TSIG, requestMAC string, timersOnly bool) ([]byte, error) {
+// tsigBuffer returns the data the MAC is calculated over: the request MAC, when given, the message, with the
+// original ID, and the TSIG variables, RFC 8945 4.3.
+func tsigBuffer(msg []byte, rr *TSIG, requestMAC string, timersOnly bool) ([]byte, error) {
 	var buf []byte
-	if rr.TimeSigned == 0 {
-		rr.TimeSigned = uint64(time.Now().Unix())
-	}
-	if rr.Fudge == 0 {
-		rr.Fudge = 300 // Standard (RFC) default.
-	}
-
-	// Replace message ID in header with original ID from TSIG
-	binary.BigEndian.PutUint16(msgbuf[0:2], rr.OrigId)
-
 	if requestMAC != "" {
-		m := new(macWireFmt)
-		m.MACSize = uint16(len(requestMAC) / 2)
-		m.MAC = requestMAC
-		buf = make([]byte, len(requestMAC)) // long enough
-		n, err := packMacWire(m, buf)
+		mac, err := hex.DecodeString(requestMAC)
 		if err != nil {
 			return nil, err
 		}
-		buf = buf[:n]
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(mac)))
+		buf = append(buf, mac...)
 	}
 
-	tsigvar := make([]byte, DefaultMsgSize)
+	// Replace message ID in header with original ID from TSIG
+	start := len(buf)
+	buf = append(buf, msg...)
+	binary.BigEndian.PutUint16(buf[start:], rr.OrigID)
+
 	if timersOnly {
-		tsig := new(timerWireFmt)
-		tsig.TimeSigned = rr.TimeSigned
-		tsig.Fudge = rr.Fudge
-		n, err := packTimerWire(tsig, tsigvar)
-		if err != nil {
-			return nil, err
-		}
-		tsigvar = tsigvar[:n]
-	} else {
-		tsig := new(tsigWireFmt)
-		tsig.Name = CanonicalName(rr.Hdr.Name)
-		tsig.Class = ClassANY
-		tsig.Ttl = rr.Hdr.Ttl
-		tsig.Algorithm = CanonicalName(rr.Algorithm)
-		tsig.TimeSigned = rr.TimeSigned
-		tsig.Fudge = rr.Fudge
-		tsig.Error = rr.Error
-		tsig.OtherLen = rr.OtherLen
-		tsig.OtherData = rr.OtherData
-		n, err := packTsigWire(tsig, tsigvar)
-		if err != nil {
-			return nil, err
-		}
-		tsigvar = tsigvar[:n]
+		buf = appendUint48(buf, rr.TimeSigned)
+		buf = binary.BigEndian.AppendUint16(buf, rr.Fudge)
+		return buf, nil
 	}
 
-	if requestMAC != "" {
-		x := append(buf, msgbuf...)
-		buf = append(x, tsigvar...)
-	} else {
-		buf = append(msgbuf, tsigvar...)
+	var err error
+	if buf, err = appendName(buf, rr.Hdr.Name); err != nil {
+		return nil, err
+	}
+	buf = binary.BigEndian.AppendUint16(buf, ClassANY)
+	buf = binary.BigEndian.AppendUint32(buf, 0) // TTL
+	if buf, err = appendName(buf, rr.Algorithm); err != nil {
+		return nil, err
 	}
+	buf = appendUint48(buf, rr.TimeSigned)
+	buf = binary.BigEndian.AppendUint16(buf, rr.Fudge)
+	buf = binary.BigEndian.AppendUint16(buf, rr.Error)
+	other, err := hex.DecodeString(rr.OtherData)
+	if err != nil {
+		return nil, err
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(other)))
+	buf = append(buf, other...)
 	return buf, nil
 }
 
-// Strip the TSIG from the raw message.
+// appendName appends the uncompressed canonical wire format of name to buf.
+func appendName(buf []byte, name string) ([]byte, error) {
+	wire := make([]byte, len(name)+2)
+	off, err := packDomainName(dnsutil.Canonical(name), wire, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, wire[:off]...), nil
+}
+
+func appendUint48(buf []byte, i uint64) []byte {
+	return append(buf, byte(i>>40), byte(i>>32), byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+}
+
+// stripTsig returns a copy of the raw message without the TSIG, which must be the last RR, and the TSIG.
 func stripTsig(msg []byte) ([]byte, *TSIG, error) {
-	// Copied from msg.go's Unpack() Header, but modified.
 	s := cryptobyte.String(msg)
 
-	var dh Header
+	var dh header
 	if !dh.unpack(&s) {
-		return nil, nil, errTruncatedMessage
+		return nil, nil, ErrTruncatedMessage
 	}
 	if dh.Arcount == 0 {
 		return nil, nil, ErrNoSig
 	}
 
-	// Rcode, see msg.go Unpack()
-	if int(dh.Bits&0xF) == RcodeNotAuth {
-		return nil, nil, ErrAuth
+	if _, err := unpackQuestions(dh.Qdcount, &s, msg); err != nil {
+		return nil, nil, err
 	}
-
-	_, err := unpackQuestions(dh.Qdcount, &s, msg)
-	if err != nil {
+	if _, err := unpackRRs(dh.Ancount, &s, msg); err != nil {
 		return nil, nil, err
 	}
-
-	_, err = unpackRRs(dh.Ancount, &s, msg)
-	if err != nil {
+	if _, err := unpackRRs(dh.Nscount, &s, msg); err != nil {
+		return nil, nil, err
+	}
+	if _, err := unpackRRs(dh.Arcount-1, &s, msg); err != nil {
 		return nil, nil, err
 	}
 
-	_, err = unpackRRs(dh.Nscount, &s, msg)
+	off := offset(s, msg)
+	rr, err := unpackRR(&s, msg)
 	if err != nil {
 		return nil, nil, err
 	}
+	tsig, ok := rr.(*TSIG)
+	if !ok {
+		return nil, nil, ErrNoSig
+	}
 
-	for i := 0; i < int(dh.Arcount); i++ {
-		rrOff := offset(s, msg)
-		extra, err := unpackRR(&s, msg)
-		if err != nil {
-			return nil, nil, err
-		}
-		if extra.Header().Rrtype == TypeTSIG {
-			// Adjust Arcount.
-			arcount := binary.BigEndian.Uint16(msg[10:])
-			binary.BigEndian.PutUint16(msg[10:], arcount-1)
-			return msg[:rrOff], extra.(*TSIG), nil
+	stripped := make([]byte, off)
+	copy(stripped, msg)
+	binary.BigEndian.PutUint16(stripped[10:], dh.Arcount-1)
+	return stripped, tsig, nil
+}
+
+// tsig returns the TSIG RR from the pseudo section of m, or nil if there is none.
+func (m *Msg) tsig() *TSIG {
+	for _, rr := range m.Pseudo {
+		if t, ok := rr.(*TSIG); ok {
+			return t
 		}
 	}
-
-	return nil, nil, ErrNoSig
+	return nil
 }
 
 // Translate the TSIG time signed into a date. There is no
@@ -388,71 +333,3 @@ func tsigTimeToString(t uint64) string {
 	ti := time.Unix(int64(t), 0).UTC()
 	return ti.Format("20060102150405")
 }
-
-func packTsigWire(tw *tsigWireFmt, msg []byte) (int, error) {
-	// copied from zmsg.go TSIG packing
-	// RR_Header
-	off, err := PackDomainName(tw.Name, msg, 0, nil, false)
-	if err != nil {
-		return off, err
-	}
-	off, err = packUint16(tw.Class, msg, off)
-	if err != nil {
-		return off, err
-	}
-	off, err = packUint32(tw.Ttl, msg, off)
-	if err != nil {
-		return off, err
-	}
-
-	off, err = PackDomainName(tw.Algorithm, msg, off, nil, false)
-	if err != nil {
-		return off, err
-	}
-	off, err = packUint48(tw.TimeSigned, msg, off)
-	if err != nil {
-		return off, err
-	}
-	off, err = packUint16(tw.Fudge, msg, off)
-	if err != nil {
-		return off, err
-	}
-
-	off, err = packUint16(tw.Error, msg, off)
-	if err != nil {
-		return off, err
-	}
-	off, err = packUint16(tw.OtherLen, msg, off)
-	if err != nil {
-		return off, err
-	}
-	off, err = packStringHex(tw.OtherData, msg, off)
-	if err != nil {
-		return off, err
-	}
-	return off, nil
-}
-
-func packMacWire(mw *macWireFmt, msg []byte) (int, error) {
-	off, err := packUint16(mw.MACSize, msg, 0)
-	if err != nil {
-		return off, err
-	}
-	off, err = packStringHex(mw.MAC, msg, off)
-	if err != nil {
-		return off, err
-	}
-	return off, nil
-}
-
-func packTimerWire(tw *timerWireFmt, msg []byte) (int, error) {
-	off, err := packUint48(tw.TimeSigned, msg, 0)
-	if err != nil {
-		return off, err
-	}
-	off, err = packUint16(tw.Fudge, msg, off)
-	if err != nil {
-		return off, err
-	}
-	return off, nil
-}
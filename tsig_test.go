@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const tsigSecret = "pRZgBrBvI4NAHZYhxmhs/Q=="
+
+func newTsigMsg() *Msg {
+	m := &Msg{MsgHeader: MsgHeader{ID: ID()}}
+	m.Question = []RR{&A{Hdr: Header{Name: "example.org.", Class: ClassINET}}}
+	m.Pseudo = []RR{&TSIG{Hdr: Header{Name: "test."}, Algorithm: HmacSHA256}}
+	return m
+}
+
+func TestTsig(t *testing.T) {
+	m := newTsigMsg()
+	m.UDPSize = 1232
+	mac, err := TsigGenerate(m, tsigSecret, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mac) != 64 {
+		t.Errorf("expected a 32 byte MAC, got %q", mac)
+	}
+
+	r := &Msg{Data: m.Data}
+	if err := r.Unpack(); err != nil {
+		t.Fatal(err)
+	}
+	if r.tsig() == nil || r.tsig().MAC != mac {
+		t.Fatalf("expected TSIG with MAC %s in pseudo section, got %v", mac, r.Pseudo)
+	}
+	if err := TsigVerify(r, tsigSecret, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := TsigVerify(r, "bm90IHRoZSBzZWNyZXQ=", "", false); err != ErrSig {
+		t.Errorf("expected %v with the wrong secret, got %v", ErrSig, err)
+	}
+	if err := tsigVerify(r.Data, tsigHMACProvider(tsigSecret), "", false, uint64(time.Now().Unix())+301); err != ErrTime {
+		t.Errorf("expected %v outside of the fudge window, got %v", ErrTime, err)
+	}
+
+	// Changing the message breaks the signature.
+	r.Data[2] |= 0x01
+	if err := TsigVerify(r, tsigSecret, "", false); err != ErrSig {
+		t.Errorf("expected %v for a changed message, got %v", ErrSig, err)
+	}
+}
+
+func TestClientTsig(t *testing.T) {
+	addr := serveLocal(t, "127.0.0.1:0", func(network string, req *Msg) *Msg {
+		r := new(Msg).SetReply(req)
+		rt := &TSIG{Hdr: Header{Name: req.tsig().Hdr.Name}, Algorithm: HmacSHA256}
+		r.Pseudo = []RR{rt}
+		if err := TsigVerify(req, tsigSecret, "", false); err != nil {
+			rt.Error = RcodeBadKey
+			r.Rcode = RcodeNotAuth
+		}
+		TsigGenerate(r, tsigSecret, req.tsig().MAC, false)
+		return r
+	})
+
+	c := &Client{TsigSecret: map[string]string{"test.": tsigSecret}}
+	m := newTsigMsg()
+	if err := m.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := c.Exchange(context.Background(), m, "udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.tsig() == nil {
+		t.Errorf("expected signed reply")
+	}
+	if m.tsig().MAC != "" {
+		t.Errorf("expected query to be left alone, got MAC %s", m.tsig().MAC)
+	}
+
+	// The key name is matched in canonical form.
+	m.Pseudo[0].Header().Name = "Test."
+	if _, _, err = c.Exchange(context.Background(), m, "udp", addr); err != nil {
+		t.Errorf("expected the key to be found for %q, got %v", "Test.", err)
+	}
+
+	c.TsigSecret["test."] = "bm90IHRoZSBzZWNyZXQ="
+	if _, _, err = c.Exchange(context.Background(), m, "udp", addr); !errors.Is(err, ErrBadKey) {
+		t.Errorf("expected %v, got %v", ErrBadKey, err)
+	}
+
+	c.TsigSecret = map[string]string{}
+	if _, _, err = c.Exchange(context.Background(), m, "udp", addr); !errors.Is(err, ErrSecret) {
+		t.Errorf("expected %v, got %v", ErrSecret, err)
+	}
+}
@@ -245,6 +245,30 @@ func (*ANY) parse(c *zlexer, origin string) *ParseError {
 	return &ParseError{err: "ANY records do not have a presentation format"}
 }
 
+// AXFR is the question of a full zone transfer. See RFC 5936.
+type AXFR struct {
+	Hdr Header
+	// Does not have any rdata
+}
+
+func (rr *AXFR) String() string { return rr.Hdr.String() }
+
+func (*AXFR) parse(c *zlexer, origin string) *ParseError {
+	return &ParseError{err: "AXFR records do not have a presentation format"}
+}
+
+// IXFR is the question of an incremental zone transfer. See RFC 1995.
+type IXFR struct {
+	Hdr Header
+	// Does not have any rdata
+}
+
+func (rr *IXFR) String() string { return rr.Hdr.String() }
+
+func (*IXFR) parse(c *zlexer, origin string) *ParseError {
+	return &ParseError{err: "IXFR records do not have a presentation format"}
+}
+
 // NULL RR. See RFC 1035.
 type NULL struct {
 	Hdr  Header
@@ -1097,6 +1121,36 @@ func (rr *TKEY) String() string {
 	return sb.String()
 }
 
+// TSIG RR. See RFC 8945. A TSIG record is put in the pseudo section of a message.
+type TSIG struct {
+	Hdr        Header
+	Algorithm  string `dns:"domain-name"`
+	TimeSigned uint64 `dns:"uint48"`
+	Fudge      uint16
+	MACSize    uint16
+	MAC        string `dns:"size-hex:MACSize"`
+	OrigID     uint16
+	Error      uint16
+	OtherLen   uint16
+	OtherData  string `dns:"size-hex:OtherLen"`
+}
+
+// TSIG has no official presentation format, but this will suffice.
+func (rr *TSIG) String() string {
+	sb := sprintHeader(rr)
+	sprintData(sb,
+		rr.Algorithm,
+		tsigTimeToString(rr.TimeSigned),
+		strconv.Itoa(int(rr.Fudge)),
+		strconv.Itoa(int(rr.MACSize)),
+		strings.ToUpper(rr.MAC),
+		strconv.Itoa(int(rr.OrigID)),
+		strconv.Itoa(int(rr.Error)),
+		strconv.Itoa(int(rr.OtherLen)),
+		rr.OtherData)
+	return sb.String()
+}
+
 // RFC3597 represents an unknown/generic RR. See RFC 3597.
 type RFC3597 struct {
 	Hdr   Header
@@ -0,0 +1,12 @@
+package validator
+
+import "github.com/miekg/dnsv2"
+
+// RootAnchors are the trust anchors of the root zone, as published by IANA in
+// https://data.iana.org/root-anchors/root-anchors.xml: KSK-2017 and KSK-2024.
+var RootAnchors = []*dns.DS{
+	{Hdr: dns.Header{Name: ".", Class: dns.ClassINET, TTL: 172800}, KeyTag: 20326, Algorithm: dns.RSASHA256, DigestType: dns.SHA256,
+		Digest: "e06d44b80b8f1d39a95c0b0d7c65d08458e880409bbc683457104237c7f8ec8d"},
+	{Hdr: dns.Header{Name: ".", Class: dns.ClassINET, TTL: 172800}, KeyTag: 38696, Algorithm: dns.RSASHA256, DigestType: dns.SHA256,
+		Digest: "683d2d0acb8c9b712a1948b27f741219298d0a450d612c483af444a4c0fb2b16"},
+}
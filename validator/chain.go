@@ -0,0 +1,279 @@
+package validator
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/miekg/dnsv2"
+	"github.com/miekg/dnsv2/dnsutil"
+)
+
+// zone is a zone with a validated DNSKEY RRset, or a provably insecure zone when keys is nil.
+type zone struct {
+	name   string
+	keys   []*dns.DNSKEY
+	expire time.Time
+	err    *Error // why an insecure zone is insecure, if it is worth an extended error
+}
+
+func (z *zone) secure() bool { return z.keys != nil }
+
+func (z *zone) errorOrNil() error {
+	if z.err == nil {
+		return nil
+	}
+	return z.err
+}
+
+// chain builds the chain of trust from a trust anchor down to name. It returns the closest zone at or above
+// name, which is secure, or the first insecure zone found on the way.
+func (v *Validator) chain(ctx context.Context, name string) (*zone, *Error) {
+	name = dnsutil.Canonical(name)
+	anchor := v.anchor(name)
+	if anchor == nil {
+		return nil, &Error{Result: Indeterminate, Code: dns.ExtendedErrorDNSSECIndeterminate, Reason: "no trust anchor for " + name}
+	}
+
+	apex := dnsutil.Canonical(anchor[0].Hdr.Name)
+	z, ok := v.cached(apex)
+	if !ok {
+		var err *Error
+		if z, err = v.trust(ctx, apex, anchor); err != nil {
+			return nil, err
+		}
+	}
+
+	// Walk down from the trust anchor to name, one label at a time, looking for zone cuts.
+	for n := dnsutil.Count(apex) + 1; n <= dnsutil.Count(name) && z.secure(); n++ {
+		i, _ := dnsutil.Prev(name, n)
+		child := name[i:]
+		if c, ok := v.cached(child); ok {
+			z = c
+			continue
+		}
+		next, stop, err := v.delegation(ctx, z, child)
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			next = z // child is not a zone cut, remember it belongs to z
+		}
+		v.store(child, next)
+		z = next
+		if stop {
+			break
+		}
+	}
+	return z, nil
+}
+
+// delegation looks up the DS records of child, whose parent zone is z. It returns the zone when child is a
+// zone cut, or nil when it is not. When child does not exist, stop is true.
+func (v *Validator) delegation(ctx context.Context, z *zone, child string) (_ *zone, stop bool, _ *Error) {
+	r, err := v.resolve(ctx, child, dns.TypeDS)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var ds []dns.RR
+	for _, rr := range r.Answer {
+		if _, ok := rr.(*dns.DS); ok && strings.EqualFold(rr.Header().Name, child) {
+			ds = append(ds, rr)
+		}
+	}
+	if len(ds) > 0 {
+		if _, err := v.verify(z, ds, signatures(r.Answer, ds[0].Header().Name, dns.TypeDS)); err != nil {
+			return nil, false, err
+		}
+		anchor := make([]*dns.DS, len(ds))
+		for i := range ds {
+			anchor[i] = ds[i].(*dns.DS)
+		}
+		next, err := v.trust(ctx, child, anchor)
+		return next, false, err
+	}
+
+	for _, rr := range r.Answer {
+		if _, ok := rr.(*dns.CNAME); ok && strings.EqualFold(rr.Header().Name, child) {
+			return nil, true, nil // a CNAME can not be at a zone cut, and nothing exists below it
+		}
+	}
+
+	d, err := v.denial(z, r.Ns)
+	if err != nil {
+		return nil, false, err
+	}
+	if r.Rcode == dns.RcodeNameError {
+		if !d.nameError(child) {
+			return nil, false, bogus(dns.ExtendedErrorNSECMissing, "no proof that %s does not exist", child)
+		}
+		return nil, true, nil
+	}
+	ok, insecure := d.noData(child, dns.TypeDS)
+	if !ok {
+		return nil, false, bogus(dns.ExtendedErrorNSECMissing, "no proof that %s has no DS records", child)
+	}
+	if insecure {
+		return &zone{name: child, expire: v.expire(r.Ns)}, false, nil
+	}
+	return nil, false, nil
+}
+
+// trust fetches the DNSKEY RRset of the zone name and validates it with the DS records in anchor.
+func (v *Validator) trust(ctx context.Context, name string, anchor []*dns.DS) (*zone, *Error) {
+	// DS records with unknown algorithms or digest types are ignored, if none are left the zone is
+	// treated as insecure, RFC 4035 section 5.2.
+	var supported []*dns.DS
+	code := dns.ExtendedErrorUnsupportedDSDigestType
+	for _, ds := range anchor {
+		if !supportedAlgorithm(ds.Algorithm) {
+			code = dns.ExtendedErrorUnsupportedDNSKEYAlgorithm
+			continue
+		}
+		if !supportedDigest(ds.DigestType) {
+			continue
+		}
+		supported = append(supported, ds)
+	}
+	if len(supported) == 0 {
+		z := &zone{name: name, expire: v.clock().Add(time.Duration(minTTL(anchorRRs(anchor))) * time.Second)}
+		z.err = &Error{Result: Insecure, Code: code, Reason: "no supported DS records for " + name}
+		v.store(name, z)
+		return z, nil
+	}
+
+	r, err := v.resolve(ctx, name, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var rrset []dns.RR
+	var keys []*dns.DNSKEY
+	for _, rr := range r.Answer {
+		if k, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(k.Hdr.Name, name) {
+			rrset = append(rrset, k)
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, bogus(dns.ExtendedErrorDNSKEYMissing, "no DNSKEY records for %s", name)
+	}
+	sigs := signatures(r.Answer, rrset[0].Header().Name, dns.TypeDNSKEY)
+
+	err = bogus(dns.ExtendedErrorDNSKEYMissing, "no DNSKEY for %s matches its DS records", name)
+	for _, ds := range supported {
+		for _, k := range keys {
+			if k.KeyTag() != ds.KeyTag || k.Algorithm != ds.Algorithm {
+				continue
+			}
+			if digest := k.ToDS(ds.DigestType); digest == nil || !strings.EqualFold(digest.Digest, ds.Digest) {
+				continue
+			}
+			if k.Flags&dns.ZONE == 0 || k.Flags&dns.REVOKE != 0 {
+				err = bogus(dns.ExtendedErrorNoZoneKeyBitSet, "DNSKEY %d for %s is not a zone key", ds.KeyTag, name)
+				continue
+			}
+			if _, e := v.verify(&zone{name: name, keys: []*dns.DNSKEY{k}}, rrset, sigs); e != nil {
+				err = e
+				continue
+			}
+			z := &zone{name: name, keys: keys, expire: v.expire(rrset)}
+			v.store(name, z)
+			return z, nil
+		}
+	}
+	return nil, err
+}
+
+// resolve looks up name and qtype with the Resolver.
+func (v *Validator) resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, *Error) {
+	r, err := v.Resolver.Resolve(ctx, name, qtype)
+	if err != nil {
+		return nil, &Error{Result: Indeterminate, Code: dns.ExtendedErrorDNSSECIndeterminate, Reason: "failed to look up " + name + " " + dns.TypeToString[qtype], Err: err}
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, &Error{Result: Indeterminate, Code: dns.ExtendedErrorDNSSECIndeterminate, Reason: "failed to look up " + name + " " + dns.TypeToString[qtype] + ": " + dns.RcodeToString[r.Rcode]}
+	}
+	return r, nil
+}
+
+// anchor returns the trust anchor closest to name.
+func (v *Validator) anchor(name string) []*dns.DS {
+	anchors := v.Anchors
+	if len(anchors) == 0 {
+		anchors = RootAnchors
+	}
+	var closest []*dns.DS
+	for _, ds := range anchors {
+		owner := dnsutil.Canonical(ds.Hdr.Name)
+		if !dnsutil.IsSubDomain(owner, name) {
+			continue
+		}
+		switch {
+		case len(closest) == 0 || dnsutil.Count(owner) > dnsutil.Count(closest[0].Hdr.Name):
+			closest = []*dns.DS{ds}
+		case dnsutil.Compare(owner, closest[0].Hdr.Name) == 0:
+			closest = append(closest, ds)
+		}
+	}
+	return closest
+}
+
+func (v *Validator) cached(name string) (*zone, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	z, ok := v.zones[name]
+	if !ok {
+		return nil, false
+	}
+	if !v.clock().Before(z.expire) {
+		delete(v.zones, name)
+		return nil, false
+	}
+	return z, true
+}
+
+func (v *Validator) store(name string, z *zone) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.zones == nil {
+		v.zones = map[string]*zone{}
+	}
+	v.zones[name] = z
+}
+
+// expire returns when the RRs in rrs expire.
+func (v *Validator) expire(rrs []dns.RR) time.Time {
+	return v.clock().Add(time.Duration(minTTL(rrs)) * time.Second)
+}
+
+func minTTL(rrs []dns.RR) uint32 {
+	if len(rrs) == 0 {
+		return 0
+	}
+	ttl := rrs[0].Header().TTL
+	for _, rr := range rrs[1:] {
+		ttl = min(ttl, rr.Header().TTL)
+	}
+	return ttl
+}
+
+func anchorRRs(anchor []*dns.DS) []dns.RR {
+	rrs := make([]dns.RR, len(anchor))
+	for i := range anchor {
+		rrs[i] = anchor[i]
+	}
+	return rrs
+}
+
+// supportedAlgorithm returns true if signatures with algorithm alg can be verified.
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+// supportedDigest returns true if DS records with digest type h can be checked.
+func supportedDigest(h uint8) bool { return h == dns.SHA1 || h == dns.SHA256 || h == dns.SHA384 }
@@ -0,0 +1,203 @@
+package validator
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/miekg/dnsv2"
+	"github.com/miekg/dnsv2/dnsutil"
+)
+
+// denial holds the validated NSEC and NSEC3 records of a reply, that prove the non-existence of names or
+// types in zone.
+type denial struct {
+	zone  string
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+}
+
+// nameError returns true if the records prove that name does not exist, and that there is no wildcard that
+// could have been expanded to it, RFC 4035 section 5.4 and RFC 5155 section 8.4.
+func (d *denial) nameError(name string) bool {
+	if len(d.nsec) > 0 {
+		covering := d.covering(name)
+		if covering == nil {
+			return false
+		}
+		return d.covering(wildcardAt(closestEncloser(name, covering))) != nil
+	}
+	if d.matching3(name) != nil {
+		return false
+	}
+	ce, _, ok := d.closestEncloser(name)
+	return ok && d.covering3(wildcardAt(ce)) != nil
+}
+
+// noData returns true if the records prove that name has no records of type qtype, RFC 4035 section 5.4 and
+// RFC 5155 sections 8.5 to 8.7. For DS records insecure is true when name is a delegation to an unsigned
+// zone: the NSEC or NSEC3 record has the NS bit but not the DS bit, or an opt-out NSEC3 record covers it.
+func (d *denial) noData(name string, qtype uint16) (ok, insecure bool) {
+	if len(d.nsec) > 0 {
+		for _, n := range d.nsec {
+			if dnsutil.Compare(n.Hdr.Name, name) == 0 {
+				return noType(n.TypeBitMap, qtype), qtype == dns.TypeDS && delegation(n.TypeBitMap)
+			}
+		}
+		covering := d.covering(name)
+		if covering == nil {
+			return false, false
+		}
+		// Empty non-terminal, the next name is below name.
+		if dnsutil.IsSubDomain(name, covering.NextDomain) && dnsutil.Compare(name, covering.NextDomain) != 0 {
+			return true, false
+		}
+		// Wildcard without the type.
+		wildcard := wildcardAt(closestEncloser(name, covering))
+		for _, n := range d.nsec {
+			if dnsutil.Compare(n.Hdr.Name, wildcard) == 0 {
+				return noType(n.TypeBitMap, qtype), false
+			}
+		}
+		return false, false
+	}
+
+	if n := d.matching3(name); n != nil {
+		return noType(n.TypeBitMap, qtype), qtype == dns.TypeDS && delegation(n.TypeBitMap)
+	}
+	ce, next, ok := d.closestEncloser(name)
+	if !ok {
+		return false, false
+	}
+	if qtype == dns.TypeDS {
+		// Opt-out, RFC 5155 section 8.6.
+		n := d.covering3(next)
+		return n.Flags&optOut != 0, true
+	}
+	// Wildcard without the type, RFC 5155 section 8.7.
+	if n := d.matching3(wildcardAt(ce)); n != nil {
+		return noType(n.TypeBitMap, qtype), false
+	}
+	return false, false
+}
+
+// wildcard returns true if the records prove that name does not exist, for an answer that was expanded from
+// the wildcard at closest, RFC 4035 section 5.3.4 and RFC 5155 section 8.8.
+func (d *denial) wildcard(name, closest string) bool {
+	if len(d.nsec) > 0 {
+		return d.covering(name) != nil
+	}
+	return d.covering3(ancestor(name, dnsutil.Count(closest)+1)) != nil
+}
+
+// covering returns the NSEC record that covers name, or nil if there is none.
+func (d *denial) covering(name string) *dns.NSEC {
+	for _, n := range d.nsec {
+		if !dnsutil.IsSubDomain(d.zone, n.Hdr.Name) || dnsutil.Compare(n.Hdr.Name, name) >= 0 {
+			continue
+		}
+		// The last NSEC record in the zone points back to the apex.
+		if dnsutil.Compare(n.NextDomain, n.Hdr.Name) <= 0 {
+			if dnsutil.IsSubDomain(d.zone, name) {
+				return n
+			}
+			continue
+		}
+		if dnsutil.Compare(name, n.NextDomain) < 0 {
+			return n
+		}
+	}
+	return nil
+}
+
+// closestEncloser returns the closest encloser proof for name, RFC 5155 section 8.3: the closest ancestor of
+// name that exists, ce, and the name one label longer, next, that does not exist.
+func (d *denial) closestEncloser(name string) (ce, next string, ok bool) {
+	next = name
+	for n := dnsutil.Count(name) - 1; n >= dnsutil.Count(d.zone); n-- {
+		ce = ancestor(name, n)
+		if d.matching3(ce) != nil {
+			return ce, next, d.covering3(next) != nil
+		}
+		next = ce
+	}
+	return "", "", false
+}
+
+// matching3 returns the NSEC3 record that matches name, or nil if there is none.
+func (d *denial) matching3(name string) *dns.NSEC3 {
+	for _, n := range d.nsec3 {
+		if d.usable(n) && n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// covering3 returns the NSEC3 record that covers name, or nil if there is none.
+func (d *denial) covering3(name string) *dns.NSEC3 {
+	for _, n := range d.nsec3 {
+		if d.usable(n) && n.Cover(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// usable returns true if n belongs to the zone and uses a hash algorithm that is known.
+func (d *denial) usable(n *dns.NSEC3) bool {
+	i, _ := dnsutil.Next(n.Hdr.Name, 0)
+	return n.Hash == dns.SHA1 && strings.EqualFold(n.Hdr.Name[i:], d.zone)
+}
+
+const optOut = 1 // NSEC3 opt-out flag, RFC 5155 section 3.1.2.1.
+
+// closestEncloser returns the closest encloser of name that is proven by the covering NSEC record: the
+// longest of the common ancestors of name with the owner and with the next name of the record.
+func closestEncloser(name string, covering *dns.NSEC) string {
+	a, b := commonAncestor(name, covering.Hdr.Name), commonAncestor(name, covering.NextDomain)
+	if dnsutil.Count(a) > dnsutil.Count(b) {
+		return a
+	}
+	return b
+}
+
+func commonAncestor(a, b string) string {
+	a, b = dnsutil.Canonical(a), dnsutil.Canonical(b)
+	for n := min(dnsutil.Count(a), dnsutil.Count(b)); n > 0; n-- {
+		if x := ancestor(a, n); dnsutil.Compare(x, ancestor(b, n)) == 0 {
+			return x
+		}
+	}
+	return "."
+}
+
+// ancestor returns the ancestor of name that has n labels.
+func ancestor(name string, n int) string {
+	if n == 0 {
+		return "."
+	}
+	i, _ := dnsutil.Prev(name, n)
+	return name[i:]
+}
+
+// wildcardAt returns the wildcard name directly below name.
+func wildcardAt(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// noType returns true if the type bitmap has neither qtype nor CNAME. The parent side of a delegation does
+// not prove anything about the types in the child zone.
+func noType(bitmap []uint16, qtype uint16) bool {
+	if slices.Contains(bitmap, qtype) || slices.Contains(bitmap, dns.TypeCNAME) {
+		return false
+	}
+	return qtype == dns.TypeDS || !delegation(bitmap)
+}
+
+// delegation returns true if the type bitmap is that of a delegation: it has NS, but not SOA.
+func delegation(bitmap []uint16) bool {
+	return slices.Contains(bitmap, dns.TypeNS) && !slices.Contains(bitmap, dns.TypeSOA)
+}
@@ -0,0 +1,74 @@
+package validator
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dnsv2"
+)
+
+// nsec3Chain returns the NSEC3 chain of a zone that has the names in types.
+func nsec3Chain(zone string, flags uint8, types map[string][]uint16) *denial {
+	hashes := map[string][]uint16{}
+	var owners []string
+	for name, bitmap := range types {
+		h := dns.HashName(name, dns.SHA1, 12, "AABBCCDD")
+		hashes[h] = bitmap
+		owners = append(owners, h)
+	}
+	slices.Sort(owners)
+
+	d := &denial{zone: zone}
+	for i, h := range owners {
+		d.nsec3 = append(d.nsec3, &dns.NSEC3{Hdr: dns.Header{Name: strings.ToLower(h) + "." + zone, Class: dns.ClassINET, TTL: 300},
+			Hash: dns.SHA1, Flags: flags, Iterations: 12, SaltLength: 4, Salt: "AABBCCDD", HashLength: 20,
+			NextDomain: owners[(i+1)%len(owners)], TypeBitMap: hashes[h]})
+	}
+	return d
+}
+
+func TestNSEC3Denial(t *testing.T) {
+	d := nsec3Chain("example.", 0, map[string][]uint16{
+		"example.":          {dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		"a.example.":        {dns.TypeA, dns.TypeRRSIG},
+		"w.example.":        nil,
+		"*.w.example.":      {dns.TypeA, dns.TypeRRSIG},
+		"unsigned.example.": {dns.TypeNS},
+	})
+
+	if !d.nameError("nope.example.") {
+		t.Error("expected name error for nope.example.")
+	}
+	if d.nameError("a.example.") {
+		t.Error("expected no name error for a.example.")
+	}
+	if ok, insecure := d.noData("a.example.", dns.TypeMX); !ok || insecure {
+		t.Errorf("expected secure NODATA for a.example. MX, got %t, %t", ok, insecure)
+	}
+	if ok, _ := d.noData("a.example.", dns.TypeA); ok {
+		t.Error("expected no NODATA proof for a.example. A")
+	}
+	if ok, insecure := d.noData("unsigned.example.", dns.TypeDS); !ok || !insecure {
+		t.Errorf("expected insecure delegation for unsigned.example., got %t, %t", ok, insecure)
+	}
+	if ok, _ := d.noData("x.w.example.", dns.TypeMX); !ok {
+		t.Error("expected wildcard NODATA for x.w.example. MX")
+	}
+	if !d.wildcard("x.w.example.", "w.example.") {
+		t.Error("expected proof that x.w.example. does not exist")
+	}
+	if ok, _ := d.noData("optout.example.", dns.TypeDS); ok {
+		t.Error("expected no NODATA proof for optout.example. DS without opt-out")
+	}
+}
+
+func TestNSEC3OptOut(t *testing.T) {
+	d := nsec3Chain("example.", optOut, map[string][]uint16{
+		"example.":   {dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		"a.example.": {dns.TypeNS, dns.TypeDS, dns.TypeRRSIG},
+	})
+	if ok, insecure := d.noData("optout.example.", dns.TypeDS); !ok || !insecure {
+		t.Errorf("expected insecure opt-out delegation for optout.example., got %t, %t", ok, insecure)
+	}
+}
@@ -0,0 +1,421 @@
+// Package validator implements a DNSSEC validator. Starting from a trust anchor it builds the chain of trust
+// down to the zone that signed a reply, by fetching and verifying the DS and DNSKEY records of each zone along
+// the way. It then verifies the signatures in the reply and the NSEC or NSEC3 records that prove the
+// non-existence of names and types, as described in RFC 4035 and RFC 5155.
+//
+//	v := &validator.Validator{Resolver: validator.Forward(&dns.Client{}, "192.0.2.53:53")}
+//	result, err := v.Validate(ctx, reply)
+package validator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dnsv2"
+	"github.com/miekg/dnsv2/dnsutil"
+)
+
+// Result is the outcome of a validation, see RFC 4035 section 4.3.
+type Result uint8
+
+const (
+	Indeterminate Result = iota // There is no trust anchor for the reply, or the chain of trust could not be fetched.
+	Secure                      // The reply is signed and there is a chain of trust from a trust anchor to its signer.
+	Insecure                    // The reply is in a zone that is provably not signed.
+	Bogus                       // The reply should be signed, but the signatures or denial of existence proofs are missing or wrong.
+)
+
+var resultToString = map[Result]string{
+	Indeterminate: "Indeterminate",
+	Secure:        "Secure",
+	Insecure:      "Insecure",
+	Bogus:         "Bogus",
+}
+
+func (r Result) String() string {
+	if s, ok := resultToString[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("Result%d", r)
+}
+
+// Error describes why a reply is not Secure. Code is the extended DNS error, one of the dns.ExtendedErrorXXX
+// constants, that goes with it.
+type Error struct {
+	Result Result
+	Code   uint16
+	Reason string
+	Err    error // Err is the underlying error, if any.
+}
+
+func (e *Error) Error() string {
+	s := "validator: " + strings.ToLower(e.Result.String()) + ": " + e.Reason
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// EDE returns the extended DNS error option for e, for use in the pseudo section of a reply.
+func (e *Error) EDE() *dns.EDE { return &dns.EDE{InfoCode: e.Code, ExtraText: e.Reason} }
+
+func bogus(code uint16, format string, a ...any) *Error {
+	return &Error{Result: Bogus, Code: code, Reason: fmt.Sprintf(format, a...)}
+}
+
+// A Resolver looks up the records the Validator needs. The replies must hold the DNSSEC records, so queries
+// must be sent with the DO bit set, and with the CD bit set when they go to a validating resolver.
+type Resolver interface {
+	Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+}
+
+// The ResolverFunc type is an adapter to allow the use of ordinary functions as a Resolver.
+type ResolverFunc func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+
+// Resolve calls f(ctx, name, qtype).
+func (f ResolverFunc) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return f(ctx, name, qtype)
+}
+
+// Forward returns a Resolver that sends its queries, with the DO and CD bits set, to the recursive name
+// server at address using c.
+func Forward(c *dns.Client, address string) Resolver {
+	return ResolverFunc(func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+		q := dns.TypeToRR[qtype]()
+		*q.Header() = dns.Header{Name: name, Class: dns.ClassINET}
+		m := &dns.Msg{MsgHeader: dns.MsgHeader{ID: dns.ID(), RecursionDesired: true, CheckingDisabled: true}, Question: []dns.RR{q}}
+		m.UDPSize, m.Security = udpSize, true
+		if err := m.Pack(); err != nil {
+			return nil, err
+		}
+		r, _, _, err := c.ExchangeWithFallback(ctx, m, address)
+		return r, err
+	})
+}
+
+const udpSize = 1232 // EDNS0 buffer size advertised by Forward, see https://dnsflagday.net/2020/
+
+// A Validator validates DNS replies. The DNSKEY records it validates, and the insecure delegations it finds,
+// are cached for their TTL.
+type Validator struct {
+	// Resolver is used to fetch the DS and DNSKEY records of the zones.
+	Resolver Resolver
+	// Anchors are the trust anchors, if empty RootAnchors is used.
+	Anchors []*dns.DS
+
+	mu    sync.Mutex
+	zones map[string]*zone // keyed on the canonical name
+
+	now func() time.Time // for testing
+}
+
+// Validate validates the reply m. For a Secure or Insecure reply the error is nil, except when a zone is
+// Insecure because its DS records only use algorithms or digest types that are not supported, then an
+// *Error with the extended error code is returned. For Bogus and Indeterminate replies the error is an *Error.
+//
+// All RRsets in the answer section must validate. When the answer does not hold the data asked for, the
+// NSEC or NSEC3 records in the authority section must prove that the name, or the type, does not exist.
+// Wildcard expansions must be accompanied by a proof that the name itself does not exist.
+func (v *Validator) Validate(ctx context.Context, m *dns.Msg) (Result, error) {
+	if len(m.Question) == 0 {
+		return Indeterminate, &Error{Result: Indeterminate, Code: dns.ExtendedErrorDNSSECIndeterminate, Reason: "no question"}
+	}
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return Indeterminate, &Error{Result: Indeterminate, Code: dns.ExtendedErrorDNSSECIndeterminate, Reason: "rcode " + dns.RcodeToString[m.Rcode]}
+	}
+	qname, qtype := m.Question[0].Header().Name, dns.RRToType(m.Question[0])
+
+	result, detail := Secure, error(nil)
+	combine := func(r Result, err error) bool {
+		if r == Secure {
+			return true
+		}
+		if r == Insecure {
+			result = Insecure
+			if detail == nil {
+				detail = err
+			}
+			return true
+		}
+		result, detail = r, err
+		return false
+	}
+
+	for _, set := range rrsets(m.Answer) {
+		if synthesized(set, m.Answer) {
+			continue
+		}
+		if !combine(v.validate(ctx, set, m)) {
+			return result, detail
+		}
+	}
+
+	target, found := follow(m.Answer, qname, qtype)
+	if found {
+		return result, detail
+	}
+	combine(v.deny(ctx, target, qtype, m))
+	return result, detail
+}
+
+// validate validates a single RRset from m.
+func (v *Validator) validate(ctx context.Context, set []dns.RR, m *dns.Msg) (Result, error) {
+	owner, rrtype := set[0].Header().Name, dns.RRToType(set[0])
+	sigs := signatures(m.Answer, owner, rrtype)
+	if len(sigs) == 0 {
+		z, err := v.chain(ctx, owner)
+		if err != nil {
+			return err.Result, err
+		}
+		if !z.secure() {
+			return Insecure, z.errorOrNil()
+		}
+		return Bogus, bogus(dns.ExtendedErrorRRSIGsMissing, "no signatures for %s %s", owner, dns.TypeToString[rrtype])
+	}
+
+	signer := dnsutil.Canonical(sigs[0].SignerName)
+	if !dnsutil.IsSubDomain(signer, owner) {
+		return Bogus, bogus(dns.ExtendedErrorDNSBogus, "signer %s is not a parent of %s", signer, owner)
+	}
+	z, err := v.chain(ctx, signer)
+	if err != nil {
+		return err.Result, err
+	}
+	if !z.secure() {
+		return Insecure, z.errorOrNil()
+	}
+	if z.name != signer {
+		return Bogus, bogus(dns.ExtendedErrorDNSKEYMissing, "signer %s is not a zone", signer)
+	}
+	sig, err := v.verify(z, set, sigs)
+	if err != nil {
+		return Bogus, err
+	}
+
+	// Wildcard expansion, the owner name itself must not exist, RFC 4035 section 5.3.4. The labels of the
+	// RRSIG do not count a leading "*", a wildcard owner name itself is not an expansion.
+	labels := dnsutil.Count(owner)
+	if strings.HasPrefix(owner, "*.") {
+		labels--
+	}
+	if int(sig.Labels) < labels {
+		d, err := v.denial(z, m.Ns)
+		if err != nil {
+			return Bogus, err
+		}
+		if !d.wildcard(owner, ancestor(owner, int(sig.Labels))) {
+			return Bogus, bogus(dns.ExtendedErrorNSECMissing, "no proof that %s does not exist for wildcard answer", owner)
+		}
+	}
+	return Secure, nil
+}
+
+// deny validates the proof in m that name does not exist, or that it has no qtype records.
+func (v *Validator) deny(ctx context.Context, name string, qtype uint16, m *dns.Msg) (Result, error) {
+	signer := ""
+	for _, rr := range m.Ns {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			signer = dnsutil.Canonical(sig.SignerName)
+			break
+		}
+	}
+	if signer == "" {
+		z, err := v.chain(ctx, name)
+		if err != nil {
+			return err.Result, err
+		}
+		if !z.secure() {
+			return Insecure, z.errorOrNil()
+		}
+		return Bogus, bogus(dns.ExtendedErrorNSECMissing, "no signed denial of existence for %s", name)
+	}
+
+	if !dnsutil.IsSubDomain(signer, name) {
+		return Bogus, bogus(dns.ExtendedErrorDNSBogus, "signer %s is not a parent of %s", signer, name)
+	}
+	z, err := v.chain(ctx, signer)
+	if err != nil {
+		return err.Result, err
+	}
+	if !z.secure() {
+		return Insecure, z.errorOrNil()
+	}
+	if z.name != signer {
+		return Bogus, bogus(dns.ExtendedErrorDNSKEYMissing, "signer %s is not a zone", signer)
+	}
+	d, err := v.denial(z, m.Ns)
+	if err != nil {
+		return Bogus, err
+	}
+
+	if m.Rcode == dns.RcodeNameError {
+		if !d.nameError(name) {
+			return Bogus, bogus(dns.ExtendedErrorNSECMissing, "no proof that %s does not exist", name)
+		}
+		return Secure, nil
+	}
+	ok, insecure := d.noData(name, qtype)
+	if !ok {
+		return Bogus, bogus(dns.ExtendedErrorNSECMissing, "no proof that %s has no %s records", name, dns.TypeToString[qtype])
+	}
+	// The absence of DS records at an unsigned delegation is itself proven, only an opt-out NSEC3 record
+	// leaves the answer insecure, RFC 5155 section 9.2.
+	if insecure && len(d.nsec) == 0 && d.matching3(name) == nil {
+		return Insecure, nil
+	}
+	return Secure, nil
+}
+
+// verify verifies the RRset with one of the signatures in sigs and the keys of z. The signature that
+// verified is returned.
+func (v *Validator) verify(z *zone, rrset []dns.RR, sigs []*dns.RRSIG) (*dns.RRSIG, *Error) {
+	owner, rrtype := rrset[0].Header().Name, dns.TypeToString[dns.RRToType(rrset[0])]
+	if len(sigs) == 0 {
+		return nil, bogus(dns.ExtendedErrorRRSIGsMissing, "no signatures for %s %s", owner, rrtype)
+	}
+	now := v.clock()
+	err := bogus(dns.ExtendedErrorDNSKEYMissing, "no DNSKEY in %s for the signatures of %s %s", z.name, owner, rrtype)
+	for _, sig := range sigs {
+		if dnsutil.Canonical(sig.SignerName) != z.name || int(sig.Labels) > dnsutil.Count(owner) {
+			continue
+		}
+		for _, k := range z.keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				if int32(sig.Inception-uint32(now.Unix())) > 0 {
+					err = bogus(dns.ExtendedErrorSignatureNotYetValid, "signature of %s %s is not yet valid", owner, rrtype)
+				} else {
+					err = bogus(dns.ExtendedErrorSignatureExpired, "signature of %s %s has expired", owner, rrtype)
+				}
+				continue
+			}
+			if e := sig.Verify(k, rrset); e != nil {
+				err = bogus(dns.ExtendedErrorDNSBogus, "signature of %s %s does not verify", owner, rrtype)
+				err.Err = e
+				continue
+			}
+			return sig, nil
+		}
+	}
+	return nil, err
+}
+
+// denial returns the NSEC and NSEC3 records from rrs that are verified with the keys of z.
+func (v *Validator) denial(z *zone, rrs []dns.RR) (*denial, *Error) {
+	d := &denial{zone: z.name}
+	for _, set := range rrsets(rrs) {
+		switch set[0].(type) {
+		case *dns.NSEC, *dns.NSEC3:
+		default:
+			continue
+		}
+		h := set[0].Header()
+		if _, err := v.verify(z, set, signatures(rrs, h.Name, dns.RRToType(set[0]))); err != nil {
+			return nil, err
+		}
+		for _, rr := range set {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				d.nsec = append(d.nsec, rr)
+			case *dns.NSEC3:
+				d.nsec3 = append(d.nsec3, rr)
+			}
+		}
+	}
+	return d, nil
+}
+
+func (v *Validator) clock() time.Time {
+	if v.now != nil {
+		return v.now()
+	}
+	return time.Now()
+}
+
+// rrsets groups the RRs in rrs, except the RRSIGs, in RRsets.
+func rrsets(rrs []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+Next:
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			continue
+		}
+		h := rr.Header()
+		for i, set := range sets {
+			h0 := set[0].Header()
+			if dns.RRToType(set[0]) == dns.RRToType(rr) && h0.Class == h.Class && h0.Name == h.Name {
+				sets[i] = append(set, rr)
+				continue Next
+			}
+		}
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets
+}
+
+// signatures returns the RRSIGs in rrs that cover the RRset with name and type rrtype.
+func signatures(rrs []dns.RR, name string, rrtype uint16) []*dns.RRSIG {
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype && strings.EqualFold(sig.Hdr.Name, name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// follow follows the CNAME records in answer starting at name. It returns the name it ends up at and
+// whether there are qtype records for that name.
+func follow(answer []dns.RR, name string, qtype uint16) (string, bool) {
+	for range len(answer) + 1 {
+		next := ""
+		for _, rr := range answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) {
+				continue
+			}
+			rrtype := dns.RRToType(rr)
+			if rrtype == qtype || qtype == dns.TypeANY {
+				return name, true
+			}
+			if c, ok := rr.(*dns.CNAME); ok {
+				next = c.Target
+			}
+		}
+		if next == "" {
+			return name, false
+		}
+		name = next
+	}
+	return name, false
+}
+
+// synthesized returns true if set is an unsigned CNAME that is synthesized from a DNAME in answer, as
+// described in RFC 6672 section 5.3.3.
+func synthesized(set []dns.RR, answer []dns.RR) bool {
+	cname, ok := set[0].(*dns.CNAME)
+	if !ok || len(set) != 1 || len(signatures(answer, cname.Hdr.Name, dns.TypeCNAME)) > 0 {
+		return false
+	}
+	for _, rr := range answer {
+		dname, ok := rr.(*dns.DNAME)
+		if !ok || !dnsutil.IsSubDomain(dname.Hdr.Name, cname.Hdr.Name) || dnsutil.Compare(dname.Hdr.Name, cname.Hdr.Name) == 0 {
+			continue
+		}
+		target := cname.Hdr.Name[:len(cname.Hdr.Name)-len(dname.Hdr.Name)] + dnsutil.Fqdn(dname.Target)
+		if dname.Target == "." {
+			target = cname.Hdr.Name[:len(cname.Hdr.Name)-len(dname.Hdr.Name)]
+		}
+		if strings.EqualFold(target, cname.Target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,343 @@
+package validator
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dnsv2"
+	"github.com/miekg/dnsv2/dnsutil"
+)
+
+// testZone is an authoritative zone, that is signed with an ED25519 key when it has one.
+type testZone struct {
+	origin string
+	key    *dns.DNSKEY
+	priv   ed25519.PrivateKey
+	rrs    []dns.RR
+}
+
+func newTestZone(t *testing.T, origin string, signed bool, records ...string) *testZone {
+	t.Helper()
+	z := &testZone{origin: origin}
+	for _, s := range records {
+		z.rrs = append(z.rrs, mustRR(t, s))
+	}
+	if signed {
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		z.priv = priv
+		z.key = &dns.DNSKEY{Hdr: dns.Header{Name: origin, Class: dns.ClassINET, TTL: 3600}, Flags: dns.ZONE | dns.SEP,
+			Protocol: 3, Algorithm: dns.ED25519, PublicKey: base64.StdEncoding.EncodeToString(pub)}
+		z.rrs = append(z.rrs, z.key)
+	}
+	return z
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.New(s)
+	if err != nil {
+		t.Fatalf("bad record %q: %v", s, err)
+	}
+	return rr
+}
+
+func (z *testZone) ds() *dns.DS { return z.key.ToDS(dns.SHA256) }
+
+// sign adds the NSEC chain and signs all authoritative RRsets, with a validity period around now.
+func (z *testZone) sign(t *testing.T, now time.Time) {
+	t.Helper()
+	if z.key == nil {
+		return
+	}
+	types := map[string][]uint16{}
+	var names []string
+	for _, rr := range z.rrs {
+		name := dnsutil.Canonical(rr.Header().Name)
+		if z.glue(name) {
+			continue
+		}
+		if _, ok := types[name]; !ok {
+			names = append(names, name)
+		}
+		types[name] = append(types[name], dns.RRToType(rr))
+	}
+	slices.SortFunc(names, dnsutil.Compare)
+	for i, name := range names {
+		bitmap := append(types[name], dns.TypeNSEC, dns.TypeRRSIG)
+		slices.Sort(bitmap)
+		z.rrs = append(z.rrs, &dns.NSEC{Hdr: dns.Header{Name: name, Class: dns.ClassINET, TTL: 300},
+			NextDomain: names[(i+1)%len(names)], TypeBitMap: slices.Compact(bitmap)})
+	}
+
+	for _, set := range rrsets(z.rrs) {
+		h := set[0].Header()
+		rrtype := dns.RRToType(set[0])
+		if z.glue(h.Name) || (rrtype == dns.TypeNS && h.Name != z.origin) {
+			continue
+		}
+		sig := &dns.RRSIG{Hdr: dns.Header{TTL: h.TTL}, KeyTag: z.key.KeyTag(), SignerName: z.origin, Algorithm: dns.ED25519,
+			Inception: uint32(now.Add(-time.Hour).Unix()), Expiration: uint32(now.Add(24 * time.Hour).Unix())}
+		if err := sig.Sign(z.priv, set); err != nil {
+			t.Fatal(err)
+		}
+		z.rrs = append(z.rrs, sig)
+	}
+}
+
+// glue returns true if name is below a delegation in z.
+func (z *testZone) glue(name string) bool {
+	for _, rr := range z.rrs {
+		if _, ok := rr.(*dns.NS); ok && rr.Header().Name != z.origin && dnsutil.IsSubDomain(rr.Header().Name, name) &&
+			dnsutil.Compare(rr.Header().Name, name) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the RRs with name and rrtype, with their signatures.
+func (z *testZone) lookup(name string, rrtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.rrs {
+		if dnsutil.Compare(rr.Header().Name, name) != 0 {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); (ok && sig.TypeCovered == rrtype) || (!ok && dns.RRToType(rr) == rrtype) {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// nsec returns the NSEC record that matches or covers name, with its signature.
+func (z *testZone) nsec(name string) []dns.RR {
+	d := &denial{zone: z.origin}
+	for _, rr := range z.rrs {
+		if n, ok := rr.(*dns.NSEC); ok {
+			d.nsec = append(d.nsec, n)
+		}
+	}
+	for _, n := range d.nsec {
+		if dnsutil.Compare(n.Hdr.Name, name) == 0 {
+			return z.lookup(n.Hdr.Name, dns.TypeNSEC)
+		}
+	}
+	if n := d.covering(name); n != nil {
+		return z.lookup(n.Hdr.Name, dns.TypeNSEC)
+	}
+	return nil
+}
+
+func (z *testZone) answer(name string, qtype uint16) *dns.Msg {
+	m := &dns.Msg{MsgHeader: dns.MsgHeader{Response: true, Authoritative: true}, Question: []dns.RR{question(name, qtype)}}
+	if rrs := z.lookup(name, qtype); len(rrs) > 0 {
+		m.Answer = rrs
+		return m
+	}
+	if rrs := z.lookup(name, dns.TypeCNAME); len(rrs) > 0 {
+		m.Answer = rrs
+		return m
+	}
+
+	exists, ce := false, z.origin
+	for _, rr := range z.rrs {
+		owner := rr.Header().Name
+		if dnsutil.IsSubDomain(name, owner) {
+			exists = true
+		}
+		if a := commonAncestor(owner, name); dnsutil.Count(a) > dnsutil.Count(ce) {
+			ce = a
+		}
+	}
+	soa := z.lookup(z.origin, dns.TypeSOA)
+	switch {
+	case exists:
+		m.Ns = append(soa, z.nsec(name)...)
+	case len(z.lookup(wildcardAt(ce), qtype)) > 0:
+		for _, rr := range z.lookup(wildcardAt(ce), qtype) {
+			rr, _ = dns.New(rr.String())
+			rr.Header().Name = name
+			m.Answer = append(m.Answer, rr)
+		}
+		m.Ns = z.nsec(name)
+	default:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(soa, z.nsec(name)...)
+		if wc := z.nsec(wildcardAt(ce)); len(wc) > 0 && wc[0] != m.Ns[len(soa)] {
+			m.Ns = append(m.Ns, wc...)
+		}
+	}
+	return m
+}
+
+func question(name string, qtype uint16) dns.RR {
+	q := dns.TypeToRR[qtype]()
+	*q.Header() = dns.Header{Name: name, Class: dns.ClassINET}
+	return q
+}
+
+// testResolver answers from the deepest zone that holds a name, DS queries are answered by the parent zone.
+type testResolver []*testZone
+
+func (r testResolver) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	var best, parent *testZone
+	for _, z := range r {
+		if !dnsutil.IsSubDomain(z.origin, name) {
+			continue
+		}
+		if best == nil || dnsutil.Count(z.origin) > dnsutil.Count(best.origin) {
+			best, parent = z, best
+		} else if parent == nil || dnsutil.Count(z.origin) > dnsutil.Count(parent.origin) {
+			parent = z
+		}
+	}
+	if qtype == dns.TypeDS && dnsutil.Compare(best.origin, name) == 0 && parent != nil {
+		best = parent
+	}
+	return best.answer(name, qtype), nil
+}
+
+func testZones(t *testing.T, now time.Time) testResolver {
+	example := newTestZone(t, "example.org.", true,
+		"example.org. IN SOA ns.example.org. hostmaster.example.org. 1 7200 3600 1209600 300",
+		"example.org. IN NS ns.example.org.",
+		"ns.example.org. IN A 192.0.2.53",
+		"www.example.org. IN A 192.0.2.1",
+		"alias.example.org. IN CNAME www.example.org.",
+		"host.sub.example.org. IN A 192.0.2.2",
+		"*.wild.example.org. IN A 192.0.2.3",
+	)
+	insecure := newTestZone(t, "insecure.org.", false,
+		"insecure.org. IN SOA ns.insecure.org. hostmaster.insecure.org. 1 7200 3600 1209600 300",
+		"www.insecure.org. IN A 192.0.2.4",
+	)
+	org := newTestZone(t, "org.", true,
+		"org. IN SOA ns.org. hostmaster.org. 1 7200 3600 1209600 300",
+		"org. IN NS ns.org.",
+		"example.org. IN NS ns.example.org.",
+		"insecure.org. IN NS ns.insecure.org.",
+	)
+	root := newTestZone(t, ".", true,
+		". IN SOA a.root. hostmaster.root. 1 7200 3600 1209600 300",
+		". IN NS a.root.",
+		"org. IN NS ns.org.",
+	)
+	example.sign(t, now)
+	org.rrs = append(org.rrs, example.ds())
+	org.sign(t, now)
+	root.rrs = append(root.rrs, org.ds())
+	root.sign(t, now)
+	return testResolver{root, org, example, insecure}
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	zones := testZones(t, time.Now())
+	v := &Validator{Resolver: zones, Anchors: []*dns.DS{zones[0].ds()}}
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  uint16
+		result Result
+	}{
+		{"www.example.org.", dns.TypeA, dns.RcodeSuccess, Secure},
+		{"WWW.Example.ORG.", dns.TypeA, dns.RcodeSuccess, Secure},
+		{"alias.example.org.", dns.TypeA, dns.RcodeSuccess, Secure},
+		{"www.example.org.", dns.TypeMX, dns.RcodeSuccess, Secure},        // NODATA
+		{"sub.example.org.", dns.TypeA, dns.RcodeSuccess, Secure},         // NODATA for an empty non-terminal
+		{"nope.example.org.", dns.TypeA, dns.RcodeNameError, Secure},      // NXDOMAIN
+		{"a.wild.example.org.", dns.TypeA, dns.RcodeSuccess, Secure},      // wildcard
+		{"a.b.wild.example.org.", dns.TypeA, dns.RcodeSuccess, Secure},    // wildcard, two labels deep
+		{"*.wild.example.org.", dns.TypeA, dns.RcodeSuccess, Secure},      // the wildcard itself
+		{"www.insecure.org.", dns.TypeA, dns.RcodeSuccess, Insecure},      // insecure delegation
+		{"nope.insecure.org.", dns.TypeA, dns.RcodeNameError, Insecure},   // unsigned NXDOMAIN in an insecure zone
+		{"example.org.", dns.TypeDS, dns.RcodeSuccess, Secure},            // answered by the parent
+		{"insecure.org.", dns.TypeDS, dns.RcodeSuccess, Secure},           // NODATA from the parent
+		{"nope.example.org.", dns.TypeDNSKEY, dns.RcodeNameError, Secure}, // NXDOMAIN for another type
+	}
+	for _, tc := range tests {
+		m := query(t, zones, tc.name, tc.qtype)
+		if m.Rcode != tc.rcode {
+			t.Fatalf("%s %s: expected rcode %s, got %s", tc.name, dns.TypeToString[tc.qtype], dns.RcodeToString[tc.rcode], dns.RcodeToString[m.Rcode])
+		}
+		result, err := v.Validate(ctx, m)
+		if result != tc.result || err != nil {
+			t.Errorf("%s %s: expected %s, got %s: %v", tc.name, dns.TypeToString[tc.qtype], tc.result, result, err)
+		}
+	}
+}
+
+func TestValidateBogus(t *testing.T) {
+	ctx := context.Background()
+	zones := testZones(t, time.Now())
+	v := &Validator{Resolver: zones, Anchors: []*dns.DS{zones[0].ds()}}
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		modify func(m *dns.Msg)
+		code   uint16
+	}{
+		{"www.example.org.", dns.TypeA, func(m *dns.Msg) { m.Answer[0].(*dns.A).A[3] = 99 }, dns.ExtendedErrorDNSBogus},
+		{"www.example.org.", dns.TypeA, func(m *dns.Msg) { m.Answer = m.Answer[:1] }, dns.ExtendedErrorRRSIGsMissing},
+		{"www.example.org.", dns.TypeA, func(m *dns.Msg) { m.Answer[1].(*dns.RRSIG).KeyTag++ }, dns.ExtendedErrorDNSKEYMissing},
+		{"nope.example.org.", dns.TypeA, func(m *dns.Msg) { m.Ns = m.Ns[:2] }, dns.ExtendedErrorNSECMissing},
+		{"www.example.org.", dns.TypeMX, func(m *dns.Msg) { m.Ns = m.Ns[:2] }, dns.ExtendedErrorNSECMissing},
+		{"a.wild.example.org.", dns.TypeA, func(m *dns.Msg) { m.Ns = nil }, dns.ExtendedErrorNSECMissing},
+		{"www.example.org.", dns.TypeAAAA, func(m *dns.Msg) { m.Rcode = dns.RcodeNameError }, dns.ExtendedErrorNSECMissing},
+	}
+	for i, tc := range tests {
+		m := query(t, zones, tc.name, tc.qtype)
+		tc.modify(m)
+		result, err := v.Validate(ctx, m)
+		verr := &Error{}
+		if result != Bogus || !errors.As(err, &verr) || verr.Code != tc.code {
+			t.Errorf("test %d, %s %s: expected %s with %q, got %s: %v", i, tc.name, dns.TypeToString[tc.qtype],
+				Bogus, dns.ExtendedErrorToString[tc.code], result, err)
+		}
+	}
+
+	// Signatures have expired.
+	v = &Validator{Resolver: zones, Anchors: []*dns.DS{zones[0].ds()}, now: func() time.Time { return time.Now().Add(48 * time.Hour) }}
+	result, err := v.Validate(ctx, query(t, zones, "www.example.org.", dns.TypeA))
+	if verr := (&Error{}); result != Bogus || !errors.As(err, &verr) || verr.Code != dns.ExtendedErrorSignatureExpired {
+		t.Errorf("expected %s with expired signatures, got %s: %v", Bogus, result, err)
+	}
+
+	// Trust anchor does not match the root key.
+	other := testZones(t, time.Now())
+	v = &Validator{Resolver: zones, Anchors: []*dns.DS{other[0].ds()}}
+	result, err = v.Validate(ctx, query(t, zones, "www.example.org.", dns.TypeA))
+	if verr := (&Error{}); result != Bogus || !errors.As(err, &verr) || verr.Code != dns.ExtendedErrorDNSKEYMissing {
+		t.Errorf("expected %s with a wrong trust anchor, got %s: %v", Bogus, result, err)
+	}
+
+	// No trust anchor.
+	anchor := zones[0].ds()
+	anchor.Hdr.Name = "com."
+	v = &Validator{Resolver: zones, Anchors: []*dns.DS{anchor}}
+	result, err = v.Validate(ctx, query(t, zones, "www.example.org.", dns.TypeA))
+	if verr := (&Error{}); result != Indeterminate || !errors.As(err, &verr) || verr.Code != dns.ExtendedErrorDNSSECIndeterminate {
+		t.Errorf("expected %s without a trust anchor, got %s: %v", Indeterminate, result, err)
+	}
+}
+
+// query resolves name and qtype, following a CNAME like a recursive name server would.
+func query(t *testing.T, zones testResolver, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	m, _ := zones.Resolve(context.Background(), name, qtype)
+	if len(m.Answer) > 0 {
+		if cname, ok := m.Answer[0].(*dns.CNAME); ok && qtype != dns.TypeCNAME {
+			r := query(t, zones, cname.Target, qtype)
+			m.Answer = append(m.Answer, r.Answer...)
+			m.Ns, m.Rcode = r.Ns, r.Rcode
+		}
+	}
+	return m
+}
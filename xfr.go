@@ -1,9 +1,10 @@
-//go:build ignore
-
 package dns
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
+	"net"
 	"time"
 )
 
@@ -15,12 +16,15 @@ type Envelope struct {
 
 // A Transfer defines parameters that are used during a zone transfer.
 type Transfer struct {
-	*Conn
+	// Conn is the connection used for the transfer. If nil, a TCP connection to the address given to In is
+	// dialed.
+	Conn           net.Conn
 	DialTimeout    time.Duration     // net.DialTimeout, defaults to 2 seconds
 	ReadTimeout    time.Duration     // net.Conn.SetReadTimeout value for connections, defaults to 2 seconds
 	WriteTimeout   time.Duration     // net.Conn.SetWriteTimeout value for connections, defaults to 2 seconds
 	TsigProvider   TsigProvider      // An implementation of the TsigProvider interface. If defined it replaces TsigSecret and is used for all TSIG operations.
 	TsigSecret     map[string]string // Secret(s) for Tsig map[<zonename>]<base64 secret>, zonename must be in canonical form (lowercase, fqdn, see RFC 4034 Section 6.2)
+	tsigRequestMAC string
 	tsigTimersOnly bool
 }
 
@@ -34,68 +38,74 @@ func (t *Transfer) tsigProvider() TsigProvider {
 	return nil
 }
 
-// TODO: Think we need to away to stop the transfer
-
-// In performs an incoming transfer with the server in a.
-// If you would like to set the source IP, or some other attribute
-// of a Dialer for a Transfer, you can do so by specifying the attributes
-// in the Transfer.Conn:
+// In performs an incoming transfer with the server in address. The transfer is stopped when ctx is done.
+// If you would like to set the source IP, or some other attribute of a Dialer for a Transfer, you can do so
+// by specifying the attributes in the Transfer.Conn:
 //
 //	d := net.Dialer{LocalAddr: transfer_source}
 //	con, err := d.Dial("tcp", master)
-//	dnscon := &dns.Conn{Conn:con}
-//	transfer = &dns.Transfer{Conn: dnscon}
-//	channel, err := transfer.In(message, master)
-func (t *Transfer) In(q *Msg, a string) (env chan *Envelope, err error) {
-	switch q.Question[0].Qtype {
-	case TypeAXFR, TypeIXFR:
-	default:
-		return nil, &Error{"unsupported question type"}
+//	transfer = &dns.Transfer{Conn: con}
+//	channel, err := transfer.In(ctx, message, master)
+func (t *Transfer) In(ctx context.Context, q *Msg, address string) (env chan *Envelope, err error) {
+	if len(q.Question) == 0 {
+		return nil, &Error{err: "unsupported question type"}
 	}
-
-	timeout := dnsTimeout
-	if t.DialTimeout != 0 {
-		timeout = t.DialTimeout
+	qtype := RRToType(q.Question[0])
+	switch qtype {
+	case TypeAXFR:
+	case TypeIXFR:
+		if len(q.Ns) == 0 {
+			return nil, ErrSoa
+		}
+		if _, ok := q.Ns[0].(*SOA); !ok {
+			return nil, ErrSoa
+		}
+	default:
+		return nil, &Error{err: "unsupported question type"}
 	}
 
 	if t.Conn == nil {
-		t.Conn, err = DialTimeout("tcp", a, timeout)
+		d := net.Dialer{Timeout: dnsTimeout}
+		if t.DialTimeout != 0 {
+			d.Timeout = t.DialTimeout
+		}
+		t.Conn, err = d.DialContext(ctx, "tcp", address)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if err := t.WriteMsg(q); err != nil {
+		t.Conn.Close()
 		return nil, err
 	}
 
 	env = make(chan *Envelope)
-	switch q.Question[0].Qtype {
-	case TypeAXFR:
-		go t.inAxfr(q, env)
-	case TypeIXFR:
-		go t.inIxfr(q, env)
-	}
+	stop := context.AfterFunc(ctx, func() { t.Conn.SetReadDeadline(aLongTimeAgo) })
+	go func() {
+		defer stop()
+		switch qtype {
+		case TypeAXFR:
+			t.inAxfr(ctx, q, env)
+		case TypeIXFR:
+			t.inIxfr(ctx, q, env)
+		}
+	}()
 
 	return env, nil
 }
 
-func (t *Transfer) inAxfr(q *Msg, c chan *Envelope) {
+func (t *Transfer) inAxfr(ctx context.Context, q *Msg, c chan *Envelope) {
 	first := true
 	defer t.Close()
 	defer close(c)
-	timeout := dnsTimeout
-	if t.ReadTimeout != 0 {
-		timeout = t.ReadTimeout
-	}
 	for {
-		t.Conn.SetReadDeadline(time.Now().Add(timeout))
-		in, err := t.ReadMsg()
+		in, err := t.read(ctx)
 		if err != nil {
 			c <- &Envelope{nil, err}
 			return
 		}
-		if q.Id != in.Id {
+		if q.ID != in.ID {
 			c <- &Envelope{in.Answer, ErrId}
 			return
 		}
@@ -128,25 +138,20 @@ func (t *Transfer) inAxfr(q *Msg, c chan *Envelope) {
 	}
 }
 
-func (t *Transfer) inIxfr(q *Msg, c chan *Envelope) {
+func (t *Transfer) inIxfr(ctx context.Context, q *Msg, c chan *Envelope) {
 	var serial uint32 // The first serial seen is the current server serial
 	axfr := true
 	n := 0
 	qser := q.Ns[0].(*SOA).Serial
 	defer t.Close()
 	defer close(c)
-	timeout := dnsTimeout
-	if t.ReadTimeout != 0 {
-		timeout = t.ReadTimeout
-	}
 	for {
-		t.SetReadDeadline(time.Now().Add(timeout))
-		in, err := t.ReadMsg()
+		in, err := t.read(ctx)
 		if err != nil {
 			c <- &Envelope{nil, err}
 			return
 		}
-		if q.Id != in.Id {
+		if q.ID != in.ID {
 			c <- &Envelope{in.Answer, ErrId}
 			return
 		}
@@ -189,12 +194,26 @@ func (t *Transfer) inIxfr(q *Msg, c chan *Envelope) {
 	}
 }
 
+// read reads the next message of the transfer, the error wraps the one of ctx when it is done.
+func (t *Transfer) read(ctx context.Context) (*Msg, error) {
+	timeout := dnsTimeout
+	if t.ReadTimeout != 0 {
+		timeout = t.ReadTimeout
+	}
+	if ctx.Err() == nil {
+		t.Conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	m, err := t.ReadMsg()
+	return m, ctxError(ctx, err)
+}
+
 // Out performs an outgoing transfer with the client connecting in w.
 // Basic use pattern:
 //
 //	ch := make(chan *dns.Envelope)
 //	tr := new(dns.Transfer)
 //	var wg sync.WaitGroup
+//	wg.Add(1)
 //	go func() {
 //		tr.Out(w, r, ch)
 //		wg.Done()
@@ -204,7 +223,8 @@ func (t *Transfer) inIxfr(q *Msg, c chan *Envelope) {
 //	wg.Wait() // wait until everything is written out
 //	w.Close() // close connection
 //
-// The server is responsible for sending the correct sequence of RRs through the channel ch.
+// The server is responsible for sending the correct sequence of RRs through the channel ch. When q is signed
+// with TSIG and it verified, each message is signed.
 func (t *Transfer) Out(w ResponseWriter, q *Msg, ch chan *Envelope) error {
 	for x := range ch {
 		r := new(Msg)
@@ -213,8 +233,9 @@ func (t *Transfer) Out(w ResponseWriter, q *Msg, ch chan *Envelope) error {
 		r.Authoritative = true
 		// assume it fits TODO(miek): fix
 		r.Answer = append(r.Answer, x.RR...)
-		if tsig := q.IsTsig(); tsig != nil && w.TsigStatus() == nil {
-			r.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+		if tsig := q.tsig(); tsig != nil && w.TsigStatus() == nil {
+			r.Pseudo = append(r.Pseudo, &TSIG{Hdr: Header{Name: tsig.Hdr.Name, Class: ClassANY},
+				Algorithm: tsig.Algorithm, Fudge: tsig.Fudge, TimeSigned: uint64(time.Now().Unix())})
 		}
 		if err := w.WriteMsg(r); err != nil {
 			return err
@@ -226,47 +247,59 @@ func (t *Transfer) Out(w ResponseWriter, q *Msg, ch chan *Envelope) error {
 
 // ReadMsg reads a message from the transfer connection t.
 func (t *Transfer) ReadMsg() (*Msg, error) {
-	m := new(Msg)
-	p := make([]byte, MaxMsgSize)
-	n, err := t.Read(p)
-	if err != nil && n == 0 {
-		return nil, err
-	}
-	p = p[:n]
-	if err := m.Unpack(p); err != nil {
+	m, err := readMsg(t.Conn, nil, nil)
+	if err != nil {
 		return nil, err
 	}
-	if ts, tp := m.IsTsig(), t.tsigProvider(); ts != nil && tp != nil {
-		// Need to work on the original message p, as that was used to calculate the tsig.
-		err = TsigVerifyWithProvider(p, tp, t.tsigRequestMAC, t.tsigTimersOnly)
+	if ts, tp := m.tsig(), t.tsigProvider(); ts != nil && tp != nil {
+		// Need to work on the original message data, as that was used to calculate the tsig.
+		err = TsigVerifyWithProvider(m, tp, t.tsigRequestMAC, t.tsigTimersOnly)
 		t.tsigRequestMAC = ts.MAC
 	}
 	return m, err
 }
 
-// WriteMsg writes a message through the transfer connection t.
+// WriteMsg writes a message through the transfer connection t. If m has a TSIG RR in its pseudo section
+// and t has a TsigProvider or TsigSecret, m is signed, otherwise it is packed.
 func (t *Transfer) WriteMsg(m *Msg) (err error) {
-	var out []byte
-	if ts, tp := m.IsTsig(), t.tsigProvider(); ts != nil && tp != nil {
-		out, t.tsigRequestMAC, err = TsigGenerateWithProvider(m, tp, t.tsigRequestMAC, t.tsigTimersOnly)
+	if ts, tp := m.tsig(), t.tsigProvider(); ts != nil && tp != nil {
+		t.tsigRequestMAC, err = TsigGenerateWithProvider(m, tp, t.tsigRequestMAC, t.tsigTimersOnly)
 	} else {
-		out, err = m.Pack()
+		err = m.Pack()
 	}
 	if err != nil {
 		return err
 	}
-	_, err = t.Write(out)
+
+	timeout := dnsTimeout
+	if t.WriteTimeout != 0 {
+		timeout = t.WriteTimeout
+	}
+	t.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2+len(m.Data))
+	binary.BigEndian.PutUint16(buf, uint16(len(m.Data)))
+	copy(buf[2:], m.Data)
+	_, err = t.Conn.Write(buf)
 	return err
 }
 
+// Close closes the connection of the transfer.
+func (t *Transfer) Close() error { return t.Conn.Close() }
+
 func isSOAFirst(in *Msg) bool {
-	return len(in.Answer) > 0 &&
-		in.Answer[0].Header().Rrtype == TypeSOA
+	if len(in.Answer) == 0 {
+		return false
+	}
+	_, ok := in.Answer[0].(*SOA)
+	return ok
 }
 
 func isSOALast(in *Msg) bool {
-	return len(in.Answer) > 0 &&
-		in.Answer[len(in.Answer)-1].Header().Rrtype == TypeSOA
+	if len(in.Answer) == 0 {
+		return false
+	}
+	_, ok := in.Answer[len(in.Answer)-1].(*SOA)
+	return ok
 }
 
 const errXFR = "bad xfr rcode: %d"
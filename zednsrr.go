@@ -2,15 +2,24 @@
 
 package dns
 
-func (rr *NSID) Header() *Header    { return &rr.Hdr }
-func (rr *NSID) Pseudo() bool       { return true }
-func (rr *PADDING) Header() *Header { return &rr.Hdr }
-func (rr *PADDING) Pseudo() bool    { return true }
+func (rr *NSID) Header() *Header         { return &rr.Hdr }
+func (rr *NSID) Pseudo() bool            { return true }
+func (rr *PADDING) Header() *Header      { return &rr.Hdr }
+func (rr *PADDING) Pseudo() bool         { return true }
+func (rr *TCPKEEPALIVE) Header() *Header { return &rr.Hdr }
+func (rr *TCPKEEPALIVE) Pseudo() bool    { return true }
+func (rr *COOKIE) Header() *Header       { return &rr.Hdr }
+func (rr *COOKIE) Pseudo() bool          { return true }
+func (rr *EDE) Header() *Header          { return &rr.Hdr }
+func (rr *EDE) Pseudo() bool             { return true }
 
 // CodeToRR is a map of constructors for each EDNS0 RR type.
 var CodeToRR = map[uint16]func() EDNS0{
-	CodeNSID:    func() EDNS0 { return new(NSID) },
-	CodePADDING: func() EDNS0 { return new(PADDING) },
+	CodeNSID:         func() EDNS0 { return new(NSID) },
+	CodePADDING:      func() EDNS0 { return new(PADDING) },
+	CodeTCPKEEPALIVE: func() EDNS0 { return new(TCPKEEPALIVE) },
+	CodeCOOKIE:       func() EDNS0 { return new(COOKIE) },
+	CodeEDE:          func() EDNS0 { return new(EDE) },
 }
 
 // RRToCode is the reverse of CodeToRR, implemented as a function.
@@ -20,15 +29,27 @@ func RRToCode(rr EDNS0) uint16 {
 		return CodeNSID
 	case *PADDING:
 		return CodePADDING
+	case *TCPKEEPALIVE:
+		return CodeTCPKEEPALIVE
+	case *COOKIE:
+		return CodeCOOKIE
+	case *EDE:
+		return CodeEDE
 	}
 	return CodeNone
 }
 
 // CodeToString is a map of strings for each EDNS0 RR type.
 var CodeToString = map[uint16]string{
-	CodeNSID:    "NSID",
-	CodePADDING: "PADDING",
+	CodeNSID:         "NSID",
+	CodePADDING:      "PADDING",
+	CodeTCPKEEPALIVE: "TCPKEEPALIVE",
+	CodeCOOKIE:       "COOKIE",
+	CodeEDE:          "EDE",
 }
 
-func (rr *NSID) Data() []Field    { return []Field{rr.Nsid} }
-func (rr *PADDING) Data() []Field { return []Field{rr.Padding} }
+func (rr *COOKIE) Data() []Field       { return []Field{rr.Cookie} }
+func (rr *EDE) Data() []Field          { return []Field{rr.InfoCode, rr.ExtraText} }
+func (rr *NSID) Data() []Field         { return []Field{rr.Nsid} }
+func (rr *PADDING) Data() []Field      { return []Field{rr.Padding} }
+func (rr *TCPKEEPALIVE) Data() []Field { return []Field{rr.Timeout} }
@@ -12,6 +12,16 @@ func (rr *ANY) Len() int {
 	return l
 }
 
+func (rr *AXFR) Len() int {
+	l := rr.Hdr.Len()
+	return l
+}
+
+func (rr *IXFR) Len() int {
+	l := rr.Hdr.Len()
+	return l
+}
+
 func (rr *NULL) Len() int {
 	l := rr.Hdr.Len()
 	l += len(rr.Null)
@@ -388,6 +398,20 @@ func (rr *TKEY) Len() int {
 	return l
 }
 
+func (rr *TSIG) Len() int {
+	l := rr.Hdr.Len()
+	l += len(rr.Algorithm)
+	l += 6 // TimeSigned
+	l += 2 // Fudge
+	l += 2 // MACSize
+	l += len(rr.MAC) / 2
+	l += 2 // OrigID
+	l += 2 // Error
+	l += 2 // OtherLen
+	l += len(rr.OtherData) / 2
+	return l
+}
+
 func (rr *RFC3597) Len() int {
 	l := rr.Hdr.Len()
 	l += len(rr.Rdata) / 2
@@ -16,6 +16,30 @@ func (rr *ANY) unpack(data, msgBuf []byte) (err error) {
 	return nil
 }
 
+func (rr *AXFR) pack(msg []byte, off int, compression map[string]uint16) (off1 int, err error) {
+	return off, nil
+}
+
+func (rr *AXFR) unpack(data, msgBuf []byte) (err error) {
+	s := cryptobyte.String(data)
+	if !s.Empty() {
+		return ErrTrailingRData
+	}
+	return nil
+}
+
+func (rr *IXFR) pack(msg []byte, off int, compression map[string]uint16) (off1 int, err error) {
+	return off, nil
+}
+
+func (rr *IXFR) unpack(data, msgBuf []byte) (err error) {
+	s := cryptobyte.String(data)
+	if !s.Empty() {
+		return ErrTrailingRData
+	}
+	return nil
+}
+
 func (rr *NULL) pack(msg []byte, off int, compression map[string]uint16) (off1 int, err error) {
 	off, err = packStringAny(rr.Null, msg, off)
 	if err != nil {
@@ -1560,6 +1584,84 @@ func (rr *TKEY) unpack(data, msgBuf []byte) (err error) {
 	return nil
 }
 
+func (rr *TSIG) pack(msg []byte, off int, compression map[string]uint16) (off1 int, err error) {
+	off, err = packDomainName(rr.Algorithm, msg, off, compression, false)
+	if err != nil {
+		return off, err
+	}
+	off, err = packUint48(rr.TimeSigned, msg, off)
+	if err != nil {
+		return off, err
+	}
+	off, err = packUint16(rr.Fudge, msg, off)
+	if err != nil {
+		return off, err
+	}
+	off, err = packUint16(rr.MACSize, msg, off)
+	if err != nil {
+		return off, err
+	}
+	off, err = packStringHex(rr.MAC, msg, off)
+	if err != nil {
+		return off, err
+	}
+	off, err = packUint16(rr.OrigID, msg, off)
+	if err != nil {
+		return off, err
+	}
+	off, err = packUint16(rr.Error, msg, off)
+	if err != nil {
+		return off, err
+	}
+	off, err = packUint16(rr.OtherLen, msg, off)
+	if err != nil {
+		return off, err
+	}
+	off, err = packStringHex(rr.OtherData, msg, off)
+	if err != nil {
+		return off, err
+	}
+	return off, nil
+}
+
+func (rr *TSIG) unpack(data, msgBuf []byte) (err error) {
+	s := cryptobyte.String(data)
+	rr.Algorithm, err = unpackName(&s, msgBuf)
+	if err != nil {
+		return err
+	}
+	if !s.ReadUint48(&rr.TimeSigned) {
+		return ErrUnpackOverflow
+	}
+	if !s.ReadUint16(&rr.Fudge) {
+		return ErrUnpackOverflow
+	}
+	if !s.ReadUint16(&rr.MACSize) {
+		return ErrUnpackOverflow
+	}
+	rr.MAC, err = unpackStringHex(&s, int(rr.MACSize))
+	if err != nil {
+		return err
+	}
+	if !s.ReadUint16(&rr.OrigID) {
+		return ErrUnpackOverflow
+	}
+	if !s.ReadUint16(&rr.Error) {
+		return ErrUnpackOverflow
+	}
+	if !s.ReadUint16(&rr.OtherLen) {
+		return ErrUnpackOverflow
+	}
+	rr.OtherData, err = unpackStringHex(&s, int(rr.OtherLen))
+	if err != nil {
+		return err
+	}
+	if !s.Empty() {
+		return ErrTrailingRData
+	}
+	return nil
+}
+
 func (rr *RFC3597) pack(msg []byte, off int, compression map[string]uint16) (off1 int, err error) {
 	off, err = packStringHex(rr.Rdata, msg, off)
 	if err != nil {
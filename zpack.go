@@ -10,6 +10,10 @@ func pack(rr RR, msg []byte, off int, compression map[string]uint16) (int, error
 	switch x := rr.(type) {
 	case *ANY:
 		return x.pack(msg, off, compression)
+	case *AXFR:
+		return x.pack(msg, off, compression)
+	case *IXFR:
+		return x.pack(msg, off, compression)
 	case *NULL:
 		return x.pack(msg, off, compression)
 	case *CNAME:
@@ -108,6 +112,8 @@ func pack(rr RR, msg []byte, off int, compression map[string]uint16) (int, error
 		return x.pack(msg, off, compression)
 	case *TKEY:
 		return x.pack(msg, off, compression)
+	case *TSIG:
+		return x.pack(msg, off, compression)
 	case *URI:
 		return x.pack(msg, off, compression)
 	case *DHCID:
@@ -166,6 +172,10 @@ func unpack(rr RR, data, msgBuf []byte) error {
 	switch x := rr.(type) {
 	case *ANY:
 		return x.unpack(data, msgBuf)
+	case *AXFR:
+		return x.unpack(data, msgBuf)
+	case *IXFR:
+		return x.unpack(data, msgBuf)
 	case *NULL:
 		return x.unpack(data, msgBuf)
 	case *CNAME:
@@ -264,6 +274,8 @@ func unpack(rr RR, data, msgBuf []byte) error {
 		return x.unpack(data, msgBuf)
 	case *TKEY:
 		return x.unpack(data, msgBuf)
+	case *TSIG:
+		return x.unpack(data, msgBuf)
 	case *URI:
 		return x.unpack(data, msgBuf)
 	case *DHCID:
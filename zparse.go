@@ -6,6 +6,10 @@ func parse(rr RR, c *zlexer, o string) *ParseError {
 	switch x := rr.(type) {
 	case *ANY:
 		return x.parse(c, o)
+	case *AXFR:
+		return x.parse(c, o)
+	case *IXFR:
+		return x.parse(c, o)
 	case *NULL:
 		return x.parse(c, o)
 	case *CNAME:
@@ -104,6 +108,8 @@ func parse(rr RR, c *zlexer, o string) *ParseError {
 		return x.parse(c, o)
 	case *TKEY:
 		return x.parse(c, o)
+	case *TSIG:
+		return x.parse(c, o)
 	case *URI:
 		return x.parse(c, o)
 	case *DHCID:
@@ -3,6 +3,8 @@
 package dns
 
 func (rr *ANY) Header() *Header        { return &rr.Hdr }
+func (rr *AXFR) Header() *Header       { return &rr.Hdr }
+func (rr *IXFR) Header() *Header       { return &rr.Hdr }
 func (rr *NULL) Header() *Header       { return &rr.Hdr }
 func (rr *CNAME) Header() *Header      { return &rr.Hdr }
 func (rr *HINFO) Header() *Header      { return &rr.Hdr }
@@ -52,6 +54,7 @@ func (rr *NSAPPTR) Header() *Header    { return &rr.Hdr }
 func (rr *NSEC3) Header() *Header      { return &rr.Hdr }
 func (rr *NSEC3PARAM) Header() *Header { return &rr.Hdr }
 func (rr *TKEY) Header() *Header       { return &rr.Hdr }
+func (rr *TSIG) Header() *Header       { return &rr.Hdr }
 func (rr *URI) Header() *Header        { return &rr.Hdr }
 func (rr *DHCID) Header() *Header      { return &rr.Hdr }
 func (rr *TLSA) Header() *Header       { return &rr.Hdr }
@@ -79,6 +82,8 @@ func (rr *APL) Header() *Header        { return &rr.Hdr }
 // TypeToRR is a map of constructors for each RR type.
 var TypeToRR = map[uint16]func() RR{
 	TypeANY:        func() RR { return new(ANY) },
+	TypeAXFR:       func() RR { return new(AXFR) },
+	TypeIXFR:       func() RR { return new(IXFR) },
 	TypeNULL:       func() RR { return new(NULL) },
 	TypeCNAME:      func() RR { return new(CNAME) },
 	TypeHINFO:      func() RR { return new(HINFO) },
@@ -128,6 +133,7 @@ var TypeToRR = map[uint16]func() RR{
 	TypeNSEC3:      func() RR { return new(NSEC3) },
 	TypeNSEC3PARAM: func() RR { return new(NSEC3PARAM) },
 	TypeTKEY:       func() RR { return new(TKEY) },
+	TypeTSIG:       func() RR { return new(TSIG) },
 	TypeURI:        func() RR { return new(URI) },
 	TypeDHCID:      func() RR { return new(DHCID) },
 	TypeTLSA:       func() RR { return new(TLSA) },
@@ -158,6 +164,10 @@ func RRToType(rr RR) uint16 {
 	switch rr.(type) {
 	case *ANY:
 		return TypeANY
+	case *AXFR:
+		return TypeAXFR
+	case *IXFR:
+		return TypeIXFR
 	case *NULL:
 		return TypeNULL
 	case *CNAME:
@@ -256,6 +266,8 @@ func RRToType(rr RR) uint16 {
 		return TypeNSEC3PARAM
 	case *TKEY:
 		return TypeTKEY
+	case *TSIG:
+		return TypeTSIG
 	case *URI:
 		return TypeURI
 	case *DHCID:
@@ -313,6 +325,8 @@ func RRToType(rr RR) uint16 {
 // TypeToString is a map of strings for each RR type.
 var TypeToString = map[uint16]string{
 	TypeANY:        "ANY",
+	TypeAXFR:       "AXFR",
+	TypeIXFR:       "IXFR",
 	TypeNULL:       "NULL",
 	TypeCNAME:      "CNAME",
 	TypeHINFO:      "HINFO",
@@ -361,6 +375,7 @@ var TypeToString = map[uint16]string{
 	TypeNSEC3:      "NSEC3",
 	TypeNSEC3PARAM: "NSEC3PARAM",
 	TypeTKEY:       "TKEY",
+	TypeTSIG:       "TSIG",
 	TypeURI:        "URI",
 	TypeDHCID:      "DHCID",
 	TypeTLSA:       "TLSA",
@@ -397,6 +412,7 @@ func (rr *ANY) Data() []Field       { return []Field{} }
 func (rr *APL) Data() []Field       { return []Field{rr.Prefixes} }
 func (rr *APLPrefix) Data() []Field { return []Field{rr.Negation, rr.Network} }
 func (rr *AVC) Data() []Field       { return []Field{rr.Txt} }
+func (rr *AXFR) Data() []Field      { return []Field{} }
 func (rr *CAA) Data() []Field       { return []Field{rr.Flag, rr.Tag, rr.Value} }
 func (rr *CDNSKEY) Data() []Field   { return []Field{} }
 func (rr *CDS) Data() []Field       { return []Field{} }
@@ -420,10 +436,11 @@ func (rr *HIP) Data() []Field {
 func (rr *IPSECKEY) Data() []Field {
 	return []Field{rr.Precedence, rr.GatewayType, rr.Algorithm, rr.GatewayAddr, rr.GatewayHost, rr.PublicKey}
 }
-func (rr *KEY) Data() []Field { return []Field{} }
-func (rr *KX) Data() []Field  { return []Field{rr.Preference, rr.Exchanger} }
-func (rr *L32) Data() []Field { return []Field{rr.Preference, rr.Locator32} }
-func (rr *L64) Data() []Field { return []Field{rr.Preference, rr.Locator64} }
+func (rr *IXFR) Data() []Field { return []Field{} }
+func (rr *KEY) Data() []Field  { return []Field{} }
+func (rr *KX) Data() []Field   { return []Field{rr.Preference, rr.Exchanger} }
+func (rr *L32) Data() []Field  { return []Field{rr.Preference, rr.Locator32} }
+func (rr *L64) Data() []Field  { return []Field{rr.Preference, rr.Locator64} }
 func (rr *LOC) Data() []Field {
 	return []Field{rr.Version, rr.Size, rr.HorizPre, rr.VertPre, rr.Latitude, rr.Longitude, rr.Altitude}
 }
@@ -480,6 +497,9 @@ func (rr *TKEY) Data() []Field {
 func (rr *TLSA) Data() []Field {
 	return []Field{rr.Usage, rr.Selector, rr.MatchingType, rr.Certificate}
 }
+func (rr *TSIG) Data() []Field {
+	return []Field{rr.Algorithm, rr.TimeSigned, rr.Fudge, rr.MACSize, rr.MAC, rr.OrigID, rr.Error, rr.OtherLen, rr.OtherData}
+}
 func (rr *TXT) Data() []Field    { return []Field{rr.Txt} }
 func (rr *UID) Data() []Field    { return []Field{rr.Uid} }
 func (rr *UINFO) Data() []Field  { return []Field{rr.Uinfo} }